@@ -1,6 +1,7 @@
 package elastic
 
 import (
+	"context"
 	"datawaves/errors"
 	"fmt"
 	"net/http"
@@ -11,14 +12,14 @@ import (
 )
 
 var opNamesMap = map[string]string{
-	"sum":            "sum",
-	"min":            "min",
-	"max":            "max",
-	"avg":            "avg",
-	"cardinality":    "count",
-	"percentiles":    "percentiles",
-	"extended_stats": "standard_deviation",
-	"median":         "median",
+	"sum":                       "sum",
+	"min":                       "min",
+	"max":                       "max",
+	"avg":                       "avg",
+	"cardinality":               "count",
+	"percentiles":               "percentiles",
+	"extended_stats":            "standard_deviation",
+	"median_absolute_deviation": "median",
 }
 
 func aggs(r *http.Request, op, idx, body string) (interface{}, error) {
@@ -36,7 +37,26 @@ func aggs(r *http.Request, op, idx, body string) (interface{}, error) {
 		return nil, errors.New("Missing target_property!")
 	}
 
-	query := search.GetQuery(op)
+	if search.Compare != nil {
+		return compare(&search, opNamesMap[op], func(search *Search) (interface{}, error) {
+			return backend.Aggregate(r.Context(), op, search)
+		})
+	}
+
+	return backend.Aggregate(r.Context(), op, &search)
+}
+
+func (es *Elasticsearch) Aggregate(ctx context.Context, op string, search *Search) (interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	idx := search.Index
+
+	es.loadMapping(ctx, search, op)
+
+	query, err := search.GetQuery(op)
+	if err != nil {
+		return nil, err
+	}
 
 	size := 0
 	// Set up the request object.
@@ -47,28 +67,28 @@ func aggs(r *http.Request, op, idx, body string) (interface{}, error) {
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error processing documents!")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Failed to process documents!")
 	}
 
 	var rr map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&rr)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error decoding response!")
 	}
 
 	_aggs, ok := rr["aggregations"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
@@ -107,6 +127,10 @@ func aggs(r *http.Request, op, idx, body string) (interface{}, error) {
 					x["start"] = v
 				}
 
+				if k == "key" {
+					x["end"] = search.BucketEnd(v)
+				}
+
 				if k == op+"_value" {
 					z, ok := v.(map[string]interface{})
 					if !ok {
@@ -117,61 +141,39 @@ func aggs(r *http.Request, op, idx, body string) (interface{}, error) {
 
 				}
 			}
+
+			if len(search.GroupBy) > 0 {
+				x["value"] = search.groupRows(yy, func(bucket, row map[string]interface{}) {
+					z, ok := bucket[op+"_value"].(map[string]interface{})
+					if ok {
+						row[opNamesMap[op]] = z[L]
+					}
+				})
+			}
+
 			y = append(y, x)
 		}
 
 		return y, nil
 	}
 
-	if search.GroupBy != "" {
-		rslt, ok := _aggs["result"].(map[string]interface{})
-		if !ok {
+	if len(search.GroupBy) > 0 {
+		if _, ok := _aggs["result"].(map[string]interface{}); !ok {
 			goto Value
 		}
 
-		rs, ok := rslt["buckets"].([]interface{})
-		if !ok {
-			goto Value
-		}
-
-		y := []map[string]interface{}{}
-		for i := range rs {
-			x := make(map[string]interface{})
-
-			yy, ok := rs[i].(map[string]interface{})
-			if !ok {
-				continue
+		return search.groupRows(_aggs, func(bucket, row map[string]interface{}) {
+			z, ok := bucket[op+"_value"].(map[string]interface{})
+			if ok {
+				row[opNamesMap[op]] = z[L]
 			}
-			for k, v := range yy {
-				if k == "doc_count" {
-					x["count"] = v
-				}
-
-				if k == "key" {
-
-					x[search.GroupBy] = v
-				}
-
-				if k == op+"_value" {
-					z, ok := v.(map[string]interface{})
-					if !ok {
-						continue
-					}
-
-					x[opNamesMap[op]] = z[L]
-
-				}
-			}
-			y = append(y, x)
-		}
-
-		return y, nil
+		}), nil
 	}
 
 Value:
 	aggs, ok := _aggs[op+"_value"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
@@ -0,0 +1,52 @@
+package elastic
+
+import (
+	"context"
+)
+
+// Backend is the store events are recorded to and analysed from.
+// The package functions decode and validate requests and then go through
+// the backend, Elasticsearch is the one used in production.
+type Backend interface {
+	Count(ctx context.Context, search *Search) (interface{}, error)
+	// op is the elasticsearch name of the aggregation, like "sum" or "cardinality"
+	Aggregate(ctx context.Context, op string, search *Search) (interface{}, error)
+	Percentiles(ctx context.Context, search *Search) (map[string]interface{}, error)
+	SelectUnique(ctx context.Context, search *Search) ([]interface{}, error)
+	MultiAnalysis(ctx context.Context, search *Search, analyses map[string]Analysis) (interface{}, error)
+	// ActorEvents returns the sorted epoch millis of the events matching the search for each actor,
+	// it fails when there are more than maxFunnelBuckets actor/timestamp pairs
+	ActorEvents(ctx context.Context, search *Search, actorProperty string) (map[string][]int64, error)
+
+	// Record saves the document, that already has its datawaves metadata
+	Record(ctx context.Context, idx, id string, doc map[string]interface{}) error
+	// RecordBulk returns the result of every action of the bulk, in order
+	RecordBulk(ctx context.Context, body string) ([]BulkItem, error)
+
+	GetMapping(ctx context.Context, idx string) (map[string]string, error)
+	DescribeCollection(ctx context.Context, idx string) (*CollectionDescription, error)
+
+	// RegisterCollection adds the collection to the project's registry if it isn't there yet
+	RegisterCollection(ctx context.Context, projectID, collection string) (*Collection, error)
+	Collections(ctx context.Context, projectID string) ([]Collection, error)
+	// SetSchema maps the collection's index with the schema and saves it in the registry
+	SetSchema(ctx context.Context, projectID, collection string, schema *Schema) (*Collection, error)
+	// Schema returns the schema of the index's collection, nil when it has none
+	Schema(ctx context.Context, idx string) (*Schema, error)
+	// ReindexCollection starts copying the collection to an index with the changed property types
+	ReindexCollection(ctx context.Context, projectID, collection string, changes []PropertyChange) (*Reindexing, error)
+	ReindexingProgress(ctx context.Context, projectID, collection string) (*Reindexing, error)
+}
+
+var backend Backend
+
+// SetBackend replaces the backend every package function goes through,
+// it has to be set with Connect or SetBackend before using them.
+// Tests use it to run without an elasticsearch cluster.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+func GetBackend() Backend {
+	return backend
+}
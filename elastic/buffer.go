@@ -0,0 +1,638 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Default config of the ingestion buffer
+const (
+	DefaultBufferBatchSize     = 500
+	DefaultBufferFlushInterval = time.Second
+	DefaultBufferMaxBytes      = 64 << 20
+	DefaultBufferMaxWait       = 5 * time.Second
+)
+
+// bufferRetryBackoff is the first wait before flushing again when draining, it doubles up to the flush interval
+const bufferRetryBackoff = 100 * time.Millisecond
+
+// deadLetterFile is the file of the buffer's directory with the events the cluster rejected
+const deadLetterFile = "dead-letter.jsonl"
+
+// BufferConfig is how the ingestion buffer batches the events, zero values are the defaults
+type BufferConfig struct {
+	// Dir is the directory of the write-ahead files, it is required
+	Dir string
+	// BatchSize is how many events are flushed in a bulk, a flush starts as soon as there are that many
+	BatchSize int
+	// FlushInterval is how long the events wait at most before being flushed
+	FlushInterval time.Duration
+	// MaxBytes bounds the size of the events waiting to be flushed, encoded as in the write-ahead
+	// files, Record waits for room above it. An event bigger than that waits for an empty buffer.
+	MaxBytes int64
+	// MaxWait is how long Record waits for room before failing
+	MaxWait time.Duration
+}
+
+// LoadBufferConfig returns the config of the environment's buffer, its directory is the
+// INGEST_BUFFER_DIR environment variable. Without it ok is false, the events are indexed one by one.
+func LoadBufferConfig() (cfg BufferConfig, ok bool) {
+	dir := os.Getenv("INGEST_BUFFER_DIR")
+	if dir == "" {
+		return BufferConfig{}, false
+	}
+
+	return BufferConfig{Dir: dir}, true
+}
+
+// bufferedEvent is an event waiting to be flushed, a line of the write-ahead files
+type bufferedEvent struct {
+	Index string                 `json:"index"`
+	ID    string                 `json:"id"`
+	Doc   map[string]interface{} `json:"doc"`
+	// segment is the number of the write-ahead file of the event
+	segment int64
+	// size is the size of its line
+	size int64
+}
+
+// Buffer queues the recorded events and flushes them to the backend in bulks, by size or time.
+// Accepted events are first appended to a write-ahead file, the events of a directory that weren't
+// flushed are queued again by the next buffer created with it, after a crash for instance.
+// Events are created with their ID so flushing one twice doesn't duplicate it, see idempotencyKey.
+// The ones the cluster rejects are moved to the directory's dead letter file.
+type Buffer struct {
+	cfg BufferConfig
+
+	mu     sync.Mutex
+	events []*bufferedEvent
+	// size is the size of the events, see MaxBytes
+	size int64
+	// room is closed when events are flushed, Add waits for it when the buffer is full
+	room   chan struct{}
+	closed bool
+
+	// wal is the write-ahead file events are appended to, segment its number
+	wal     *os.File
+	walSize int64
+	segment int64
+	// pending is how many events of each segment aren't flushed yet
+	pending map[int64]int
+
+	// appended is how many bytes were appended to the write-ahead files and synced how many are on disk,
+	// a single sync covers the events appended by every writer waiting for syncMu
+	appended int64
+	synced   int64
+	syncMu   sync.Mutex
+
+	// ctx is cancelled when Close gives up draining, it cancels the flush in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	flush chan struct{}
+	drain chan struct{}
+	done  chan struct{}
+}
+
+// NewBuffer creates the buffer and starts flushing it,
+// with the events of the directory's write-ahead files first
+func NewBuffer(cfg BufferConfig) (*Buffer, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("The buffer needs a directory to keep the events until they are flushed!")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBufferBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultBufferFlushInterval
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultBufferMaxBytes
+	}
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = DefaultBufferMaxWait
+	}
+
+	b := &Buffer{
+		cfg:     cfg,
+		events:  []*bufferedEvent{},
+		room:    make(chan struct{}),
+		pending: make(map[int64]int),
+		flush:   make(chan struct{}, 1),
+		drain:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	err := b.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.openSegment(b.segment + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	go b.run()
+
+	if len(b.events) > 0 {
+		b.flush <- struct{}{}
+	}
+
+	return b, nil
+}
+
+func (b *Buffer) segmentPath(segment int64) string {
+	return filepath.Join(b.cfg.Dir, fmt.Sprintf("%020d.wal", segment))
+}
+
+// replay queues the events of the write-ahead files in order
+func (b *Buffer) replay() error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	err := os.MkdirAll(b.cfg.Dir, 0700)
+	if err != nil {
+		errors.Log(err, "Error creating the buffer directory "+b.cfg.Dir+".")
+		return errors.New("Error creating the buffer directory!")
+	}
+
+	paths, err := filepath.Glob(filepath.Join(b.cfg.Dir, "*.wal"))
+	if err != nil {
+		errors.Log(err, "Error listing the write-ahead files of "+b.cfg.Dir+".")
+		return errors.New("Error listing the write-ahead files!")
+	}
+
+	segments := []int64{}
+	for _, path := range paths {
+		segment, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".wal"), 10, 64)
+		if err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	for _, segment := range segments {
+		f, err := os.Open(b.segmentPath(segment))
+		if err != nil {
+			errors.Log(err, "Error opening the write-ahead file "+b.segmentPath(segment)+".")
+			return errors.New("Error reading the write-ahead files!")
+		}
+
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				var e bufferedEvent
+				// the last line is cut when writing it failed
+				if json.Unmarshal(line, &e) != nil || e.Index == "" || e.ID == "" {
+					errors.Log(errors.New(fmt.Sprintf("Invalid write-ahead event.\nSegment: %d.\nLine: %s.", segment, line)))
+				} else {
+					e.segment = segment
+					e.size = int64(len(line))
+					b.events = append(b.events, &e)
+					b.size += e.size
+					b.pending[segment]++
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				errors.Log(err, "Error reading the write-ahead file "+b.segmentPath(segment)+".")
+				return errors.New("Error reading the write-ahead files!")
+			}
+		}
+		f.Close()
+
+		if b.pending[segment] == 0 {
+			os.Remove(b.segmentPath(segment))
+		}
+		b.segment = segment
+	}
+
+	return nil
+}
+
+// openSegment replaces the write-ahead file events are appended to,
+// the previous one is synced first
+func (b *Buffer) openSegment(segment int64) error {
+	f, err := os.OpenFile(b.segmentPath(segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		errors.Log(err, "Error creating the write-ahead file "+b.segmentPath(segment)+".")
+		return errors.New("Error creating the write-ahead file!")
+	}
+
+	if b.wal != nil {
+		err = b.wal.Sync()
+		if err != nil {
+			f.Close()
+			os.Remove(b.segmentPath(segment))
+			errors.Log(err, "Error syncing the write-ahead file "+b.segmentPath(b.segment)+".")
+			return errors.New("Error syncing the write-ahead file!")
+		}
+		b.synced = b.appended
+
+		b.wal.Close()
+		if b.pending[b.segment] == 0 {
+			delete(b.pending, b.segment)
+			os.Remove(b.segmentPath(b.segment))
+		}
+	}
+
+	b.wal = f
+	b.walSize = 0
+	b.segment = segment
+
+	return nil
+}
+
+// Add queues the event, that already has its datawaves metadata. It is on disk in the write-ahead
+// file when it returns, when the buffer is full it waits for room for MaxWait at most.
+func (b *Buffer) Add(ctx context.Context, idx, id string, doc map[string]interface{}) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	e := &bufferedEvent{Index: idx, ID: id, Doc: doc}
+	line, err := json.Marshal(e)
+	if err != nil {
+		errors.Log(err, "Error encoding data.\nIndex: "+idx+".\nDocument ID: "+id+".")
+		return errors.New("Error decoding document.")
+	}
+	line = append(line, '\n')
+	e.size = int64(len(line))
+
+	timer := time.NewTimer(b.cfg.MaxWait)
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return errors.New("The server is shutting down, retry later!")
+		}
+		if len(b.events) == 0 || b.size+e.size <= b.cfg.MaxBytes {
+			break
+		}
+		room := b.room
+		b.mu.Unlock()
+
+		select {
+		case <-room:
+		case <-timer.C:
+			return errors.New("Too many events are waiting to be recorded, retry later!")
+		case <-ctx.Done():
+			return errors.New("Too many events are waiting to be recorded, retry later!")
+		}
+	}
+
+	_, err = b.wal.Write(line)
+	if err != nil {
+		errors.Log(err, "Error writing the write-ahead file.\nIndex: "+idx+".\nDocument ID: "+id+".")
+		// the next events shouldn't follow a cut line
+		b.wal.Truncate(b.walSize)
+		b.mu.Unlock()
+		return errors.New("Error saving document.")
+	}
+	b.walSize += int64(len(line))
+	b.appended += int64(len(line))
+	offset := b.appended
+
+	e.segment = b.segment
+	b.events = append(b.events, e)
+	b.size += e.size
+	b.pending[e.segment]++
+
+	if len(b.events) >= b.cfg.BatchSize {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+	b.mu.Unlock()
+
+	// the event may be flushed before it is synced, it is recorded even when syncing fails
+	err = b.sync(offset)
+	if err != nil {
+		errors.Log(err, "Error syncing the write-ahead file.\nIndex: "+idx+".\nDocument ID: "+id+".")
+		return errors.New("Error saving document.")
+	}
+
+	return nil
+}
+
+// sync makes sure what was appended to the write-ahead files up to offset is on disk,
+// the writers waiting while a sync is in progress are covered by the next one
+func (b *Buffer) sync(offset int64) error {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	b.mu.Lock()
+	if b.synced >= offset {
+		b.mu.Unlock()
+		return nil
+	}
+	wal := b.wal
+	appended := b.appended
+	b.mu.Unlock()
+
+	err := wal.Sync()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the file was synced and closed when rotating
+	if err != nil && b.synced < offset {
+		return err
+	}
+	if appended > b.synced {
+		b.synced = appended
+	}
+
+	return nil
+}
+
+// Len returns how many events are waiting to be flushed
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.events)
+}
+
+func (b *Buffer) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.flush:
+		case <-ticker.C:
+		case <-b.drain:
+			b.drainEvents()
+			return
+		}
+
+		// full batches are flushed right away, failed ones with the next tick
+		for b.flushBatch() && b.Len() >= b.cfg.BatchSize {
+		}
+	}
+}
+
+// drainEvents flushes every event, retrying with backoff until Close gives up
+func (b *Buffer) drainEvents() {
+	backoff := bufferRetryBackoff
+	for b.Len() > 0 && b.ctx.Err() == nil {
+		if b.flushBatch() {
+			backoff = bufferRetryBackoff
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+		}
+
+		backoff *= 2
+		if backoff > b.cfg.FlushInterval {
+			backoff = b.cfg.FlushInterval
+		}
+	}
+}
+
+// flushBatch sends the oldest events in a bulk. Events that failed because of the cluster, including
+// write blocks, are kept to be flushed again, the other failures are moved to the dead letter file
+// and duplicates succeed. It returns false when events have to be flushed again.
+func (b *Buffer) flushBatch() bool {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	b.mu.Lock()
+	n := len(b.events)
+	if n > b.cfg.BatchSize {
+		n = b.cfg.BatchSize
+	}
+	if n == 0 {
+		b.mu.Unlock()
+		return true
+	}
+	batch := append([]*bufferedEvent{}, b.events[:n]...)
+
+	// new events go to a new segment so this one can be removed once flushed
+	if !b.closed && b.pending[b.segment] > 0 {
+		err := b.openSegment(b.segment + 1)
+		if err != nil {
+			errors.Log(err, "Error rotating the write-ahead file.")
+		}
+	}
+	b.mu.Unlock()
+
+	// events are settled when they don't have to be flushed again
+	settled := make(map[*bufferedEvent]bool)
+	dead := []deadLetter{}
+
+	sent := []*bufferedEvent{}
+	var bulk strings.Builder
+	for _, e := range batch {
+		meta, err := json.Marshal(map[string]interface{}{"create": map[string]interface{}{"_index": e.Index, "_id": e.ID}})
+		if err == nil {
+			var doc []byte
+			doc, err = json.Marshal(e.Doc)
+			if err == nil {
+				bulk.WriteString(string(meta) + "\n" + string(doc) + "\n")
+				sent = append(sent, e)
+				continue
+			}
+		}
+
+		dead = append(dead, deadLetter{bufferedEvent: e, Error: "encoding error: " + err.Error()})
+	}
+
+	retry := false
+	recorded := make(map[string]bool)
+	if len(sent) > 0 {
+		items, err := backend.RecordBulk(b.ctx, bulk.String())
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Error flushing %d buffered events.", len(sent)))
+			retry = true
+		}
+
+		for j, item := range items {
+			if j >= len(sent) {
+				break
+			}
+			e := sent[j]
+
+			switch {
+			// duplicates were flushed before
+			case !item.Failed() || item.Status == http.StatusConflict:
+				settled[e] = true
+				recorded[e.Index] = true
+			// write blocks while reindexing are forbidden
+			case item.Status == http.StatusTooManyRequests || item.Status == http.StatusForbidden || item.Status >= http.StatusInternalServerError:
+				retry = true
+			default:
+				dead = append(dead, deadLetter{bufferedEvent: e, Status: item.Status, Error: item.Error})
+			}
+		}
+		if len(items) < len(sent) && err == nil {
+			retry = true
+		}
+	}
+
+	if len(dead) > 0 {
+		err := b.writeDeadLetters(dead)
+		if err != nil {
+			// they are kept until they can be written
+			errors.Log(err, fmt.Sprintf("Error writing %d events to the dead letter file.", len(dead)))
+			retry = true
+		} else {
+			for _, d := range dead {
+				settled[d.bufferedEvent] = true
+			}
+		}
+	}
+
+	b.mu.Lock()
+	events := []*bufferedEvent{}
+	for _, e := range batch {
+		if !settled[e] {
+			events = append(events, e)
+			continue
+		}
+
+		b.size -= e.size
+		b.pending[e.segment]--
+		if b.pending[e.segment] <= 0 && e.segment != b.segment {
+			delete(b.pending, e.segment)
+			os.Remove(b.segmentPath(e.segment))
+		}
+	}
+	b.events = append(events, b.events[n:]...)
+
+	close(b.room)
+	b.room = make(chan struct{})
+	b.mu.Unlock()
+
+	for idx := range recorded {
+		registerIndex(b.ctx, idx)
+	}
+
+	return !retry
+}
+
+// deadLetter is an event the cluster rejected, a line of the dead letter file
+type deadLetter struct {
+	*bufferedEvent
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error"`
+	FailedAt string `json:"failed_at"`
+}
+
+// writeDeadLetters appends the events to the dead letter file, they are on disk when it returns
+func (b *Buffer) writeDeadLetters(dead []deadLetter) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var lines bytes.Buffer
+	now := time.Now().UTC().Format(timestampFormat)
+	for _, d := range dead {
+		d.FailedAt = now
+		line, err := json.Marshal(d)
+		if err != nil {
+			// only the event's document can't be encoded
+			line, err = json.Marshal(map[string]interface{}{"index": d.Index, "id": d.ID, "doc": fmt.Sprintf("%v", d.Doc), "error": d.Error, "failed_at": now})
+			if err != nil {
+				return err
+			}
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+
+		errors.Log(errors.New(fmt.Sprintf("Failed to index buffered event, it is in the dead letter file.\nIndex: %s.\nDocument ID: %s.\nStatus: %d.\nError: %s.", d.Index, d.ID, d.Status, d.Error)))
+	}
+
+	f, err := os.OpenFile(filepath.Join(b.cfg.Dir, deadLetterFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(lines.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Close stops accepting events and flushes the buffered ones, retrying until ctx is done.
+// The events that couldn't be flushed stay in the write-ahead files.
+func (b *Buffer) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.drain)
+		// the events waiting for room fail
+		close(b.room)
+		b.room = make(chan struct{})
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		// the flush in progress is cancelled
+		b.cancel()
+		<-b.done
+	}
+
+	// the sync in progress finishes first, its writers would fail on the closed file
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.wal != nil {
+		if b.wal.Sync() == nil {
+			// the writers waiting to sync are on disk
+			b.synced = b.appended
+		}
+		b.wal.Close()
+		if b.pending[b.segment] == 0 {
+			os.Remove(b.segmentPath(b.segment))
+		}
+		b.wal = nil
+	}
+	b.cancel()
+
+	if len(b.events) > 0 {
+		return errors.New(fmt.Sprintf("%d events couldn't be flushed, they are kept in the write-ahead files of %s!", len(b.events), b.cfg.Dir))
+	}
+
+	return nil
+}
+
+var ingestBuffer *Buffer
+
+// SetBuffer makes Record queue the events in the buffer instead of
+// indexing them one by one, nil indexes them one by one again
+func SetBuffer(b *Buffer) {
+	ingestBuffer = b
+}
@@ -0,0 +1,439 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// useBuffer makes a new buffer of a temporary directory the buffer of Record
+// until the returned function is called, which closes it
+func useBuffer(t *testing.T, cfg BufferConfig) (*Buffer, func()) {
+	if cfg.Dir == "" {
+		dir, err := ioutil.TempDir("", "buffer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Dir = dir
+	}
+
+	b, err := NewBuffer(cfg)
+	if err != nil {
+		os.RemoveAll(cfg.Dir)
+		t.Fatal(err)
+	}
+	SetBuffer(b)
+
+	return b, func() {
+		SetBuffer(nil)
+		b.Close(context.Background())
+		os.RemoveAll(cfg.Dir)
+	}
+}
+
+// waitFor fails the test when the condition isn't met within a second
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// assertCount fails the test when the index doesn't have want events
+func assertCount(t *testing.T, r *http.Request, idx string, want int) {
+	t.Helper()
+
+	got, err := Count(r, idx, `{}`)
+	assertJSON(t, got, err, strconv.Itoa(want))
+}
+
+// readDeadLetters returns the lines of the directory's dead letter file
+func readDeadLetters(t *testing.T, dir string) []map[string]interface{} {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	f, err := os.Open(filepath.Join(dir, deadLetterFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// setWriteBlock blocks or unblocks the writes of the index
+func setWriteBlock(t *testing.T, idx string, blocked bool) {
+	// Set up the request object.
+	req := esapi.IndicesPutSettingsRequest{
+		Index: []string{idx},
+		Body:  strings.NewReader(fmt.Sprintf(`{"index.blocks.write":%v}`, blocked)),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(context.Background(), backend.(*Elasticsearch).client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		t.Fatalf("failed to set the write block of %s: %v", idx, res)
+	}
+}
+
+func TestLoadBufferConfig(t *testing.T) {
+	previous, set := os.LookupEnv("INGEST_BUFFER_DIR")
+	defer func() {
+		if set {
+			os.Setenv("INGEST_BUFFER_DIR", previous)
+		} else {
+			os.Unsetenv("INGEST_BUFFER_DIR")
+		}
+	}()
+
+	// the events are indexed one by one without directory
+	os.Unsetenv("INGEST_BUFFER_DIR")
+	if _, ok := LoadBufferConfig(); ok {
+		t.Error("expected no buffer without INGEST_BUFFER_DIR")
+	}
+
+	os.Setenv("INGEST_BUFFER_DIR", "/var/buffer")
+	cfg, ok := LoadBufferConfig()
+	if !ok || cfg.Dir != "/var/buffer" {
+		t.Errorf("got %+v, %v", cfg, ok)
+	}
+}
+
+func TestBufferFlush(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	b, closeBuffer := useBuffer(t, BufferConfig{BatchSize: 2, FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	idx := GetIndex(memoryTestProject, "flushed")
+	for i := 0; i < 3; i++ {
+		err := Record(r, idx, fmt.Sprintf(`{"timestamp":"2020-01-05T10:00:00.000Z","n":%d}`, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a full batch is flushed right away, the last event waits for the interval
+	waitFor(t, "the full batch", func() bool { return b.Len() == 1 })
+	assertCount(t, r, idx, 2)
+
+	err := b.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(t, r, idx, 3)
+
+	// the flushed events are removed from the write-ahead files
+	segments, _ := filepath.Glob(filepath.Join(b.cfg.Dir, "*.wal"))
+	if len(segments) != 0 {
+		t.Errorf("got the write-ahead files %v, want none", segments)
+	}
+	if err := Record(r, idx, `{}`); err == nil {
+		t.Error("expected an error recording in a closed buffer")
+	}
+}
+
+func TestBufferReplay(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx := GetIndex(memoryTestProject, "replayed")
+	meta := `"datawaves":{"timestamp":"2020-01-05T10:00:00.000Z"}`
+	segments := map[int64]string{
+		1: fmt.Sprintf(`{"index":"%s","id":"1","doc":{"n":1,%s}}`+"\n", idx, meta),
+		// the last event is torn, the crash happened while writing it
+		2: fmt.Sprintf(`{"index":"%s","id":"2","doc":{"n":2,%s}}`+"\n", idx, meta) +
+			fmt.Sprintf(`{"index":"%s","id":"3","doc":{"n":3,%s}}`+"\n", idx, meta) +
+			fmt.Sprintf(`{"index":"%s","id":"4","doc":{"n"`, idx),
+	}
+	for segment, data := range segments {
+		err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d.wal", segment)), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, closeBuffer := useBuffer(t, BufferConfig{Dir: dir, FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	// the replayed events are flushed right away, new ones go to a new write-ahead file
+	waitFor(t, "the replayed events", func() bool { return b.Len() == 0 })
+	assertCount(t, r, idx, 3)
+
+	err = Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.segment != 3 {
+		t.Errorf("got segment %d, want 3", b.segment)
+	}
+
+	err = b.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(t, r, idx, 4)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(files) != 0 {
+		t.Errorf("got the write-ahead files %v, want none", files)
+	}
+}
+
+func TestBufferKeepsUnflushedEvents(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, closeBuffer := useBuffer(t, BufferConfig{Dir: dir, FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	idx := GetIndex(memoryTestProject, "kept")
+	for i := 0; i < 2; i++ {
+		err := Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the crash leaves the events in the write-ahead file, the next buffer flushes them
+	b.wal.Close()
+
+	next, err := NewBuffer(BufferConfig{Dir: dir, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = next.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCount(t, r, idx, 2)
+}
+
+func TestBufferDeadLetter(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"rejected": {`{"timestamp":"2020-01-05T10:00:00.000Z","price":1}`},
+	})
+	defer restore()
+
+	b, closeBuffer := useBuffer(t, BufferConfig{BatchSize: 2, FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	idx := GetIndex(memoryTestProject, "rejected")
+	// price is mapped as a number, an object is rejected
+	err := Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z","price":{"amount":1},"datawaves":{"id":"bad"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z","price":2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the flush", func() bool { return b.Len() == 0 })
+
+	dead := readDeadLetters(t, b.cfg.Dir)
+	if len(dead) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(dead))
+	}
+	if dead[0]["id"] != "bad" || dead[0]["index"] != idx || dead[0]["status"] != float64(http.StatusBadRequest) || dead[0]["error"] == "" {
+		t.Errorf("got the dead letter %v", dead[0])
+	}
+
+	assertCount(t, r, idx, 2)
+}
+
+func TestBufferRetriesBlockedWrites(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"blocked": {`{"timestamp":"2020-01-05T10:00:00.000Z"}`},
+	})
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "blocked")
+	setWriteBlock(t, idx, true)
+
+	b, closeBuffer := useBuffer(t, BufferConfig{BatchSize: 1, FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	err := Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write block is forbidden, the event is kept for the next flush
+	time.Sleep(50 * time.Millisecond)
+	if b.Len() != 1 {
+		t.Fatalf("got %d events waiting, want 1", b.Len())
+	}
+	if dead := readDeadLetters(t, b.cfg.Dir); len(dead) != 0 {
+		t.Fatalf("got the dead letters %v, want none", dead)
+	}
+
+	// closing retries until the write block is removed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		setWriteBlock(t, idx, false)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = b.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(t, r, idx, 2)
+}
+
+func TestBufferCloseGivesUp(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"stuck": {`{"timestamp":"2020-01-05T10:00:00.000Z"}`},
+	})
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "stuck")
+	setWriteBlock(t, idx, true)
+
+	b, closeBuffer := useBuffer(t, BufferConfig{FlushInterval: time.Hour})
+	defer closeBuffer()
+
+	err := Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// the event stays in the write-ahead file
+	if err := b.Close(ctx); err == nil {
+		t.Error("expected an error closing with events that can't be flushed")
+	}
+	segments, _ := filepath.Glob(filepath.Join(b.cfg.Dir, "*.wal"))
+	if len(segments) != 1 {
+		t.Errorf("got the write-ahead files %v, want 1", segments)
+	}
+}
+
+func TestBufferMaxBytes(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "bounded")
+	event := `{"timestamp":"2020-01-05T10:00:00.000Z","text":"` + strings.Repeat("a", 1000) + `"}`
+
+	// the batches are never full, the events are only flushed when closing
+	b, closeBuffer := useBuffer(t, BufferConfig{FlushInterval: time.Hour, MaxBytes: 1500, MaxWait: 20 * time.Millisecond})
+	defer closeBuffer()
+
+	err := Record(r, idx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(r, idx, event); err == nil {
+		t.Error("expected an error recording above MaxBytes")
+	}
+	if b.Len() != 1 {
+		t.Errorf("got %d events waiting, want 1", b.Len())
+	}
+
+	// an event bigger than MaxBytes waits for an empty buffer
+	closeBuffer()
+	b, closeBuffer = useBuffer(t, BufferConfig{FlushInterval: time.Hour, MaxBytes: 10, MaxWait: 20 * time.Millisecond})
+	defer closeBuffer()
+
+	err = Record(r, idx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 1 {
+		t.Errorf("got %d events waiting, want 1", b.Len())
+	}
+}
+
+func TestBufferCloseWhileRecording(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	b, closeBuffer := useBuffer(t, BufferConfig{BatchSize: 3, FlushInterval: time.Millisecond})
+	defer closeBuffer()
+
+	idx := GetIndex(memoryTestProject, "closing")
+
+	var mu sync.Mutex
+	accepted := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`) == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond)
+	err := b.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// the events reported as recorded are recorded, the others failed
+	if accepted == 0 {
+		t.Skip("no event was recorded before closing")
+	}
+	assertCount(t, r, idx, accepted)
+}
@@ -2,57 +2,66 @@ package elastic
 
 import (
 	"context"
-	"datawaves/errors"
-	"fmt"
-	"io/ioutil"
 	"regexp"
 	"strings"
-
-	"github.com/elastic/go-elasticsearch/v7/esapi"
 )
 
+// GetCollections returns the names of the project's collections
 func GetCollections(projectID string) []string {
-	collections := []string{}
+	names := []string{}
 
-	// Set up the request object.
-	req := esapi.CatIndicesRequest{
-		Index: []string{projectID + "*"},
+	collections, err := backend.Collections(context.Background(), projectID)
+	if err != nil {
+		return names
 	}
 
-	// Perform the request with the client.
-	res, err := req.Do(context.Background(), client)
-	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response.\nProjectID: %s\nResponse: %v.\n", projectID, res))
-		return collections
+	for _, c := range collections {
+		names = append(names, c.Name)
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error.\nProjectID: %s\nResponse: %v.\n", projectID, res)))
+	return names
+}
+
+// legacyPrefixRe is the project prefixes whose legacy indices can be listed,
+// index patterns can't escape wildcards so other prefixes have none.
+var legacyPrefixRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// legacyCollections finds the collections of a project without registry in the index names,
+// the legacy indices a migrated project owns are not the project's, see MigrateCollections.
+func (es *Elasticsearch) legacyCollections(ctx context.Context, projectID string) []Collection {
+	collections := []Collection{}
+
+	prefix := projectPrefix(projectID)
+	if !legacyPrefixRe.MatchString(prefix) {
 		return collections
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	indices, err := es.catIndices(ctx, prefix+"*", "*"+indexSeparator+"_collections")
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error.\nProjectID: %s\nResponse: %v.\n", projectID, res))
 		return collections
 	}
+	migrated := registryPrefixes(indices)
 
-	// body is returned in the following format:
-	// yellow open bp745pq23akg01vmgfm0posts nFvV9EsGR3aIzJS6INISDw 1 1  2 0 11.1kb 11.1kb
-
+	// legacy indices are the project prefix followed by the collection, without separator,
+	// the collections created since have their new name but are not registered yet
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-create-index.html
+	for _, idx := range indices {
+		if strings.HasPrefix(idx, prefix+indexSeparator) {
+			collection := strings.TrimPrefix(idx, prefix+indexSeparator)
+			if ValidateCollection(collection) == nil {
+				collections = append(collections, Collection{Name: collection, Index: idx})
+			}
+			continue
+		}
 
-	re := regexp.MustCompile(projectID + `[\w\d]*[-_]*[\w\d]*`)
-
-	all := re.FindAll(body, -1)
-	for i := range all {
-		idx := string(all[i])
-		collection := strings.Split(idx, projectID)[1]
-		if collection == projectID {
+		collection := strings.TrimPrefix(idx, prefix)
+		if collection == "" || collection == idx || collection == "datawavesapiusage" || strings.Contains(collection, indexSeparator) {
+			continue
+		}
+		if len(legacyOwners(idx, migrated)) > 0 {
 			continue
 		}
-		collections = append(collections, strings.TrimSpace(collection))
+		collections = append(collections, Collection{Name: collection, Index: idx})
 	}
 
 	return collections
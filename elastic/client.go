@@ -0,0 +1,172 @@
+package elastic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"datawaves/errors"
+	"datawaves/secrets"
+	"datawaves/util"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	nrelasticsearch "github.com/newrelic/go-agent/v3/integrations/nrelasticsearch-v7"
+)
+
+// Config is how to connect to an elasticsearch cluster,
+// in json the CA cert is base64 encoded and the timeouts are in nanoseconds.
+type Config struct {
+	Addresses []string `json:"addresses"`
+	// CloudID replaces the addresses for Elastic Cloud deployments
+	CloudID string `json:"cloud_id"`
+
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// APIKey is the base64 encoded api key, it is used instead of the username and password
+	APIKey string `json:"api_key"`
+
+	// CACert is the PEM encoded certificate authority of the cluster's certificates
+	CACert []byte `json:"ca_cert"`
+
+	// DialTimeout limits connecting to the cluster, and the TLS handshake, when zero it is
+	// http.DefaultTransport's 30 seconds to connect and 10 seconds for the handshake.
+	// ResponseTimeout limits waiting for the response headers, zero means no limit.
+	DialTimeout     time.Duration `json:"dial_timeout"`
+	ResponseTimeout time.Duration `json:"response_timeout"`
+
+	// MaxRetries on network errors and 502, 503 and 504 responses, 3 when zero
+	MaxRetries   int  `json:"max_retries"`
+	DisableRetry bool `json:"disable_retry"`
+	// RetryBackoff is how long to wait before a retry, no wait when nil
+	RetryBackoff func(attempt int) time.Duration `json:"-"`
+
+	// Transport sends the requests, like a Memory cluster.
+	// When nil it is an http.Transport with the timeouts and the CA cert.
+	Transport http.RoundTripper `json:"-"`
+	// WrapTransport wraps the transport, like nrelasticsearch.NewRoundTripper to trace the requests
+	WrapTransport func(http.RoundTripper) http.RoundTripper `json:"-"`
+}
+
+// NewClient creates the elasticsearch client for the config
+func NewClient(cfg Config) (*elasticsearch.Client, error) {
+	client, _, err := newClient(cfg)
+	return client, err
+}
+
+// newClient also returns the transport the client sends the requests with, before it is wrapped
+func newClient(cfg Config) (*elasticsearch.Client, http.RoundTripper, error) {
+	if len(cfg.Addresses) == 0 && cfg.CloudID == "" {
+		return nil, nil, errors.New("Missing cluster addresses!")
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = cfg.ResponseTimeout
+		if cfg.DialTimeout > 0 {
+			t.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+			t.TLSHandshakeTimeout = cfg.DialTimeout
+		}
+
+		if len(cfg.CACert) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(cfg.CACert) {
+				return nil, nil, errors.New("Invalid CA certificate!")
+			}
+			t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+
+		transport = t
+	} else if len(cfg.CACert) > 0 {
+		return nil, nil, errors.New("The CA certificate can't be set on a custom transport!")
+	}
+
+	base := transport
+	if cfg.WrapTransport != nil {
+		transport = cfg.WrapTransport(transport)
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses:    cfg.Addresses,
+		CloudID:      cfg.CloudID,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		APIKey:       cfg.APIKey,
+		MaxRetries:   cfg.MaxRetries,
+		DisableRetry: cfg.DisableRetry,
+		RetryBackoff: cfg.RetryBackoff,
+		Transport:    transport,
+	})
+	if err != nil {
+		errors.Log(err, "Error creating the elasticsearch client.")
+		return nil, nil, errors.New("Error creating client!")
+	}
+
+	return client, base, nil
+}
+
+// LoadConfig returns the config of the environment's cluster, in production it is
+// read from Secret Manager and traced with New Relic, elsewhere from the
+// elasticsearch_testing_url, _user and _pass environment variables.
+func LoadConfig() (Config, error) {
+	if !util.IsProduction() {
+		return Config{
+			Addresses: []string{os.Getenv("elasticsearch_testing_url")},
+			Username:  os.Getenv("elasticsearch_testing_user"),
+			Password:  os.Getenv("elasticsearch_testing_pass"),
+		}, nil
+	}
+
+	url, err := secrets.Get("elasticsearch_url")
+	if err != nil {
+		return Config{}, err
+	}
+
+	user, err := secrets.Get("elasticsearch_user")
+	if err != nil {
+		return Config{}, err
+	}
+
+	pass, err := secrets.Get("elasticsearch_pass")
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		Addresses:     []string{url},
+		Username:      user,
+		Password:      pass,
+		WrapTransport: nrelasticsearch.NewRoundTripper,
+	}, nil
+}
+
+// Connect sets the backend to a Router with the environment's default cluster,
+// see LoadConfig, and its dedicated clusters, see LoadClusters.
+// When the dedicated clusters can't be loaded every project uses the default one.
+func Connect() error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	router := NewRouter(NewElasticsearch(client))
+
+	registry, err := LoadClusters()
+	if err == nil {
+		err = router.Reload(registry)
+	}
+	if err != nil {
+		errors.Log(err, "Error loading the elasticsearch clusters.")
+	}
+
+	SetBackend(router)
+
+	return nil
+}
@@ -0,0 +1,735 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// collection names are case insensitive, the case they were created with is kept as their name
+var collectionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,199}$`)
+
+// Collection is a collection of the project's registry
+type Collection struct {
+	Name      string `json:"name"`
+	Index     string `json:"index"`
+	CreatedAt string `json:"created_at"`
+	// Schema is set with SetSchema, nil when events are not checked
+	Schema *Schema `json:"schema,omitempty"`
+	// Reindexing is the last time the types of its properties were changed, see ReindexCollection
+	Reindexing *Reindexing `json:"reindexing,omitempty"`
+	// not stored, it is counted when listing the collections
+	EventCount int64 `json:"event_count"`
+}
+
+// CollectionMigration is what MigrateCollections did to the legacy indices
+type CollectionMigration struct {
+	// legacy index to the alias with its new name
+	Migrated map[string]string `json:"migrated"`
+	// legacy index to the projects it could belong to, they are left to migrate by hand
+	Ambiguous map[string][]string `json:"ambiguous"`
+	// legacy index to why it couldn't be migrated
+	Skipped map[string]string `json:"skipped"`
+}
+
+func ValidateCollection(collection string) error {
+	if !collectionRe.MatchString(collection) {
+		return errors.New(fmt.Sprintf("Invalid collection \"%s\", it should start with a letter or a digit and only have letters, digits, _ and -!", collection))
+	}
+	return nil
+}
+
+// registryIndex is the index of the project's collection registry
+func registryIndex(projectID string) string {
+	return projectPrefix(projectID) + indexSeparator + "_collections"
+}
+
+// registered is the indices already in their project's registry
+var registered sync.Map
+
+// registerIndex adds the collection of the index to the registry the first time it is written to,
+// failing to do so doesn't fail the write.
+func registerIndex(ctx context.Context, idx string) {
+	if _, ok := registered.Load(idx); ok {
+		return
+	}
+
+	i := strings.Index(idx, indexSeparator)
+	if i <= 0 || ValidateCollection(idx[i+1:]) != nil {
+		// legacy or internal index
+		return
+	}
+	if !projectMigrated(idx[:i]) {
+		// the migration registers it with the legacy collections
+		return
+	}
+
+	_, err := backend.RegisterCollection(ctx, idx[:i], idx[i+1:])
+	if err != nil {
+		errors.Log(err, "Error registering the collection of index "+idx+".")
+		return
+	}
+
+	registered.Store(idx, true)
+}
+
+// RegisterCollection adds the collection to the project's registry, it is
+// returned as is when already there. Collections written to are registered too.
+func RegisterCollection(r *http.Request, projectID, collection string) (*Collection, error) {
+	err := ValidateCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireMigrated(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := backend.RegisterCollection(r.Context(), projectID, collection)
+	if err != nil {
+		return nil, err
+	}
+	registered.Store(c.Index, true)
+
+	return c, nil
+}
+
+// Collections returns the project's collections sorted by name
+func Collections(r *http.Request, projectID string) ([]Collection, error) {
+	return backend.Collections(r.Context(), projectID)
+}
+
+// MigrateCollections gives the legacy indices of the projects, named without separator,
+// an alias with their new name and registers them. It can be run again.
+// The projects should be every project not migrated yet, the legacy indices more than one of
+// them could own are left to migrate by hand, with the other indices of their projects.
+func MigrateCollections(ctx context.Context, projectIDs []string) (*CollectionMigration, error) {
+	migrator, ok := backend.(interface {
+		MigrateCollections(ctx context.Context, projectIDs []string) (*CollectionMigration, error)
+	})
+	if !ok {
+		return nil, errors.New("The backend can't migrate collections!")
+	}
+
+	migration, err := migrator.MigrateCollections(ctx, projectIDs)
+	if err != nil {
+		return migration, err
+	}
+
+	// the migrated projects write to their new indices right away on this server
+	return migration, LoadIndexNames(ctx)
+}
+
+// requireMigrated fails for the projects not migrated yet, their registry would hide their legacy collections
+func requireMigrated(projectID string) error {
+	if !projectMigrated(projectID) {
+		return errors.New("The collections of the project are not migrated yet!")
+	}
+	return nil
+}
+
+// projectMigrated tells if the project has no legacy index left to migrate
+func projectMigrated(projectID string) bool {
+	return !currentIndexNames().hasLegacy(projectPrefix(projectID))
+}
+
+// indexNames is what the names of the cluster's indices tell about the migration of the projects
+type indexNames struct {
+	// the legacy indices no migrated project owns, sorted, their projects still write to them
+	legacy []string
+}
+
+func newIndexNames(indices []string) *indexNames {
+	registries := registryPrefixes(indices)
+
+	legacy := []string{}
+	for _, idx := range indices {
+		if strings.Contains(idx, indexSeparator) || len(legacyOwners(idx, registries)) > 0 {
+			continue
+		}
+		legacy = append(legacy, idx)
+	}
+	sort.Strings(legacy)
+
+	return &indexNames{legacy: legacy}
+}
+
+// isLegacy tells if the index is a legacy index still written to
+func (n *indexNames) isLegacy(idx string) bool {
+	i := sort.SearchStrings(n.legacy, idx)
+	return i < len(n.legacy) && n.legacy[i] == idx
+}
+
+// hasLegacy tells if legacy indices still written to start with the project prefix
+func (n *indexNames) hasLegacy(prefix string) bool {
+	i := sort.SearchStrings(n.legacy, prefix)
+	if i < len(n.legacy) && n.legacy[i] == prefix {
+		// a legacy index is the prefix followed by a collection
+		i++
+	}
+	return i < len(n.legacy) && strings.HasPrefix(n.legacy[i], prefix)
+}
+
+// loadedIndexNames is the *indexNames of the backend, see LoadIndexNames
+var loadedIndexNames atomic.Value
+
+func currentIndexNames() *indexNames {
+	if n, ok := loadedIndexNames.Load().(*indexNames); ok {
+		return n
+	}
+	return &indexNames{}
+}
+
+// LoadIndexNames lists the backend's indices to find the projects not migrated yet, see
+// MigrateCollections, and the legacy indices they write to. It should be loaded before
+// the backend is used, and reloaded to see the projects migrated by other servers.
+func LoadIndexNames(ctx context.Context) error {
+	lister, ok := backend.(interface {
+		Indices(ctx context.Context) ([]string, error)
+	})
+	if !ok {
+		// the backend has no legacy indices
+		loadedIndexNames.Store(&indexNames{})
+		return nil
+	}
+
+	indices, err := lister.Indices(ctx)
+	if err != nil {
+		return err
+	}
+	loadedIndexNames.Store(newIndexNames(indices))
+
+	return nil
+}
+
+// registryPrefixes returns the prefixes of the projects whose registry is among the indices,
+// they are migrated.
+func registryPrefixes(indices []string) map[string]bool {
+	suffix := indexSeparator + "_collections"
+
+	prefixes := make(map[string]bool)
+	for _, idx := range indices {
+		if len(idx) > len(suffix) && strings.HasSuffix(idx, suffix) {
+			prefixes[strings.TrimSuffix(idx, suffix)] = true
+		}
+	}
+
+	return prefixes
+}
+
+// legacyOwners returns the project prefixes the legacy index could belong to, in
+// the legacy names the prefix is directly followed by the collection.
+func legacyOwners(idx string, prefixes map[string]bool) []string {
+	owners := []string{}
+	for i := 1; i < len(idx); i++ {
+		if prefixes[idx[:i]] {
+			owners = append(owners, idx[:i])
+		}
+	}
+	return owners
+}
+
+func (es *Elasticsearch) RegisterCollection(ctx context.Context, projectID, collection string) (*Collection, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	idx := registryIndex(projectID)
+	id := strings.ToLower(collection)
+
+	c := &Collection{
+		Name:      collection,
+		Index:     collectionIndex(projectID, collection),
+		CreatedAt: time.Now().UTC().Format(timestampFormat),
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"name": c.Name, "index": c.Index, "created_at": c.CreatedAt})
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return nil, errors.New("Error encoding collection!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndexRequest{
+		Index:      idx,
+		DocumentID: id,
+		Body:       strings.NewReader(string(b)),
+		OpType:     "create",
+		Refresh:    "wait_for",
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res))
+		return nil, errors.New("Error registering collection!")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return es.getCollection(ctx, idx, id)
+	}
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res)))
+		return nil, errors.New("Failed to register collection!")
+	}
+
+	return c, nil
+}
+
+// saveCollection replaces the collection in the project's registry
+func (es *Elasticsearch) saveCollection(ctx context.Context, projectID string, c *Collection) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	idx := registryIndex(projectID)
+	id := strings.ToLower(c.Name)
+
+	// the event count isn't stored
+	b, err := json.Marshal(map[string]interface{}{
+		"name":       c.Name,
+		"index":      c.Index,
+		"created_at": c.CreatedAt,
+		"schema":     c.Schema,
+		"reindexing": c.Reindexing,
+	})
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return errors.New("Error encoding collection!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndexRequest{
+		Index:      idx,
+		DocumentID: id,
+		Body:       strings.NewReader(string(b)),
+		Refresh:    "wait_for",
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res))
+		return errors.New("Error saving collection!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res)))
+		return errors.New("Failed to save collection!")
+	}
+
+	return nil
+}
+
+func (es *Elasticsearch) getCollection(ctx context.Context, idx, id string) (*Collection, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	// Set up the request object.
+	req := esapi.GetRequest{
+		Index:      idx,
+		DocumentID: id,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res))
+		return nil, errors.New("Error getting collection!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res)))
+		return nil, errors.New("Failed to get collection!")
+	}
+
+	var rr struct {
+		Source Collection `json:"_source"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Collection: %s.\n Response: %v.\n", idx, id, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	return &rr.Source, nil
+}
+
+func (es *Elasticsearch) Collections(ctx context.Context, projectID string) ([]Collection, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	idx := registryIndex(projectID)
+
+	size := 10000
+	// Set up the request object.
+	req := esapi.SearchRequest{
+		Index: []string{idx},
+		Size:  &size,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Response: %v.\n", idx, res))
+		return nil, errors.New("Error getting collections!")
+	}
+	defer res.Body.Close()
+
+	collections := []Collection{}
+
+	if res.StatusCode == http.StatusNotFound {
+		// projects that were not migrated have no registry yet
+		collections = append(collections, es.legacyCollections(ctx, projectID)...)
+	} else {
+		if res.IsError() {
+			errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Response: %v.\n", idx, res)))
+			return nil, errors.New("Failed to get collections!")
+		}
+
+		var rr struct {
+			Hits struct {
+				Hits []struct {
+					Source Collection `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&rr)
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Response: %v.\n", idx, res))
+			return nil, errors.New("Error decoding response!")
+		}
+
+		for _, hit := range rr.Hits.Hits {
+			collections = append(collections, hit.Source)
+		}
+	}
+
+	sort.Slice(collections, func(i, j int) bool {
+		return strings.ToLower(collections[i].Name) < strings.ToLower(collections[j].Name)
+	})
+
+	err = es.countEvents(ctx, collections)
+	if err != nil {
+		return nil, err
+	}
+
+	return collections, nil
+}
+
+// countEvents sets the event count of the collections with a single multi search
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-multi-search.html
+func (es *Elasticsearch) countEvents(ctx context.Context, collections []Collection) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	if len(collections) == 0 {
+		return nil
+	}
+
+	var body strings.Builder
+	for _, c := range collections {
+		header, _ := json.Marshal(map[string]interface{}{"index": c.Index, "ignore_unavailable": true})
+		body.Write(header)
+		body.WriteString("\n{\"size\":0,\"track_total_hits\":true}\n")
+	}
+
+	// Set up the request object.
+	req := esapi.MsearchRequest{
+		Body: strings.NewReader(body.String()),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Query: %s.\n Response: %v.\n", body.String(), res))
+		return errors.New("Error counting events!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Query: %s.\n Response: %v.\n", body.String(), res)))
+		return errors.New("Failed to count events!")
+	}
+
+	var rr struct {
+		Responses []struct {
+			Hits struct {
+				Total struct {
+					Value int64 `json:"value"`
+				} `json:"total"`
+			} `json:"hits"`
+		} `json:"responses"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Query: %s.\n Response: %v.\n", body.String(), res))
+		return errors.New("Error decoding response!")
+	}
+
+	for i := range collections {
+		// collections never written to have no index yet
+		if i < len(rr.Responses) {
+			collections[i].EventCount = rr.Responses[i].Hits.Total.Value
+		}
+	}
+
+	return nil
+}
+
+func (es *Elasticsearch) MigrateCollections(ctx context.Context, projectIDs []string) (*CollectionMigration, error) {
+	migration := &CollectionMigration{
+		Migrated:  make(map[string]string),
+		Ambiguous: make(map[string][]string),
+		Skipped:   make(map[string]string),
+	}
+
+	indices, err := es.Indices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	for _, idx := range indices {
+		existing[idx] = true
+	}
+
+	// the projects migrated before own their legacy indices, the others are told apart by prefix
+	migrated := registryPrefixes(indices)
+	prefixes := make(map[string]bool)
+	projects := make(map[string]string)
+	for prefix := range migrated {
+		prefixes[prefix] = true
+		projects[prefix] = prefix
+	}
+	toMigrate := make(map[string]bool)
+	for _, projectID := range projectIDs {
+		prefix := projectPrefix(projectID)
+		if prefix == "" || migrated[prefix] {
+			continue
+		}
+		prefixes[prefix] = true
+		projects[prefix] = projectID
+		toMigrate[prefix] = true
+	}
+
+	type legacy struct {
+		prefix     string
+		collection string
+	}
+	legacies := make(map[string]legacy)
+	// the collections created with their new name before the migration are registered too
+	created := make(map[string]legacy)
+	ambiguous := make(map[string]bool)
+
+	for _, idx := range indices {
+		if i := strings.Index(idx, indexSeparator); i >= 0 {
+			if toMigrate[idx[:i]] && ValidateCollection(idx[i+1:]) == nil {
+				created[idx] = legacy{prefix: idx[:i], collection: idx[i+1:]}
+			}
+			continue
+		}
+
+		owners := legacyOwners(idx, prefixes)
+		if len(owners) == 0 || len(legacyOwners(idx, migrated)) > 0 {
+			// not an index of the projects, or one a migrated project owns
+			continue
+		}
+
+		if len(owners) > 1 {
+			candidates := []string{}
+			for _, prefix := range owners {
+				candidates = append(candidates, projects[prefix])
+				ambiguous[prefix] = true
+			}
+			migration.Ambiguous[idx] = candidates
+			continue
+		}
+
+		legacies[idx] = legacy{prefix: owners[0], collection: idx[len(owners[0]):]}
+	}
+
+	actions := []interface{}{}
+	toRegister := make(map[string]legacy)
+
+	for idx, l := range legacies {
+		if ambiguous[l.prefix] {
+			migration.Skipped[idx] = "other indices of the project are ambiguous"
+			continue
+		}
+
+		var alias string
+		if l.collection == "datawavesapiusage" {
+			alias = usageIndex(l.prefix)
+		} else {
+			if ValidateCollection(l.collection) != nil {
+				migration.Skipped[idx] = "invalid collection name " + l.collection
+				continue
+			}
+			alias = collectionIndex(l.prefix, l.collection)
+		}
+
+		if existing[alias] {
+			migration.Skipped[idx] = "the index " + alias + " already exists"
+			continue
+		}
+
+		actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": idx, "alias": alias}})
+		migration.Migrated[idx] = alias
+		if l.collection != "datawavesapiusage" {
+			toRegister[alias] = l
+		}
+	}
+
+	for idx, l := range created {
+		if !ambiguous[l.prefix] {
+			toRegister[idx] = l
+		}
+	}
+
+	if len(actions) > 0 {
+		err = es.addAliases(ctx, actions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for idx, l := range toRegister {
+		_, err := es.RegisterCollection(ctx, projects[l.prefix], l.collection)
+		if err != nil {
+			return migration, err
+		}
+		registered.Store(idx, true)
+	}
+
+	// the registry tells the project is migrated, even when it had no legacy index
+	for prefix := range toMigrate {
+		if ambiguous[prefix] {
+			continue
+		}
+
+		err := es.createRegistry(ctx, projects[prefix])
+		if err != nil {
+			return migration, err
+		}
+	}
+
+	return migration, nil
+}
+
+// Indices returns the names of the cluster's indices
+func (es *Elasticsearch) Indices(ctx context.Context) ([]string, error) {
+	return es.catIndices(ctx)
+}
+
+// catIndices returns the names of the indices matching the patterns, every index without pattern
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/cat-indices.html
+func (es *Elasticsearch) catIndices(ctx context.Context, patterns ...string) ([]string, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	// Set up the request object.
+	req := esapi.CatIndicesRequest{
+		Index:  patterns,
+		Format: "json",
+		H:      []string{"index"},
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Indices: %v.\n Response: %v.\n", patterns, res))
+		return nil, errors.New("Error listing indices!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Indices: %v.\n Response: %v.\n", patterns, res)))
+		return nil, errors.New("Failed to list indices!")
+	}
+
+	var rr []struct {
+		Index string `json:"index"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Indices: %v.\n Response: %v.\n", patterns, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	indices := []string{}
+	for _, i := range rr {
+		indices = append(indices, i.Index)
+	}
+
+	return indices, nil
+}
+
+// addAliases runs the alias actions in a single request
+func (es *Elasticsearch) addAliases(ctx context.Context, actions []interface{}) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		errors.Log(err, "Encoding error.")
+		return errors.New("Error encoding aliases!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: strings.NewReader(string(b)),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Aliases: %s.\n Response: %v.\n", b, res))
+		return errors.New("Error adding aliases!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Aliases: %s.\n Response: %v.\n", b, res)))
+		return errors.New("Failed to add aliases!")
+	}
+
+	return nil
+}
+
+// createRegistry creates the project's registry if it doesn't exist yet
+func (es *Elasticsearch) createRegistry(ctx context.Context, projectID string) error {
+	idx := registryIndex(projectID)
+
+	// Set up the request object.
+	req := esapi.IndicesCreateRequest{
+		Index: idx,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Response: %v.\n", idx, res))
+		return errors.New("Error creating registry!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "resource_already_exists_exception") {
+			return nil
+		}
+
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Response: %s.\n", idx, body)))
+		return errors.New("Failed to create registry!")
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package elastic
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestIndexNaming(t *testing.T) {
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"collection", collectionIndex("Ab-Cd", "Clicks"), "abcd.clicks"},
+		{"usage", usageIndex("ab-cd"), "abcd._usage"},
+		{"registry", registryIndex("ab-cd"), "abcd._collections"},
+		{"legacy", legacyIndex("ab-cd", "Clicks"), "abcdclicks"},
+		// the collisions of the legacy names are told apart
+		{"legacy collision", legacyIndex("abc", "def"), legacyIndex("ab", "cdef")},
+		{"no collision", collectionIndex("ab", "cdef"), "ab.cdef"},
+		{"other project", collectionIndex("abc", "def"), "abc.def"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %s, want %s", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexNames(t *testing.T) {
+	names := newIndexNames([]string{"abcdef", "abxyz", "abc._collections", "ab.new", ".kibana", "xy"})
+
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		// abcdef could be abc's and abc is migrated
+		{"legacy of a migrated project", names.isLegacy("abcdef"), false},
+		{"legacy", names.isLegacy("abxyz"), true},
+		{"new name", names.isLegacy("ab.new"), false},
+		{"project with legacy indices", names.hasLegacy("ab"), true},
+		{"migrated project", names.hasLegacy("abc"), false},
+		{"index named as the prefix", names.hasLegacy("xy"), false},
+		{"project without index", names.hasLegacy("cd"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+// useIndices records an event in each index and loads the index names
+func useIndices(t *testing.T, r *http.Request, indices ...string) {
+	t.Helper()
+
+	for _, idx := range indices {
+		err := Record(r, idx, `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := LoadIndexNames(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collectionNames returns the names and indices of the project's collections
+func collectionNames(t *testing.T, r *http.Request, projectID string) map[string]string {
+	t.Helper()
+
+	collections, err := Collections(r, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]string)
+	for _, c := range collections {
+		names[c.Name] = c.Index
+	}
+	return names
+}
+
+func TestMigrateCollectionsAmbiguous(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+	defer loadedIndexNames.Store(&indexNames{})
+
+	useIndices(t, r, "abcdef", "abxyz")
+
+	migration, err := MigrateCollections(context.Background(), []string{"ab", "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &CollectionMigration{
+		Migrated:  map[string]string{},
+		Ambiguous: map[string][]string{"abcdef": {"ab", "abc"}},
+		Skipped:   map[string]string{"abxyz": "other indices of the project are ambiguous"},
+	}
+	if !reflect.DeepEqual(migration, want) {
+		t.Errorf("got %+v, want %+v", migration, want)
+	}
+
+	// both projects keep their legacy indices until they are migrated by hand
+	if idx := GetIndex("ab", "cdef"); idx != "abcdef" {
+		t.Errorf("got %s, want abcdef", idx)
+	}
+	if idx := GetIndex("abc", "def"); idx != "abcdef" {
+		t.Errorf("got %s, want abcdef", idx)
+	}
+	if err := requireMigrated("ab"); err == nil {
+		t.Error("expected an error for a project not migrated")
+	}
+}
+
+func TestMigrateCollectionsOwnedByMigratedProject(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+	defer loadedIndexNames.Store(&indexNames{})
+
+	useIndices(t, r, "abcdef")
+
+	migration, err := MigrateCollections(context.Background(), []string{"abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"abcdef": "abc.def"}; !reflect.DeepEqual(migration.Migrated, want) {
+		t.Errorf("got %v, want %v", migration.Migrated, want)
+	}
+
+	// the legacy index of abc isn't ab's, even alone
+	useIndices(t, r, "abxyz")
+	useIndices(t, r, "ab.new")
+	if got, want := collectionNames(t, r, "ab"), map[string]string{"new": "ab.new", "xyz": "abxyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	migration, err = MigrateCollections(context.Background(), []string{"ab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"abxyz": "ab.xyz"}; !reflect.DeepEqual(migration.Migrated, want) || len(migration.Ambiguous) != 0 {
+		t.Errorf("got %+v, want migrated %v", migration, want)
+	}
+
+	if got, want := collectionNames(t, r, "ab"), map[string]string{"new": "ab.new", "xyz": "ab.xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := collectionNames(t, r, "abc"), map[string]string{"def": "abc.def"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if idx := GetIndex("ab", "cdef"); idx != "ab.cdef" {
+		t.Errorf("got %s, want ab.cdef", idx)
+	}
+	if idx := GetIndex("abc", "def"); idx != "abc.def" {
+		t.Errorf("got %s, want abc.def", idx)
+	}
+
+	// it can be run again
+	migration, err = MigrateCollections(context.Background(), []string{"ab", "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migration.Migrated) != 0 || len(migration.Ambiguous) != 0 {
+		t.Errorf("got %+v, want nothing migrated", migration)
+	}
+}
+
+func TestRegisterIndex(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+	defer loadedIndexNames.Store(&indexNames{})
+
+	useIndices(t, r, "regoldclicks")
+
+	// the registry of a project not migrated would hide its legacy collections
+	registerIndex(context.Background(), "regold.signups")
+	if got, want := collectionNames(t, r, "regold"), map[string]string{"clicks": "regoldclicks"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// the collections of new projects are registered when they are written to
+	idx := GetIndex("regnew", "Signups")
+	if idx != "regnew.signups" {
+		t.Errorf("got %s, want regnew.signups", idx)
+	}
+	useIndices(t, r, idx)
+	if got, want := collectionNames(t, r, "regnew"), map[string]string{"signups": "regnew.signups"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// registering it again returns the registered collection
+	c, err := RegisterCollection(r, "regnew", "Signups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "signups" || c.Index != "regnew.signups" {
+		t.Errorf("got %+v", c)
+	}
+
+	if _, err := RegisterCollection(r, "regold", "signups"); err == nil {
+		t.Error("expected an error registering a collection of a project not migrated")
+	}
+	if _, err := RegisterCollection(r, "regnew", "_usage"); err == nil {
+		t.Error("expected an error registering an invalid collection")
+	}
+}
@@ -0,0 +1,198 @@
+package elastic
+
+import (
+	"datawaves/errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compare runs the analysis again over a shifted timeframe, type is one of
+// "previous_period", the same length right before the timeframe,
+// "previous_year" or "offset", shifted back by offset like "7d".
+type Compare struct {
+	Type   string `json:"type"`
+	Offset string `json:"offset"`
+}
+
+// comparisonSearch returns a copy of the search over the timeframe to compare with
+func (search *Search) comparisonSearch() (*Search, error) {
+	if search.Timeframe.IsEmpty() {
+		return nil, errors.New("A timeframe is needed to compare with!")
+	}
+
+	now := time.Now()
+	from, to, err := search.Timeframe.Bounds(search.Timezone, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if from.IsZero() {
+		return nil, errors.New("A timeframe with a start is needed to compare with!")
+	}
+
+	if to.IsZero() {
+		to = now
+	}
+
+	loc, err := GetLocation(search.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	from = from.In(loc)
+	to = to.In(loc)
+
+	switch strings.ToLower(search.Compare.Type) {
+	case "previous_period":
+		m := relativeRe.FindStringSubmatch(strings.ToLower(search.Timeframe.Relative))
+		if m != nil {
+			// calendar units, so the previous month is a whole month
+			n, _ := strconv.Atoi(m[2])
+			from = addUnits(from, m[3], -n)
+			to = addUnits(to, m[3], -n)
+		} else if search.Timeframe.Relative != "" {
+			// today and yesterday
+			from = from.AddDate(0, 0, -1)
+			to = to.AddDate(0, 0, -1)
+		} else {
+			// both ends of absolute timeframes are included, the previous
+			// period ends right before the timeframe starts
+			d := to.Sub(from)
+			from = from.Add(-d)
+			to = to.Add(-d).Add(-time.Millisecond)
+		}
+	case "previous_year":
+		from = from.AddDate(-1, 0, 0)
+		to = to.AddDate(-1, 0, 0)
+	case "offset":
+		d, err := ParseDuration(search.Compare.Offset)
+		if err != nil {
+			return nil, err
+		}
+		from = from.Add(-d)
+		to = to.Add(-d)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown compare type \"%s\", it should be previous_period, previous_year or offset!", search.Compare.Type))
+	}
+
+	if search.Timeframe.Relative != "" {
+		// relative timeframes end right before to
+		to = to.Add(-time.Millisecond)
+	}
+
+	previous := *search
+	previous.Compare = nil
+	previous.Timeframe = Timeframe{
+		From: from.UTC().Format(timestampFormat),
+		To:   to.UTC().Format(timestampFormat),
+	}
+
+	return &previous, nil
+}
+
+// compare runs the analysis over the timeframe and the one to compare with,
+// key is the name of the value in grouped and interval rows.
+func compare(search *Search, key string, analysis func(search *Search) (interface{}, error)) (interface{}, error) {
+	previousSearch, err := search.comparisonSearch()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := analysis(search)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := analysis(previousSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, ok := current.([]map[string]interface{})
+	if !ok {
+		result := map[string]interface{}{"current": current, "previous": previous}
+		change(result, current, previous)
+		return result, nil
+	}
+
+	previousRows, _ := previous.([]map[string]interface{})
+
+	if search.Interval != "" {
+		// time buckets are matched in order
+		for i, row := range rows {
+			if i >= len(previousRows) {
+				if len(search.GroupBy) == 0 {
+					row["previous"] = nil
+					change(row, row[key], nil)
+				} else {
+					current, _ := row["value"].([]map[string]interface{})
+					compareGroups(search, key, current, nil)
+				}
+				continue
+			}
+
+			row["previous_start"] = previousRows[i]["start"]
+			row["previous_end"] = previousRows[i]["end"]
+			if len(search.GroupBy) == 0 {
+				row["previous"] = previousRows[i][key]
+				change(row, row[key], previousRows[i][key])
+				continue
+			}
+
+			current, _ := row["value"].([]map[string]interface{})
+			previous, _ := previousRows[i]["value"].([]map[string]interface{})
+			compareGroups(search, key, current, previous)
+		}
+
+		return rows, nil
+	}
+
+	compareGroups(search, key, rows, previousRows)
+
+	return rows, nil
+}
+
+// compareGroups adds the previous value to each row of the same groups
+func compareGroups(search *Search, key string, rows, previousRows []map[string]interface{}) {
+	groupKey := func(row map[string]interface{}) string {
+		k := ""
+		for _, group := range search.GroupBy {
+			k = k + fmt.Sprintf("%v\x00", row[group])
+		}
+		return k
+	}
+
+	previous := make(map[string]map[string]interface{})
+	for _, row := range previousRows {
+		previous[groupKey(row)] = row
+	}
+
+	for _, row := range rows {
+		var p interface{}
+		if prev, ok := previous[groupKey(row)]; ok {
+			p = prev[key]
+		}
+		row["previous"] = p
+		change(row, row[key], p)
+	}
+}
+
+// change sets the absolute and percentage change from previous to current on result,
+// the percentage is null when there is nothing to compare with.
+func change(result map[string]interface{}, current, previous interface{}) {
+	c, okc := current.(float64)
+	p, okp := previous.(float64)
+	if !okc || !okp {
+		result["change"] = nil
+		result["change_percent"] = nil
+		return
+	}
+
+	result["change"] = c - p
+	if p == 0 {
+		result["change_percent"] = nil
+	} else {
+		result["change_percent"] = (c - p) / p * 100
+	}
+}
@@ -1,6 +1,7 @@
 package elastic
 
 import (
+	"context"
 	"datawaves/errors"
 	"fmt"
 	"net/http"
@@ -26,10 +27,28 @@ func Count(r *http.Request, idx, body string) (interface{}, error) {
 	}
 	search.Index = idx
 
-	query := search.GetQuery("count")
+	if search.Compare != nil {
+		return compare(&search, "count", func(search *Search) (interface{}, error) {
+			return backend.Count(r.Context(), search)
+		})
+	}
+
+	return backend.Count(r.Context(), &search)
+}
+
+func (es *Elasticsearch) Count(ctx context.Context, search *Search) (interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	idx := search.Index
+	es.loadMapping(ctx, search, "count")
+
+	query, err := search.GetQuery("count")
+	if err != nil {
+		return 0, err
+	}
 
-	if search.GroupBy != "" || search.Interval != "" {
-		return _count(r, idx, body, query, &search)
+	if len(search.GroupBy) > 0 || search.Interval != "" {
+		return es._count(ctx, query, search)
 	}
 
 	// Set up the request object.
@@ -39,37 +58,39 @@ func Count(r *http.Request, idx, body string) (interface{}, error) {
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return 0, errors.New("Error counting documents!")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return 0, errors.New("Failed to count documents!")
 	}
 
 	var rr map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&rr)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return 0, errors.New("Error decoding response!")
 	}
 
 	count, ok := rr["count"].(float64)
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return 0, errors.New("Assertion error!")
 	}
 
 	return count, nil
 }
 
-func _count(r *http.Request, idx, body, query string, search *Search) (interface{}, error) {
+func (es *Elasticsearch) _count(ctx context.Context, query string, search *Search) (interface{}, error) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+	idx := search.Index
+
 	size := 0
 	// Set up the request object.
 	req := esapi.SearchRequest{
@@ -79,40 +100,44 @@ func _count(r *http.Request, idx, body, query string, search *Search) (interface
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error processing documents!")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Failed to process documents!")
 	}
 
 	var rr map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&rr)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error decoding response!")
 	}
 
 	_aggs, ok := rr["aggregations"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
 	rslt, ok := _aggs["result"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
+	if search.Interval == "" {
+		return search.groupRows(_aggs, nil), nil
+	}
+
 	rs, ok := rslt["buckets"].([]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
@@ -129,17 +154,19 @@ func _count(r *http.Request, idx, body, query string, search *Search) (interface
 				x["count"] = v
 			}
 
-			if search.Interval != "" {
-				if k == "key_as_string" {
-					x["start"] = v
-				}
-			} else {
-				if k == "key" {
-					x[search.GroupBy] = v
-				}
+			if k == "key_as_string" {
+				x["start"] = v
 			}
 
+			if k == "key" {
+				x["end"] = search.BucketEnd(v)
+			}
+		}
+
+		if len(search.GroupBy) > 0 {
+			x["value"] = search.groupRows(yy, nil)
 		}
+
 		y = append(y, x)
 	}
 
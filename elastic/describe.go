@@ -0,0 +1,221 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// how many of the most frequent values are described
+const describeTopValues = 10
+
+// property types described by their most frequent values and by their range
+var (
+	topValuesTypes = map[string]bool{
+		"keyword": true, "text": true, "boolean": true, "ip": true,
+		"long": true, "integer": true, "short": true, "byte": true, "unsigned_long": true,
+		"double": true, "float": true, "half_float": true, "scaled_float": true,
+	}
+	rangeTypes = map[string]bool{
+		"date": true, "date_nanos": true,
+		"long": true, "integer": true, "short": true, "byte": true, "unsigned_long": true,
+		"double": true, "float": true, "half_float": true, "scaled_float": true,
+	}
+)
+
+type CollectionDescription struct {
+	Name       string                `json:"name"`
+	EventCount int64                 `json:"event_count"`
+	Properties []PropertyDescription `json:"properties"`
+}
+
+// PropertyDescription is the statistics of a property over all the events of the collection,
+// dates' min and max are formatted and the other ones are numbers.
+type PropertyDescription struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Keyword is whether the property has a keyword subfield, text properties need it to be grouped by
+	Keyword bool `json:"keyword"`
+	// FillRate is the fraction of the events with the property
+	FillRate  float64      `json:"fill_rate"`
+	TopValues []ValueCount `json:"top_values,omitempty"`
+	Min       interface{}  `json:"min,omitempty"`
+	Max       interface{}  `json:"max,omitempty"`
+}
+
+type ValueCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+// DescribeCollection returns the properties of the collection sorted by name with their statistics
+func DescribeCollection(r *http.Request, projectID, collection string) (*CollectionDescription, error) {
+	err := ValidateCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	description, err := backend.DescribeCollection(r.Context(), GetIndex(projectID, collection))
+	if err != nil {
+		return nil, err
+	}
+	description.Name = collection
+
+	return description, nil
+}
+
+// DescribeCollection computes the statistics of every property of the mapping in a single search
+func (es *Elasticsearch) DescribeCollection(ctx context.Context, idx string) (*CollectionDescription, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	mapping, err := es.GetMapping(ctx, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	description := &CollectionDescription{Properties: []PropertyDescription{}}
+	for name, typ := range mapping {
+		// subfields are described with their property
+		if i := strings.LastIndex(name, "."); i > 0 && mapping[name[:i]] != "" {
+			continue
+		}
+
+		description.Properties = append(description.Properties, PropertyDescription{
+			Name:    name,
+			Type:    typ,
+			Keyword: mapping[name+".keyword"] == "keyword",
+		})
+	}
+	sort.Slice(description.Properties, func(i, j int) bool {
+		return description.Properties[i].Name < description.Properties[j].Name
+	})
+
+	// properties are named by position, agg names can't have every character
+	aggs := make(map[string]interface{})
+	for i, p := range description.Properties {
+		if p.Type == "nested" {
+			continue
+		}
+
+		stats := make(map[string]interface{})
+		if topValuesTypes[p.Type] && (p.Type != "text" || p.Keyword) {
+			stats["top"] = map[string]interface{}{
+				"terms": map[string]interface{}{"field": keywordField(mapping, p.Name), "size": describeTopValues},
+			}
+		}
+		if rangeTypes[p.Type] {
+			stats["min"] = map[string]interface{}{"min": map[string]interface{}{"field": p.Name}}
+			stats["max"] = map[string]interface{}{"max": map[string]interface{}{"field": p.Name}}
+		}
+
+		agg := map[string]interface{}{
+			"filter": map[string]interface{}{"exists": map[string]interface{}{"field": p.Name}},
+		}
+		if len(stats) > 0 {
+			agg["aggs"] = stats
+		}
+		aggs[fmt.Sprintf("p%d", i)] = agg
+	}
+
+	q := map[string]interface{}{"track_total_hits": true}
+	if len(aggs) > 0 {
+		q["aggs"] = aggs
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return nil, errors.New("Error encoding query!")
+	}
+	query := string(b)
+
+	size := 0
+	// Set up the request object.
+	req := esapi.SearchRequest{
+		Index: []string{idx},
+		Body:  strings.NewReader(query),
+		Size:  &size,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+		return nil, errors.New("Error describing collection!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+		return nil, errors.New("Failed to describe collection!")
+	}
+
+	var rr struct {
+		Hits struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+		} `json:"hits"`
+		Aggregations map[string]struct {
+			DocCount int64 `json:"doc_count"`
+			Top      struct {
+				Buckets []struct {
+					Key         interface{} `json:"key"`
+					KeyAsString string      `json:"key_as_string"`
+					DocCount    int64       `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"top"`
+			Min struct {
+				Value         interface{} `json:"value"`
+				ValueAsString string      `json:"value_as_string"`
+			} `json:"min"`
+			Max struct {
+				Value         interface{} `json:"value"`
+				ValueAsString string      `json:"value_as_string"`
+			} `json:"max"`
+		} `json:"aggregations"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	description.EventCount = rr.Hits.Total.Value
+	for i := range description.Properties {
+		p := &description.Properties[i]
+
+		agg, ok := rr.Aggregations[fmt.Sprintf("p%d", i)]
+		if !ok {
+			continue
+		}
+
+		if description.EventCount > 0 {
+			p.FillRate = float64(agg.DocCount) / float64(description.EventCount)
+		}
+
+		for _, bucket := range agg.Top.Buckets {
+			value := bucket.Key
+			// booleans are keyed 1 and 0
+			if p.Type == "boolean" {
+				value = bucket.KeyAsString == "true"
+			}
+			p.TopValues = append(p.TopValues, ValueCount{Value: value, Count: bucket.DocCount})
+		}
+
+		p.Min = agg.Min.Value
+		p.Max = agg.Max.Value
+		if agg.Min.ValueAsString != "" && strings.HasPrefix(p.Type, "date") {
+			p.Min = agg.Min.ValueAsString
+			p.Max = agg.Max.ValueAsString
+		}
+	}
+
+	return description, nil
+}
@@ -1,78 +1,88 @@
 package elastic
 
 import (
-	"datawaves/secrets"
-	"datawaves/util"
+	"datawaves/errors"
 	"fmt"
-	"log"
-	"os"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 	"github.com/google/uuid"
-	nrelasticsearch "github.com/newrelic/go-agent/v3/integrations/nrelasticsearch-v7"
+	jsoniter "github.com/json-iterator/go"
 )
 
-var client *elasticsearch.Client
-
-func init() {
-	var err error
-
-	if util.IsProduction() {
-		// "github.com/newrelic/go-agent/v3/integrations/nrelasticsearch-v7"
-		url, err := secrets.Get("elasticsearch_url")
-		if err != nil {
-			panic(err)
-		}
+// Elasticsearch is the Backend that stores every collection in its own index
+type Elasticsearch struct {
+	client   *elasticsearch.Client
+	mappings *mappingCache
+	schemas  *schemaCache
+	// the collections whose reindexing this server moves along, see watchReindexing
+	reindexings sync.Map
+	// transport of the client when it was created for a dedicated cluster, see CloseIdleConnections
+	transport http.RoundTripper
+}
 
-		user, err := secrets.Get("elasticsearch_user")
-		if err != nil {
-			panic(err)
-		}
+func NewElasticsearch(client *elasticsearch.Client) *Elasticsearch {
+	return &Elasticsearch{
+		client:   client,
+		mappings: newMappingCache(DefaultMappingTTL),
+		schemas:  newSchemaCache(DefaultSchemaTTL),
+	}
+}
 
-		pass, err := secrets.Get("elasticsearch_pass")
-		if err != nil {
-			panic(err)
-		}
+// CloseIdleConnections closes the connections of the client that are not in use,
+// for the clusters removed from the registry
+func (es *Elasticsearch) CloseIdleConnections() {
+	if t, ok := es.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
 
-		cfg := elasticsearch.Config{
-			Addresses: []string{
-				url,
-			},
-			Transport: nrelasticsearch.NewRoundTripper(nil),
-			Username:  user,
-			Password:  pass,
-		}
+// indexSeparator separates the project from the collection in index names,
+// project IDs are alphanumeric once their dashes are removed and collections can't have dots.
+const indexSeparator = "."
 
-		client, err = elasticsearch.NewClient(cfg)
-	} else {
-		cfg := elasticsearch.Config{
-			Addresses: []string{
-				os.Getenv("elasticsearch_testing_url"),
-			},
-			Username: os.Getenv("elasticsearch_testing_user"),
-			Password: os.Getenv("elasticsearch_testing_pass"),
-		}
+// projectPrefix is how the project's indices start
+func projectPrefix(projectID string) string {
+	return strings.ToLower(strings.ReplaceAll(projectID, "-", ""))
+}
 
-		client, err = elasticsearch.NewClient(cfg)
+// GetIndex returns the index of the collection, it should be valid, see ValidateCollection.
+// Projects not migrated yet keep writing to their legacy indices, see LoadIndexNames.
+func GetIndex(projectID, collection string) string {
+	legacy := legacyIndex(projectID, collection)
+	if currentIndexNames().isLegacy(legacy) {
+		return legacy
 	}
+	return collectionIndex(projectID, collection)
+}
 
-	if err != nil {
-		log.Fatalf("Error conntecting to ElasticSearch: %s", err)
-		panic(err)
+// GetUsageIndex returns the index of the project's api usage
+func GetUsageIndex(projectID string) string {
+	legacy := legacyIndex(projectID, "datawavesapiusage")
+	if currentIndexNames().isLegacy(legacy) {
+		return legacy
 	}
+	return usageIndex(projectID)
 }
 
-func GetIndex(projectID, collection string) string {
-	p := strings.ReplaceAll(projectID, "-", "")
-	return strings.ToLower(p + collection)
+// collectionIndex is the name of the collection's index once the project is migrated
+func collectionIndex(projectID, collection string) string {
+	return projectPrefix(projectID) + indexSeparator + strings.ToLower(collection)
 }
 
-func GetUsageIndex(projectID string) string {
-	p := strings.ReplaceAll(projectID, "-", "")
-	return strings.ToLower(p + "datawavesapiusage")
+// usageIndex is the name of the api usage index once the project is migrated,
+// collections can't start with _ so it can't be the index of one.
+func usageIndex(projectID string) string {
+	return projectPrefix(projectID) + indexSeparator + "_usage"
+}
+
+// legacyIndex is the name of the collection's index before the project was migrated
+func legacyIndex(projectID, collection string) string {
+	return projectPrefix(projectID) + strings.ToLower(collection)
 }
 
 func GetID() string {
@@ -149,6 +159,73 @@ func IsValidInterval(interval string) (bool, string) {
 	return false, ""
 }
 
+// dateHistogram returns a histogram with a bucket for every interval of the timeframe,
+// including the ones without events, so series of different analyses line up.
+func (search *Search) dateHistogram(intervalType string) (map[string]interface{}, error) {
+	histogram := map[string]interface{}{
+		"field":                    "datawaves.timestamp",
+		intervalType + "_interval": search.Interval,
+		"min_doc_count":            0,
+	}
+
+	if search.Timezone != "" {
+		histogram["time_zone"] = search.Timezone
+	}
+
+	from, to, err := search.Timeframe.Bounds(search.Timezone, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := make(map[string]interface{})
+	if !from.IsZero() {
+		bounds["min"] = from.UnixNano() / int64(time.Millisecond)
+	}
+	if !to.IsZero() {
+		max := to.UnixNano() / int64(time.Millisecond)
+		if search.Timeframe.Relative != "" {
+			// relative timeframes end right before to
+			max--
+		}
+		bounds["max"] = max
+	}
+	if len(bounds) > 0 {
+		histogram["extended_bounds"] = bounds
+	}
+
+	return histogram, nil
+}
+
+// BucketEnd returns when the interval bucket starting at key, in epoch millis, ends
+func (search *Search) BucketEnd(key interface{}) interface{} {
+	k, ok := key.(float64)
+	if !ok {
+		return nil
+	}
+
+	loc, err := GetLocation(search.Timezone)
+	if err != nil {
+		return nil
+	}
+	start := time.Unix(0, int64(k)*int64(time.Millisecond)).In(loc)
+
+	var end time.Time
+	_, intervalType := IsValidInterval(search.Interval)
+	if intervalType == "calendar" {
+		end = addUnits(start, strings.ToLower(search.Interval), 1)
+	} else {
+		d, err := ParseDuration(search.Interval)
+		if err != nil {
+			return nil
+		}
+		end = start.Add(d)
+	}
+
+	return end.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// Filter is either a condition on a property or, when the operator is
+// "and", "or" or "not", a group of operands that can be nested to any depth.
 type Filter struct {
 	PropertyName  string      `json:"property_name"`
 	Operator      string      `json:"operator"`
@@ -161,361 +238,334 @@ type Order struct {
 	Direction string `json:"direction"`
 }
 
-type Timeframe struct {
-	From string `json:"from"`
-	To   string `json:"to"`
-}
-
 type Search struct {
-	Index            string
-	Timeframe        Timeframe `json:"timeframe"`
-	Interval         string    `json:"interval"`
-	Timezone         string    `json:"timezone"`
-	Filters          []Filter  `json:"filters"`
-	MustFilters      []string
-	MustNotFilters   []string
-	ShouldFilters    []string
-	ShouldNotFilters []string
-	TargetProperty   string `json:"target_property"`
-	GroupBy          string `json:"group_by"`
-	Mapping          map[string]string
-	Order            Order `json:"order"`
+	Index          string
+	Timeframe      Timeframe `json:"timeframe"`
+	Interval       string    `json:"interval"`
+	Timezone       string    `json:"timezone"`
+	Filters        []Filter  `json:"filters"`
+	MustFilters    []Query
+	MustNotFilters []Query
+	TargetProperty string     `json:"target_property"`
+	GroupBy        Properties `json:"group_by"`
+	Mapping        map[string]string
+	Order          Order    `json:"order"`
+	Compare        *Compare `json:"compare"`
 }
 
-func appendFilter(filters []string, filter Filter) []string {
+// appendFilter appends the query of the filter, string equality is matched on the
+// keyword subfield of text properties.
+func appendFilter(filters []Query, filter Filter, mapping map[string]string) []Query {
 	if filter.Operator == "eq" {
-		return append(filters, fmt.Sprintf("{\"term\":{\"%s.keyword\":\"%s\"}}", filter.PropertyName, filter.PropertyValue))
+		if _, ok := filter.PropertyValue.(string); ok {
+			field := keywordField(mapping, filter.PropertyName)
+			if mapping[filter.PropertyName] == "" {
+				// not in the mapping, or no mapping, as dynamically mapped strings
+				field = filter.PropertyName + ".keyword"
+			}
+			return append(filters, TermQuery{Field: field, Value: filter.PropertyValue})
+		}
+		return append(filters, TermQuery{Field: filter.PropertyName, Value: filter.PropertyValue})
 	}
 
 	if filter.Operator == "ne" {
-		return append(filters, fmt.Sprintf("{\"term\":{\"%s\":\"%s\"}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, TermQuery{Field: filter.PropertyName, Value: filter.PropertyValue})
 	}
 
 	if filter.Operator == "lt" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
-		return append(filters, fmt.Sprintf("{\"range\":{\"%s\":{\"lt\":%v}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, RangeQuery{Field: filter.PropertyName, Lt: filter.PropertyValue})
 	}
 
 	if filter.Operator == "lte" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
-		return append(filters, fmt.Sprintf("{\"range\":{\"%s\":{\"lte\":%v}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, RangeQuery{Field: filter.PropertyName, Lte: filter.PropertyValue})
 	}
 
 	if filter.Operator == "gt" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
-		return append(filters, fmt.Sprintf("{\"range\":{\"%s\":{\"gt\":%v}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, RangeQuery{Field: filter.PropertyName, Gt: filter.PropertyValue})
 	}
 
 	if filter.Operator == "gte" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
-		return append(filters, fmt.Sprintf("{\"range\":{\"%s\":{\"gte\":%v}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, RangeQuery{Field: filter.PropertyName, Gte: filter.PropertyValue})
 	}
 
+	// whether it goes to must or must_not is decided by the caller
 	if filter.Operator == "exists" {
-		if filter.PropertyValue == "false" {
-			return append(filters, fmt.Sprintf("{\"exists\":{\"field\":\"%s\"}}", filter.PropertyName))
-		} else {
-			return append(filters, fmt.Sprintf("{\"exists\":{\"field\":\"%s\"}}", filter.PropertyName))
-		}
-	}
-
-	if filter.Operator == "contains" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-wildcard-query.html
-		return append(filters, fmt.Sprintf("{\"wildcard\":{\"%s\":{\"value\":\"*%s*\"}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, ExistsQuery{Field: filter.PropertyName})
 	}
 
-	if filter.Operator == "not_contains" {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-wildcard-query.html
-		return append(filters, fmt.Sprintf("{\"wildcard\":{\"%s\":{\"value\":\"*%s*\"}}}", filter.PropertyName, filter.PropertyValue))
+	if filter.Operator == "contains" || filter.Operator == "not_contains" {
+		return append(filters, WildcardQuery{Field: filter.PropertyName, Value: "*" + escapeWildcard(fmt.Sprintf("%v", filter.PropertyValue)) + "*"})
 	}
 
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-regexp-query.html
 	if filter.Operator == "regexp" || filter.Operator == "regex" {
-		return append(filters, fmt.Sprintf("{\"regexp\": {\"%s\": {\"value\":\"%s\"}}}", filter.PropertyName, filter.PropertyValue))
+		return append(filters, RegexpQuery{Field: filter.PropertyName, Value: fmt.Sprintf("%v", filter.PropertyValue)})
 	}
 
 	if filter.Operator == "in" {
-		var value string
-		switch arr := filter.PropertyValue.(type) {
-		case []interface{}:
-			value = "["
-			for i := range arr {
-				switch item := arr[i].(type) {
-				case int:
-					if i == len(arr)-1 {
-						value = value + fmt.Sprintf("%d", item)
-					} else {
-						value = value + fmt.Sprintf("%d,", item)
-					}
-				case float32:
-					if i == len(arr)-1 {
-						value = value + fmt.Sprintf("%f", item)
-					} else {
-						value = value + fmt.Sprintf("%f,", item)
-					}
-				case float64:
-					if i == len(arr)-1 {
-						value = value + fmt.Sprintf("%f", item)
-					} else {
-						value = value + fmt.Sprintf("%f,", item)
-					}
-				case string:
-					if i == len(arr)-1 {
-						value = value + fmt.Sprintf("\"%s\"", item)
-					} else {
-						value = value + fmt.Sprintf("\"%s\",", item)
-					}
-				}
-			}
-			value = value + "]"
-		}
-
-		if value != "" {
-			// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-terms-query.html
-			return append(filters, fmt.Sprintf("{\"terms\":{\"%s\": %s}}", filter.PropertyName, value))
+		arr, ok := filter.PropertyValue.([]interface{})
+		if ok && len(arr) > 0 {
+			return append(filters, TermsQuery{Field: filter.PropertyName, Values: arr})
 		}
 	}
 
 	return filters
 }
 
-func GetFilterQuery(name string, filters []string) string {
-	var query string
-	happened := make(map[string]bool)
-	if len(filters) > 0 {
-		query = fmt.Sprintf("\"%s\":", name)
-		if len(filters) > 1 {
-			query = query + "["
-			for i, filter := range filters {
-				if happened[filter] == true {
-					continue
-				}
-				query = query + filter
-				if i != len(filters)-1 {
-					query = query + ","
-				}
-				happened[filter] = true
-			}
-			query = query + "]"
-		} else {
-			// only one filter
-			query = query + filters[0]
-		}
-	}
+// wildcardEscaper escapes the wildcard characters and the escape character itself
+var wildcardEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
 
-	return query
+// escapeWildcard makes the wildcard characters of the value match themselves
+func escapeWildcard(value string) string {
+	return wildcardEscaper.Replace(value)
 }
 
-func GetShouldFilterQuery(search *Search) string {
+func isGroup(filter Filter) bool {
+	return filter.Operator == "and" || filter.Operator == "or" || filter.Operator == "not"
+}
 
-	must := GetFilterQuery("must", search.ShouldFilters)
-	mustnot := GetFilterQuery("must_not", search.ShouldNotFilters)
+// isNegative reports whether the filter matches the documents its query does not match
+func isNegative(filter Filter) bool {
+	return filter.Operator == "ne" ||
+		filter.Operator == "not_contains" ||
+		(filter.Operator == "exists" && (filter.PropertyValue == "false" || filter.PropertyValue == false))
+}
 
-	if must != "" && mustnot != "" {
-		return "\"should\":{\"bool\":{" + must + "," + mustnot + "}}"
+func validateFilter(filter Filter) error {
+	if isGroup(filter) {
+		if len(filter.Operands) == 0 {
+			return errors.New(fmt.Sprintf("Filter group \"%s\" has no operands!", filter.Operator))
+		}
+		return nil
 	}
 
-	if must != "" {
-		return "\"should\":{\"bool\":{" + must + "}}"
+	if len(filter.Operands) > 0 {
+		return errors.New(fmt.Sprintf("Operands are only allowed in \"and\", \"or\" and \"not\" filters, got \"%s\"!", filter.Operator))
 	}
 
-	if mustnot != "" {
-		return "\"should\":{\"bool\":{" + mustnot + "}}"
+	if filter.PropertyName == "" {
+		return errors.New(fmt.Sprintf("Missing property_name in \"%s\" filter!", filter.Operator))
 	}
 
-	return ""
+	switch filter.Operator {
+	case "eq", "ne", "lt", "lte", "gt", "gte", "contains", "not_contains", "regexp", "regex":
+		if filter.PropertyValue == nil {
+			return errors.New(fmt.Sprintf("Missing property_value in \"%s\" filter on %s!", filter.Operator, filter.PropertyName))
+		}
+	case "exists":
+		if filter.PropertyValue != "true" && filter.PropertyValue != "false" && filter.PropertyValue != true && filter.PropertyValue != false {
+			return errors.New(fmt.Sprintf("property_value of \"exists\" filter on %s should be true or false!", filter.PropertyName))
+		}
+	case "in":
+		arr, ok := filter.PropertyValue.([]interface{})
+		if !ok || len(arr) == 0 {
+			return errors.New(fmt.Sprintf("property_value of \"in\" filter on %s should be a non empty array!", filter.PropertyName))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown filter operator \"%s\"!", filter.Operator))
+	}
+
+	return nil
 }
 
-func (search *Search) GetQuery(op string) string {
-	var err error
-	if search.GroupBy != "" || op == "cardinality" {
-		search.Mapping, err = GetMapping(search.Index)
-		if err != nil {
-			search.GroupBy = ""
+// compileFilter turns a filter, and its operands recursively, into a query
+// that matches exactly the documents the filter selects.
+func compileFilter(filter Filter, mapping map[string]string) (Query, error) {
+	err := validateFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isGroup(filter) {
+		if isNegative(filter) {
+			return BoolQuery{MustNot: appendFilter(nil, filter, mapping)}, nil
 		}
+		return appendFilter(nil, filter, mapping)[0], nil
 	}
 
-	intervalType := ""
-	isValid := false
-	if search.Interval != "" {
-		isValid, intervalType = IsValidInterval(search.Interval)
-		if !isValid {
-			search.Interval = ""
+	operands := []Query{}
+	for _, operand := range filter.Operands {
+		q, err := compileFilter(operand, mapping)
+		if err != nil {
+			return nil, err
 		}
+		operands = append(operands, q)
 	}
 
-	if len(search.Filters) > 0 {
-		for _, filter := range search.Filters {
-
-			if filter.Operator == "or" && len(filter.Operands) > 0 {
-				for _, operand := range filter.Operands {
-					if operand.Operator == "eq" ||
-						operand.Operator == "lt" ||
-						operand.Operator == "lte" ||
-						operand.Operator == "gt" ||
-						operand.Operator == "gte" ||
-						operand.Operator == "contains" ||
-						operand.Operator == "in" ||
-						operand.Operator == "regexp" || operand.Operator == "regex" ||
-						(operand.Operator == "exists" && operand.PropertyValue == "true") {
-						search.ShouldFilters = appendFilter(search.ShouldFilters, operand)
-					}
-
-					if operand.Operator == "ne" ||
-						operand.Operator == "not_contains" ||
-						(operand.Operator == "exists" && operand.PropertyValue == "false") {
-						search.ShouldNotFilters = appendFilter(search.ShouldNotFilters, operand)
-					}
-				}
-			}
+	if filter.Operator == "and" {
+		return BoolQuery{Must: operands}, nil
+	}
 
-			if filter.Operator == "eq" ||
-				filter.Operator == "lt" ||
-				filter.Operator == "lte" ||
-				filter.Operator == "gt" ||
-				filter.Operator == "gte" ||
-				filter.Operator == "contains" ||
-				filter.Operator == "in" ||
-				filter.Operator == "regexp" || filter.Operator == "regex" ||
-				(filter.Operator == "exists" && filter.PropertyValue == "true") {
-				search.MustFilters = appendFilter(search.MustFilters, filter)
-			}
+	if filter.Operator == "or" {
+		return BoolQuery{Should: operands, MinimumShouldMatch: 1}, nil
+	}
 
-			if filter.Operator == "ne" ||
-				filter.Operator == "not_contains" ||
-				(filter.Operator == "exists" && filter.PropertyValue == "false") {
-				search.MustNotFilters = appendFilter(search.MustNotFilters, filter)
-			}
-		}
+	// not: none of the operands match
+	return BoolQuery{MustNot: operands}, nil
+}
+
+// GetFilterQuery returns a bool query of the search filters
+func GetFilterQuery(search *Search) BoolQuery {
+	return BoolQuery{
+		Must:    search.MustFilters,
+		MustNot: search.MustNotFilters,
 	}
+}
 
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-min-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-max-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-sum-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-avg-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-cardinality-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-terms-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-extendedstats-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-median-absolute-deviation-aggregation.html
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-percentile-aggregation.html
+// metricAgg returns the aggregation computing op on the property
+func (search *Search) metricAgg(op, property string) map[string]interface{} {
+	field := property
+	if op == "cardinality" {
+		field = keywordField(search.Mapping, property)
+	}
 
-	aggs := ""
-	if ((op == "count" && search.GroupBy != "") || (op == "count" && search.Interval != "")) || op == "min" || op == "max" || op == "sum" || op == "avg" || op == "cardinality" || op == "percentiles" || op == "extended_stats" || op == "median_absolute_deviation" {
-		order := ""
+	return map[string]interface{}{op: map[string]interface{}{"field": field}}
+}
 
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-datehistogram-aggregation.html
-		interval := ""
-		if search.Interval != "" {
-			timezone := ""
-			if search.Timezone != "" {
-				timezone = fmt.Sprintf(",\"time_zone\":\"%s\"", search.Timezone)
-			}
-			interval = fmt.Sprintf("\"date_histogram\":{\"field\":\"datawaves.timestamp\", \"%s_interval\":\"%s\"%s}", intervalType, search.Interval, timezone)
-		}
+// bucketAggs splits the metrics by the groups and then by the interval, if any
+func (search *Search) bucketAggs(metrics map[string]interface{}) (map[string]interface{}, error) {
+	aggs := metrics
+	if len(metrics) == 0 {
+		aggs = nil
+	}
 
-		if op == "count" && search.Interval != "" {
-			aggs = fmt.Sprintf(",\"aggs\":{\"result\":{%s}}", interval)
-			goto Jump
-		}
+	if len(search.GroupBy) > 0 {
+		aggs = search.groupAggs(aggs)
+	}
 
-		if op == "cardinality" && search.Mapping != nil && search.Mapping[search.TargetProperty] == "text" {
-			aggs = fmt.Sprintf(",\"aggs\":{\"%s_value\":{\"%s\":{\"field\":\"%s.keyword\"}}}", op, op, search.TargetProperty)
-		} else {
-			aggs = fmt.Sprintf(",\"aggs\":{\"%s_value\":{\"%s\":{\"field\":\"%s\"}}}", op, op, search.TargetProperty)
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-datehistogram-aggregation.html
+	if search.Interval != "" {
+		_, intervalType := IsValidInterval(search.Interval)
+		histogram, err := search.dateHistogram(intervalType)
+		if err != nil {
+			return nil, err
 		}
 
-		// if interval exist, ignore order and group by
-		if interval != "" {
-			aggs = fmt.Sprintf(",\"aggs\":{\"result\":{%s %s}}", interval, aggs)
-			goto Jump
+		// every time bucket is split by the groups, if any
+		interval := map[string]interface{}{"date_histogram": histogram}
+		if aggs != nil {
+			interval["aggs"] = aggs
 		}
+		aggs = map[string]interface{}{"result": interval}
+	}
 
-		if (strings.ToLower(search.Order.By) == "key" || strings.ToLower(search.Order.By) == "count") && (strings.ToLower(search.Order.Direction) == "desc" || strings.ToLower(search.Order.Direction) == "asc") {
-			order = fmt.Sprintf(",\"order\":{\"_%s\":\"%s\"}", search.Order.By, search.Order.Direction)
-		}
+	return aggs, nil
+}
 
-		if search.GroupBy != "" && search.Mapping[search.GroupBy] != "" {
-			if op == "count" {
-				aggs = ""
-			}
-			if search.Mapping[search.GroupBy] == "text" {
-				aggs = fmt.Sprintf(",\"aggs\":{\"result\":{\"terms\":{\"field\":\"%s.keyword\" %s} %s}}", search.GroupBy, order, aggs)
-			} else {
-				aggs = fmt.Sprintf(",\"aggs\":{\"result\":{\"terms\":{\"field\":\"%s\" %s} %s}}", search.GroupBy, order, aggs)
+// GetQuery returns the search request body for the op,
+// malformed filters are reported as an error.
+func (search *Search) GetQuery(op string) (string, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	body, err := search.Body(op)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := json.Marshal(body)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n Op: %s.\n", search.Index, op))
+		return "", errors.New("Error encoding query!")
+	}
+
+	return string(query), nil
+}
+
+// Body is the search request body for the op before it is encoded,
+// analyses that need their own aggregations add them to it.
+// Groups and cardinalities need the mapping of the search, the backend loads it
+// with the request's context, see loadMapping.
+func (search *Search) Body(op string) (map[string]interface{}, error) {
+	if (len(search.GroupBy) > 0 || op == "cardinality") && search.Mapping == nil {
+		errors.Log(errors.New(fmt.Sprintf("Assertion error, the mapping isn't loaded.\nIndex: %s.\nOp: %s.\n", search.Index, op)))
+		return nil, errors.New("Assertion error!")
+	}
+
+	// properties that are not in the collection can't be grouped by
+	if len(search.GroupBy) > 0 {
+		groups := Properties{}
+		for _, group := range search.GroupBy {
+			if search.Mapping[group] != "" {
+				groups = append(groups, group)
 			}
 		}
+		search.GroupBy = groups
 	}
 
-Jump:
-	// Dates should be in this format 'YYYY-MM-DDTHH:mm:ss.sssZ' like '2020-01-30T00:00:00.000Z'
-	timeframe := ""
-	if search.Timeframe.From != "" && search.Timeframe.To != "" {
-		_, err := time.Parse(time.RFC3339, search.Timeframe.From)
-		if err != nil {
-			search.Timeframe.From = ""
-			search.Timeframe.To = ""
+	if search.Interval != "" {
+		isValid, _ := IsValidInterval(search.Interval)
+		if !isValid {
+			search.Interval = ""
 		}
+	}
 
-		_, err = time.Parse(time.RFC3339, search.Timeframe.To)
-		if err != nil {
-			search.Timeframe.From = ""
-			search.Timeframe.To = ""
-		}
+	// the search's own filters are copied, running the search again doesn't add them twice
+	must := append([]Query{}, search.MustFilters...)
+	mustNot := append([]Query{}, search.MustNotFilters...)
 
-		timezone := ""
-		if search.Timezone != "" {
-			timezone = fmt.Sprintf(",\"time_zone\":\"%s\"", search.Timezone)
+	// top level filters are and-ed
+	for _, filter := range search.Filters {
+		if isGroup(filter) {
+			q, err := compileFilter(filter, search.Mapping)
+			if err != nil {
+				return nil, err
+			}
+			must = append(must, q)
+			continue
 		}
 
-		// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
-		if search.Timeframe.From != "" || search.Timeframe.To != "" {
-			timeframe = fmt.Sprintf("{\"range\":{\"datawaves.timestamp\": {\"gte\":\"%s\",\"lte\":\"%s\" %s}}}", search.Timeframe.From, search.Timeframe.To, timezone)
-		}
-	} else {
-		timezone := ""
-		if search.Timezone != "" {
-			timezone = fmt.Sprintf(",\"time_zone\":\"%s\"", search.Timezone)
+		err := validateFilter(filter)
+		if err != nil {
+			return nil, err
 		}
-		timeframe = fmt.Sprintf("{\"range\":{\"datawaves.timestamp\": {\"lte\":\"now\" %s}}}", timezone)
-	}
 
-	search.MustFilters = append(search.MustFilters, timeframe)
-	must := GetFilterQuery("must", search.MustFilters)
-	mustnot := GetFilterQuery("must_not", search.MustNotFilters)
-	should := GetShouldFilterQuery(search)
-
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-bool-query.html
-	if must != "" && mustnot != "" && should != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s,%s,%s}} %s}", must, mustnot, should, aggs)
+		if isNegative(filter) {
+			mustNot = appendFilter(mustNot, filter, search.Mapping)
+		} else {
+			must = appendFilter(must, filter, search.Mapping)
+		}
 	}
 
-	if must != "" && mustnot != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s,%s}} %s}", must, mustnot, aggs)
-	}
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-min-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-max-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-sum-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-avg-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-cardinality-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-terms-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-extendedstats-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-median-absolute-deviation-aggregation.html
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics-percentile-aggregation.html
 
-	if must != "" && should != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s, %s}} %s}", must, should, aggs)
-	}
+	var aggs map[string]interface{}
+	if ((op == "count" && len(search.GroupBy) > 0) || (op == "count" && search.Interval != "")) || op == "min" || op == "max" || op == "sum" || op == "avg" || op == "cardinality" || op == "percentiles" || op == "extended_stats" || op == "median_absolute_deviation" {
+		var metrics map[string]interface{}
+		if op != "count" {
+			metrics = map[string]interface{}{op + "_value": search.metricAgg(op, search.TargetProperty)}
+		}
 
-	if mustnot != "" && should != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s, %s}} %s}", mustnot, should, aggs)
+		var err error
+		aggs, err = search.bucketAggs(metrics)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if must != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s}} %s}", must, aggs)
+	timeframe, err := search.Timeframe.Query(search.Timezone)
+	if err != nil {
+		return nil, err
 	}
+	must = append(must, timeframe)
 
-	if mustnot != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s}} %s}", mustnot, aggs)
-	}
+	body := make(map[string]interface{})
 
-	if should != "" {
-		return fmt.Sprintf("{\"query\":{\"bool\":{%s}} %s}", should, aggs)
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-bool-query.html
+	bq := BoolQuery{Must: must, MustNot: mustNot}
+	if !bq.IsEmpty() {
+		body["query"] = bq.Source()
 	}
 
-	if aggs != "" {
-		return fmt.Sprintf("{\"query\": %s}", aggs)
+	if aggs != nil {
+		body["aggs"] = aggs
 	}
 
-	return "{}"
+	return body, nil
 }
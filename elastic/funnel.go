@@ -0,0 +1,340 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// maxFunnelBuckets caps the actor/timestamp pairs read for a single step, they are all
+// kept in memory. A step with more fails instead of counting only some of its actors.
+const maxFunnelBuckets = 1000000
+
+type FunnelStep struct {
+	Collection    string    `json:"collection"`
+	ActorProperty string    `json:"actor_property"`
+	Filters       []Filter  `json:"filters"`
+	Timeframe     Timeframe `json:"timeframe"`
+}
+
+type FunnelSearch struct {
+	Steps     []FunnelStep `json:"steps"`
+	Timeframe Timeframe    `json:"timeframe"`
+	Timezone  string       `json:"timezone"`
+	// like "30m", "12h" or "7d", counted from the time the actor did the first step
+	ConversionWindow string `json:"conversion_window"`
+}
+
+// funnelAttempt is an actor going through the funnel from one of their first step events
+type funnelAttempt struct {
+	started int64
+	// when the actor did the last step
+	reached int64
+}
+
+// Funnel counts the actors that did every step in order,
+// each step only counts when it happened after the previous one and,
+// if there is a conversion window, no later than the window after the first step.
+// Every time an actor did the first step the window starts again, an actor whose first
+// attempt ran out of time converts if a later one fits in the window.
+// A step on a collection of an earlier step has to be a later event than the previous step,
+// so a single event never counts for two steps.
+// Each step can read up to maxFunnelBuckets distinct actor/timestamp pairs.
+func Funnel(r *http.Request, projectID, body string) ([]map[string]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var funnel FunnelSearch
+	err := json.NewDecoder(strings.NewReader(body)).Decode(&funnel)
+	if err != nil {
+		errors.Log(err)
+		return nil, errors.New("Error decoding request body!")
+	}
+
+	if len(funnel.Steps) == 0 {
+		return nil, errors.New("Missing steps!")
+	}
+
+	var window time.Duration
+	if funnel.ConversionWindow != "" {
+		window, err = ParseDuration(funnel.ConversionWindow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the attempts of each actor still in the funnel
+	attempts := make(map[string][]funnelAttempt)
+	// the collections of the previous steps
+	seen := make(map[string]bool)
+
+	results := []map[string]interface{}{}
+	first := 0
+	for i, step := range funnel.Steps {
+		if step.Collection == "" {
+			return nil, errors.New(fmt.Sprintf("Missing collection in step %d!", i+1))
+		}
+
+		if err := ValidateCollection(step.Collection); err != nil {
+			return nil, err
+		}
+
+		if step.ActorProperty == "" {
+			return nil, errors.New(fmt.Sprintf("Missing actor_property in step %d!", i+1))
+		}
+
+		timeframe := step.Timeframe
+		if timeframe.IsEmpty() {
+			timeframe = funnel.Timeframe
+		}
+
+		search := Search{
+			Index:     GetIndex(projectID, step.Collection),
+			Filters:   step.Filters,
+			Timeframe: timeframe,
+			Timezone:  funnel.Timezone,
+		}
+
+		events, err := backend.ActorEvents(r.Context(), &search, step.ActorProperty)
+		if err != nil {
+			return nil, err
+		}
+
+		repeated := seen[strings.ToLower(step.Collection)]
+		seen[strings.ToLower(step.Collection)] = true
+
+		next := make(map[string][]funnelAttempt)
+		for actor, timestamps := range events {
+			if i == 0 {
+				// without window the first attempt goes the furthest
+				if window == 0 {
+					timestamps = timestamps[:1]
+				}
+				for _, ts := range timestamps {
+					next[actor] = append(next[actor], funnelAttempt{started: ts, reached: ts})
+				}
+				continue
+			}
+
+			for _, attempt := range attempts[actor] {
+				// first time the step was done at or after the previous step,
+				// strictly after when the event could be the one of an earlier step
+				j := sort.Search(len(timestamps), func(k int) bool {
+					if repeated {
+						return timestamps[k] > attempt.reached
+					}
+					return timestamps[k] >= attempt.reached
+				})
+				if j == len(timestamps) {
+					continue
+				}
+
+				if window > 0 && timestamps[j]-attempt.started > window.Milliseconds() {
+					continue
+				}
+
+				next[actor] = append(next[actor], funnelAttempt{started: attempt.started, reached: timestamps[j]})
+			}
+		}
+		attempts = next
+
+		count := len(attempts)
+		result := map[string]interface{}{
+			"collection": step.Collection,
+			"count":      count,
+		}
+
+		if i == 0 {
+			first = count
+			result["drop_off"] = 0
+			result["conversion_rate"] = rate(count, count)
+		} else {
+			prev := results[i-1]["count"].(int)
+			result["drop_off"] = prev - count
+			result["conversion_rate"] = rate(count, prev)
+		}
+		result["overall_conversion_rate"] = rate(count, first)
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func rate(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// ActorEvents reads the actor/timestamp pairs with a composite aggregation
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-composite-aggregation.html
+func (es *Elasticsearch) ActorEvents(ctx context.Context, search *Search, actorProperty string) (map[string][]int64, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	events := make(map[string][]int64)
+
+	mapping, err := es.GetMapping(ctx, search.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping[actorProperty] == "" {
+		// collection has no events with the actor
+		return events, nil
+	}
+
+	field := keywordField(mapping, actorProperty)
+	search.Mapping = mapping
+
+	search.Filters = append(search.Filters, Filter{PropertyName: actorProperty, Operator: "exists", PropertyValue: "true"})
+
+	q, err := search.Body("funnel")
+	if err != nil {
+		return nil, err
+	}
+
+	idx := search.Index
+	buckets := 0
+	var after interface{}
+	for {
+		composite := map[string]interface{}{
+			"size": 1000,
+			"sources": []interface{}{
+				map[string]interface{}{"actor": map[string]interface{}{"terms": map[string]interface{}{"field": field}}},
+				map[string]interface{}{"timestamp": map[string]interface{}{"terms": map[string]interface{}{"field": "datawaves.timestamp"}}},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		q["aggs"] = map[string]interface{}{"result": map[string]interface{}{"composite": composite}}
+
+		b, err := json.Marshal(q)
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+			return nil, errors.New("Error encoding query!")
+		}
+		query := string(b)
+
+		size := 0
+		// Set up the request object.
+		req := esapi.SearchRequest{
+			Index: []string{idx},
+			Body:  strings.NewReader(query),
+			Size:  &size,
+		}
+
+		// Perform the request with the client.
+		res, err := req.Do(ctx, es.client)
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+			return nil, errors.New("Error processing documents!")
+		}
+
+		if res.IsError() {
+			res.Body.Close()
+			errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Failed to process documents!")
+		}
+
+		var rr map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&rr)
+		res.Body.Close()
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+			return nil, errors.New("Error decoding response!")
+		}
+
+		_aggs, ok := rr["aggregations"].(map[string]interface{})
+		if !ok {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		rslt, ok := _aggs["result"].(map[string]interface{})
+		if !ok {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		rs, ok := rslt["buckets"].([]interface{})
+		if !ok {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		for i := range rs {
+			bucket, ok := rs[i].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			key, ok := bucket["key"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			ts, ok := key["timestamp"].(float64)
+			if !ok {
+				continue
+			}
+
+			actor := fmt.Sprintf("%v", key["actor"])
+			// buckets are sorted by actor then timestamp
+			events[actor] = append(events[actor], int64(ts))
+		}
+
+		buckets += len(rs)
+		if buckets > maxFunnelBuckets {
+			errors.Log(errors.New(fmt.Sprintf("Too many buckets. Index: %s.\n Query: %s.\n", idx, query)))
+			return nil, errors.New(fmt.Sprintf("A step has more than %d events, please narrow down the timeframe!", maxFunnelBuckets))
+		}
+
+		after = rslt["after_key"]
+		if after == nil || len(rs) == 0 {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// ParseDuration parses durations like "500ms", "30s", "15m", "12h" and "7d"
+func ParseDuration(duration string) (time.Duration, error) {
+	d := strings.ToLower(strings.TrimSpace(duration))
+
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+		{"d", 24 * time.Hour},
+	}
+
+	for _, u := range units {
+		if !strings.HasSuffix(d, u.suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(d, u.suffix))
+		if err != nil || n <= 0 {
+			break
+		}
+
+		return time.Duration(n) * u.unit, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("Invalid duration \"%s\", it should be like 30m, 12h or 7d!", duration))
+}
@@ -0,0 +1,104 @@
+package elastic
+
+import (
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Properties is a list of property names,
+// a single name can be sent as a string: "group_by": "country"
+type Properties []string
+
+func (properties *Properties) UnmarshalJSON(b []byte) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var property string
+	if err := json.Unmarshal(b, &property); err == nil {
+		if property == "" {
+			*properties = nil
+		} else {
+			*properties = Properties{property}
+		}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return err
+	}
+	*properties = Properties(list)
+
+	return nil
+}
+
+// groupAggs nests a terms aggregation for every group property,
+// the first property being the outermost, with inner aggs at the deepest level.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-terms-aggregation.html
+func (search *Search) groupAggs(inner map[string]interface{}) map[string]interface{} {
+	aggs := inner
+	for i := len(search.GroupBy) - 1; i >= 0; i-- {
+		group := search.GroupBy[i]
+
+		terms := map[string]interface{}{"field": keywordField(search.Mapping, group)}
+
+		by := strings.ToLower(search.Order.By)
+		direction := strings.ToLower(search.Order.Direction)
+		if (by == "key" || by == "count") && (direction == "desc" || direction == "asc") {
+			terms["order"] = map[string]interface{}{"_" + by: direction}
+		}
+
+		result := map[string]interface{}{"terms": terms}
+		if aggs != nil {
+			result["aggs"] = aggs
+		}
+		aggs = map[string]interface{}{"result": result}
+	}
+
+	return aggs
+}
+
+// groupRows flattens the nested terms buckets under agg into one row per group,
+// keyed by each group property, with the count and what value adds to it.
+func (search *Search) groupRows(agg map[string]interface{}, value func(bucket, row map[string]interface{})) []map[string]interface{} {
+	return search.appendGroupRows([]map[string]interface{}{}, agg, 0, map[string]interface{}{}, value)
+}
+
+func (search *Search) appendGroupRows(rows []map[string]interface{}, agg map[string]interface{}, level int, keys map[string]interface{}, value func(bucket, row map[string]interface{})) []map[string]interface{} {
+	rslt, ok := agg["result"].(map[string]interface{})
+	if !ok {
+		return rows
+	}
+
+	rs, ok := rslt["buckets"].([]interface{})
+	if !ok {
+		return rows
+	}
+
+	for i := range rs {
+		bucket, ok := rs[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		row := make(map[string]interface{})
+		for k, v := range keys {
+			row[k] = v
+		}
+		row[search.GroupBy[level]] = bucket["key"]
+
+		if level < len(search.GroupBy)-1 {
+			rows = search.appendGroupRows(rows, bucket, level+1, row, value)
+			continue
+		}
+
+		row["count"] = bucket["doc_count"]
+		if value != nil {
+			value(bucket, row)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
@@ -4,18 +4,69 @@ import (
 	"context"
 	"datawaves/errors"
 	"fmt"
+	"sync"
+	"time"
+
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/json-iterator/go"
 )
 
+// DefaultMappingTTL is how long the Elasticsearch backend caches a mapping
+const DefaultMappingTTL = 5 * time.Minute
+
+// mappingFetchTimeout limits a fetch shared by the gets of an index
+const mappingFetchTimeout = 30 * time.Second
+
 func GetMapping(idx string) (map[string]string, error) {
+	return backend.GetMapping(context.Background(), idx)
+}
+
+// GetMapping returns the property types of the index, cached for the mapping TTL
+func (es *Elasticsearch) GetMapping(ctx context.Context, idx string) (map[string]string, error) {
+	return es.mappings.get(ctx, idx, es.fetchMapping)
+}
+
+// SetMappingTTL changes how long mappings are cached, zero disables the cache
+func (es *Elasticsearch) SetMappingTTL(ttl time.Duration) {
+	es.mappings.setTTL(ttl)
+}
+
+// loadMapping sets the mapping of the search when the op needs it, see Search.Body
+func (es *Elasticsearch) loadMapping(ctx context.Context, search *Search, op string) {
+	if (len(search.GroupBy) > 0 || op == "cardinality") && search.Mapping == nil {
+		mapping, err := es.GetMapping(ctx, search.Index)
+		if err != nil {
+			search.GroupBy = nil
+			mapping = map[string]string{}
+		}
+		search.Mapping = mapping
+	}
+}
+
+func (es *Elasticsearch) fetchMapping(ctx context.Context, idx string) (map[string]string, error) {
+	properties, err := es.rawMapping(ctx, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	if !flattenProperties(fields, properties, "") {
+		errors.Log(errors.New(fmt.Sprintf("Assertion error.\nIndex: %s.\nProperties: %v.\n", idx, properties)))
+		return nil, errors.New("Assertion error!")
+	}
+
+	return fields, nil
+}
+
+// rawMapping returns the mapping properties of the index as elasticsearch has them
+func (es *Elasticsearch) rawMapping(ctx context.Context, idx string) (map[string]interface{}, error) {
 	// Set up the request object.
 	req := esapi.IndicesGetMappingRequest{
 		Index: []string{idx},
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(context.Background(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
 		errors.Log(err, fmt.Sprintf("Error getting response.\nIndex: %s\nResponse: %v.\n", idx, res))
 		return nil, errors.New("Error counting documents!")
@@ -35,7 +86,13 @@ func GetMapping(idx string) (map[string]string, error) {
 		return nil, errors.New("Error decoding response!")
 	}
 
+	// an alias is answered with the mapping of its index
 	mp, ok := r[idx].(map[string]interface{})
+	if !ok && len(r) == 1 {
+		for _, v := range r {
+			mp, ok = v.(map[string]interface{})
+		}
+	}
 	if !ok {
 		errors.Log(errors.New(fmt.Sprintf("Assertion error.\nIndex: %s.\nResponse: %v.\n", idx, res)))
 		return nil, errors.New("Assertion error!")
@@ -53,26 +110,215 @@ func GetMapping(idx string) (map[string]string, error) {
 		return nil, errors.New("Assertion error!")
 	}
 
-	fields := make(map[string]string)
+	return fd, nil
+}
 
-	for k, v := range fd {
-		if k == "datawaves" {
+// flattenProperties adds the types of the properties to fields by dotted path,
+// objects are flattened into their properties (user.address.city) and multi-fields
+// into their subfields (name.keyword). Nested properties are only typed "nested",
+// their documents are queried apart.
+func flattenProperties(fields map[string]string, properties map[string]interface{}, prefix string) bool {
+	for k, v := range properties {
+		if prefix == "" && k == "datawaves" {
 			continue
 		}
 		obj, ok := v.(map[string]interface{})
 		if !ok {
-			errors.Log(errors.New(fmt.Sprintf("Assertion error.\nIndex: %s.\nResponse: %v.\n", idx, res)))
-			return nil, errors.New("Assertion error!")
+			return false
 		}
 
-		typ, ok := obj["type"].(string)
-		if !ok {
-			errors.Log(errors.New(fmt.Sprintf("Assertion error.\nIndex: %s.\nResponse: %v.\n", idx, res)))
-			return nil, errors.New("Assertion error!")
+		typ, _ := obj["type"].(string)
+		if typ == "" || typ == "object" {
+			sub, ok := obj["properties"].(map[string]interface{})
+			if !ok {
+				if typ == "" {
+					return false
+				}
+				// object without properties yet
+				continue
+			}
+			if !flattenProperties(fields, sub, prefix+k+".") {
+				return false
+			}
+			continue
 		}
 
-		fields[k] = typ
+		fields[prefix+k] = typ
+
+		if subfields, ok := obj["fields"].(map[string]interface{}); ok && typ != "nested" {
+			if !flattenProperties(fields, subfields, prefix+k+".") {
+				return false
+			}
+		}
 	}
 
-	return fields, nil
+	return true
+}
+
+// keywordField returns the field to aggregate or match exactly the property on,
+// for text properties it is their keyword subfield, as dynamic mappings add.
+func keywordField(mapping map[string]string, property string) string {
+	if mapping[property] != "text" {
+		return property
+	}
+	if sub := mapping[property+".keyword"]; sub != "" && sub != "keyword" {
+		return property
+	}
+	return property + ".keyword"
+}
+
+// mappingCache caches the mappings of the indices, concurrent gets of an index
+// that isn't cached share a single fetch.
+type mappingCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*mappingEntry
+}
+
+type mappingEntry struct {
+	mapping map[string]string
+	err     error
+	fetched time.Time
+	// closed once fetched
+	done chan struct{}
+}
+
+func newMappingCache(ttl time.Duration) *mappingCache {
+	return &mappingCache{ttl: ttl, entries: make(map[string]*mappingEntry)}
+}
+
+func (c *mappingCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+	c.entries = make(map[string]*mappingEntry)
+}
+
+func (c *mappingCache) get(ctx context.Context, idx string, fetch func(ctx context.Context, idx string) (map[string]string, error)) (map[string]string, error) {
+	c.mu.Lock()
+	if c.ttl <= 0 {
+		c.mu.Unlock()
+		return fetch(ctx, idx)
+	}
+
+	entry, ok := c.entries[idx]
+	if ok {
+		select {
+		case <-entry.done:
+			if time.Since(entry.fetched) >= c.ttl {
+				ok = false
+			}
+		default:
+			// being fetched
+		}
+	}
+
+	if !ok {
+		entry = &mappingEntry{done: make(chan struct{})}
+		c.entries[idx] = entry
+		go c.fetch(idx, entry, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	// a copy, callers may change it
+	mapping := make(map[string]string, len(entry.mapping))
+	for k, v := range entry.mapping {
+		mapping[k] = v
+	}
+
+	return mapping, nil
+}
+
+// fetch fills the entry and closes its done channel, even if fetch panics. It doesn't use
+// the context of the caller that started it, cancelling it doesn't fail the other waiters.
+func (c *mappingCache) fetch(idx string, entry *mappingEntry, fetch func(ctx context.Context, idx string) (map[string]string, error)) {
+	defer close(entry.done)
+	defer func() {
+		if r := recover(); r != nil {
+			errors.Log(errors.New(fmt.Sprintf("Panic fetching the mapping.\n Index: %s.\n Panic: %v.\n", idx, r)))
+			entry.mapping, entry.err = nil, errors.New("Error getting mapping!")
+		}
+		entry.fetched = time.Now()
+
+		c.mu.Lock()
+		// errors are not cached
+		if entry.err != nil && c.entries[idx] == entry {
+			delete(c.entries, idx)
+		}
+		c.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mappingFetchTimeout)
+	defer cancel()
+
+	entry.mapping, entry.err = fetch(ctx, idx)
+}
+
+// invalidate drops the index's mapping, a fetch in flight isn't cached either
+func (c *mappingCache) invalidate(idx string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, idx)
+}
+
+// observe invalidates the index's mapping when the document has properties it doesn't have
+func (c *mappingCache) observe(idx string, doc map[string]interface{}) {
+	c.mu.Lock()
+	entry, ok := c.entries[idx]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case <-entry.done:
+	default:
+		// fetched before the document was written, it may not have its properties
+		c.invalidate(idx)
+		return
+	}
+
+	if entry.err == nil && hasNewProperties(entry.mapping, doc, "") {
+		c.invalidate(idx)
+	}
+}
+
+func hasNewProperties(mapping map[string]string, doc map[string]interface{}, prefix string) bool {
+	for k, v := range doc {
+		if prefix == "" && k == "datawaves" {
+			continue
+		}
+
+		values := []interface{}{v}
+		if arr, ok := v.([]interface{}); ok {
+			values = arr
+		}
+
+		for _, value := range values {
+			if obj, ok := value.(map[string]interface{}); ok {
+				if hasNewProperties(mapping, obj, prefix+k+".") {
+					return true
+				}
+				continue
+			}
+
+			if value != nil && mapping[prefix+k] == "" {
+				return true
+			}
+		}
+	}
+
+	return false
 }
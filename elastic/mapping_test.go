@@ -0,0 +1,75 @@
+package elastic
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMappingCachePanic(t *testing.T) {
+	c := newMappingCache(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.get(ctx, "a", func(ctx context.Context, idx string) (map[string]string, error) {
+		panic("fetch")
+	})
+	if err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("got %v, want the error of the fetch", err)
+	}
+
+	// the failed fetch isn't cached
+	mapping, err := c.get(ctx, "a", func(ctx context.Context, idx string) (map[string]string, error) {
+		return map[string]string{"price": "long"}, nil
+	})
+	if err != nil || mapping["price"] != "long" {
+		t.Fatalf("got %v, %v", mapping, err)
+	}
+}
+
+func TestMappingCacheCancelledCaller(t *testing.T) {
+	c := newMappingCache(time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context, idx string) (map[string]string, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return map[string]string{"price": "long"}, nil
+	}
+
+	// the caller starting the fetch gives up
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := c.get(first, "a", fetch)
+		firstErr <- err
+	}()
+	<-started
+
+	second := make(chan error)
+	go func() {
+		_, err := c.get(context.Background(), "a", fetch)
+		second <- err
+	}()
+
+	cancelFirst()
+	if err := <-firstErr; err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatalf("the other waiter failed with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the other waiter is still waiting")
+	}
+}
@@ -0,0 +1,1066 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Memory is an in-memory elasticsearch cluster for tests and local development.
+// It is an http.RoundTripper answering the requests the Elasticsearch backend makes,
+// so results are shaped exactly like the ones of a real cluster.
+// Only the part of the api and of the query dsl this package uses is supported.
+type Memory struct {
+	mu      sync.RWMutex
+	indices map[string]*memoryIndex
+	// alias to the names of its indices
+	aliases map[string][]string
+	// the tasks run without waiting for their completion, by id
+	tasks  map[string]map[string]interface{}
+	lastID int
+	// Now resolves "now" in queries, time.Now when nil
+	Now func() time.Time
+}
+
+type memoryIndex struct {
+	name string
+	uuid string
+	// in the order they were indexed
+	docs []*memoryDoc
+	ids  map[string]*memoryDoc
+	// the mapping properties, explicit or inferred like elasticsearch's dynamic mapping
+	properties map[string]interface{}
+	// index.blocks.write
+	blocked bool
+}
+
+type memoryDoc struct {
+	id     string
+	source map[string]interface{}
+	index  *memoryIndex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		indices: make(map[string]*memoryIndex),
+		aliases: make(map[string][]string),
+		tasks:   make(map[string]map[string]interface{}),
+	}
+}
+
+// NewMemoryBackend returns an Elasticsearch backend whose cluster is a new Memory
+func NewMemoryBackend() (*Elasticsearch, *Memory, error) {
+	mem := NewMemory()
+
+	client, err := NewClient(Config{
+		Addresses: []string{"http://memory"},
+		Transport: mem,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewElasticsearch(client), mem, nil
+}
+
+func (m *Memory) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// memoryError is returned by handlers to answer with an elasticsearch error
+type memoryError struct {
+	status int
+	typ    string
+	reason string
+}
+
+func (e *memoryError) Error() string {
+	return e.reason
+}
+
+func newMemoryError(status int, typ, reason string) *memoryError {
+	return &memoryError{status: status, typ: typ, reason: reason}
+}
+
+func (m *Memory) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	parts := []string{}
+	for _, p := range strings.Split(strings.Trim(req.URL.Path, "/"), "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	status, resp, err := m.route(req.Method, parts, req.URL.Query(), body)
+	if err != nil {
+		e, ok := err.(*memoryError)
+		if !ok {
+			e = newMemoryError(http.StatusInternalServerError, "exception", err.Error())
+		}
+		status = e.status
+		resp = map[string]interface{}{
+			"error": map[string]interface{}{
+				"root_cause": []interface{}{map[string]interface{}{"type": e.typ, "reason": e.reason}},
+				"type":       e.typ,
+				"reason":     e.reason,
+			},
+			"status": e.status,
+		}
+	}
+
+	header := http.Header{}
+	header.Set("X-Elastic-Product", "Elasticsearch")
+
+	var b []byte
+	if text, ok := resp.(string); ok {
+		header.Set("Content-Type", "text/plain; charset=UTF-8")
+		b = []byte(text)
+	} else {
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+		header.Set("Content-Type", "application/json; charset=UTF-8")
+		b, err = json.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Method == http.MethodHead {
+		b = nil
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
+
+func (m *Memory) route(method string, parts []string, params url.Values, body []byte) (int, interface{}, error) {
+	if len(parts) == 0 {
+		return http.StatusOK, map[string]interface{}{
+			"name":         "memory",
+			"cluster_name": "memory",
+			"version":      map[string]interface{}{"number": "7.10.2", "build_flavor": "default"},
+			"tagline":      "You Know, for Search",
+		}, nil
+	}
+
+	switch parts[0] {
+	case "_bulk":
+		return m.bulk("", params, body)
+	case "_msearch":
+		return m.msearch("", body)
+	case "_aliases":
+		return m.updateAliases(body)
+	case "_reindex":
+		return m.reindex(params, body)
+	case "_tasks":
+		if len(parts) == 2 {
+			return m.task(parts[1])
+		}
+		if len(parts) == 3 && parts[2] == "_cancel" {
+			return m.cancelTask(parts[1])
+		}
+	}
+
+	if parts[0] == "_cat" && len(parts) >= 2 && parts[1] == "indices" {
+		pattern := "*"
+		if len(parts) > 2 {
+			pattern = parts[2]
+		}
+		return m.catIndices(pattern, params)
+	}
+
+	if len(parts) == 1 && method == http.MethodPut {
+		return m.createIndex(parts[0], body)
+	}
+
+	if len(parts) == 1 && method == http.MethodDelete {
+		return m.deleteIndex(parts[0])
+	}
+
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "_search":
+			return m.search(parts[0], params, body)
+		case "_count":
+			return m.count(parts[0], body)
+		case "_mapping":
+			if method == http.MethodPut || method == http.MethodPost {
+				return m.putMapping(parts[0], body)
+			}
+			return m.mapping(parts[0])
+		case "_bulk":
+			return m.bulk(parts[0], params, body)
+		case "_msearch":
+			return m.msearch(parts[0], body)
+		case "_settings":
+			return m.putSettings(parts[0], body)
+		}
+	}
+
+	if len(parts) == 3 && parts[1] == "_clone" && (method == http.MethodPut || method == http.MethodPost) {
+		return m.cloneIndex(parts[0], parts[2])
+	}
+
+	if len(parts) == 3 && (parts[1] == "_doc" || parts[1] == "_create") {
+		if method == http.MethodGet {
+			return m.get(parts[0], parts[2])
+		}
+
+		opType := params.Get("op_type")
+		if parts[1] == "_create" {
+			opType = "create"
+		}
+		return m.index(parts[0], parts[2], opType, body)
+	}
+
+	return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("%s /%s is not supported by the memory cluster", method, strings.Join(parts, "/")))
+}
+
+// resolve returns the indices matching the comma separated names, aliases and wildcards
+func (m *Memory) resolve(names string) ([]*memoryIndex, error) {
+	indices := []*memoryIndex{}
+	seen := make(map[string]bool)
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			indices = append(indices, m.indices[name])
+		}
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		if !strings.Contains(name, "*") {
+			if _, ok := m.indices[name]; ok {
+				add(name)
+				continue
+			}
+
+			alias, ok := m.aliases[name]
+			if !ok {
+				return nil, newMemoryError(http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]")
+			}
+			for _, n := range alias {
+				add(n)
+			}
+			continue
+		}
+
+		matched := []string{}
+		for n := range m.indices {
+			if ok, _ := filepath.Match(name, n); ok {
+				matched = append(matched, n)
+			}
+		}
+		for a, alias := range m.aliases {
+			if ok, _ := filepath.Match(name, a); ok {
+				matched = append(matched, alias...)
+			}
+		}
+		sort.Strings(matched)
+		for _, n := range matched {
+			add(n)
+		}
+	}
+
+	return indices, nil
+}
+
+// writeIndex returns the index a document sent to name is written to, creating it when missing
+func (m *Memory) writeIndex(name string) (*memoryIndex, error) {
+	if alias, ok := m.aliases[name]; ok {
+		if len(alias) != 1 {
+			return nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "no write index is defined for alias ["+name+"]")
+		}
+		return m.indices[alias[0]], nil
+	}
+
+	if name == "" || strings.ToLower(name) != name || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "-") || strings.ContainsAny(name, `\/*?"<>| ,#:`) {
+		return nil, newMemoryError(http.StatusBadRequest, "invalid_index_name_exception", "Invalid index name ["+name+"]")
+	}
+
+	return m.getOrCreateIndex(name), nil
+}
+
+func (m *Memory) getOrCreateIndex(name string) *memoryIndex {
+	idx, ok := m.indices[name]
+	if !ok {
+		idx = &memoryIndex{
+			name:       name,
+			uuid:       GetID(),
+			ids:        make(map[string]*memoryDoc),
+			properties: make(map[string]interface{}),
+		}
+		m.indices[name] = idx
+	}
+	return idx
+}
+
+// put indexes the json source, the returned result is "created" or "updated"
+func (m *Memory) put(name, id, opType string, source []byte) (string, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var doc map[string]interface{}
+	err := json.Unmarshal(source, &doc)
+	if err != nil || doc == nil {
+		return "", newMemoryError(http.StatusBadRequest, "mapper_parsing_exception", "failed to parse")
+	}
+
+	// numbers as written, to tell longs from floats, decode into encoding/json numbers
+	var raw map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(source))
+	d.UseNumber()
+	d.Decode(&raw)
+
+	idx, err := m.writeIndex(name)
+	if err != nil {
+		return "", err
+	}
+	if idx.blocked {
+		return "", newMemoryError(http.StatusForbidden, "cluster_block_exception", "index ["+idx.name+"] blocked by: [FORBIDDEN/8/index write (api)];")
+	}
+
+	if id == "" {
+		id = GetID()
+	}
+
+	existing, exists := idx.ids[id]
+	if exists && opType == "create" {
+		return "", newMemoryError(http.StatusConflict, "version_conflict_engine_exception", "["+id+"]: version conflict, document already exists")
+	}
+
+	err = mapProperties(idx.properties, raw)
+	if err != nil {
+		return "", err
+	}
+
+	if exists {
+		existing.source = doc
+		return "updated", nil
+	}
+
+	md := &memoryDoc{id: id, source: doc, index: idx}
+	idx.docs = append(idx.docs, md)
+	idx.ids[id] = md
+
+	return "created", nil
+}
+
+// remove deletes the document, the result is the bulk item
+func (m *Memory) remove(name, id string) map[string]interface{} {
+	item := map[string]interface{}{"_index": name, "_type": "_doc", "_id": id, "result": "not_found", "status": http.StatusNotFound}
+
+	idx, err := m.writeIndex(name)
+	if err != nil {
+		e := err.(*memoryError)
+		return map[string]interface{}{"_index": name, "_type": "_doc", "_id": id, "status": e.status, "error": map[string]interface{}{"type": e.typ, "reason": e.reason}}
+	}
+
+	doc, ok := idx.ids[id]
+	if !ok {
+		return item
+	}
+
+	delete(idx.ids, id)
+	for i, d := range idx.docs {
+		if d == doc {
+			idx.docs = append(idx.docs[:i], idx.docs[i+1:]...)
+			break
+		}
+	}
+
+	item["result"] = "deleted"
+	item["status"] = http.StatusOK
+	return item
+}
+
+func (m *Memory) index(name, id, opType string, body []byte) (int, interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result, err := m.put(name, id, opType, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	status := http.StatusOK
+	if result == "created" {
+		status = http.StatusCreated
+	}
+
+	return status, map[string]interface{}{
+		"_index":   name,
+		"_type":    "_doc",
+		"_id":      id,
+		"_version": 1,
+		"result":   result,
+	}, nil
+}
+
+func (m *Memory) get(name, id string) (int, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	indices, err := m.resolve(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	doc, ok := indices[0].ids[id]
+	if !ok {
+		return http.StatusNotFound, map[string]interface{}{"_index": name, "_type": "_doc", "_id": id, "found": false}, nil
+	}
+
+	return http.StatusOK, map[string]interface{}{"_index": name, "_type": "_doc", "_id": id, "found": true, "_source": doc.source}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+func (m *Memory) bulk(defaultIndex string, params url.Values, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := []interface{}{}
+	hasErrors := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 100*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var action map[string]map[string]interface{}
+		err := json.Unmarshal(line, &action)
+		if err != nil || len(action) != 1 {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "Malformed action/metadata line")
+		}
+
+		for op, meta := range action {
+			name, _ := meta["_index"].(string)
+			if name == "" {
+				name = defaultIndex
+			}
+			id, _ := meta["_id"].(string)
+
+			if op == "delete" {
+				item := m.remove(name, id)
+				if _, failed := item["error"]; failed {
+					hasErrors = true
+				}
+				items = append(items, map[string]interface{}{op: item})
+				continue
+			}
+
+			if op != "index" && op != "create" {
+				return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "Unsupported bulk action ["+op+"]")
+			}
+
+			if !scanner.Scan() {
+				return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "The bulk request must be terminated by a newline")
+			}
+			source := append([]byte{}, scanner.Bytes()...)
+
+			if id == "" {
+				id = GetID()
+			}
+
+			item := map[string]interface{}{"_index": name, "_type": "_doc", "_id": id}
+			result, err := m.put(name, id, op, source)
+			if err != nil {
+				e, ok := err.(*memoryError)
+				if !ok {
+					e = newMemoryError(http.StatusInternalServerError, "exception", err.Error())
+				}
+				hasErrors = true
+				item["status"] = e.status
+				item["error"] = map[string]interface{}{"type": e.typ, "reason": e.reason}
+			} else {
+				item["result"] = result
+				item["_version"] = 1
+				if result == "created" {
+					item["status"] = http.StatusCreated
+				} else {
+					item["status"] = http.StatusOK
+				}
+			}
+
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+
+	return http.StatusOK, map[string]interface{}{"took": 0, "errors": hasErrors, "items": items}, nil
+}
+
+func (m *Memory) mapping(names string) (int, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	indices, err := m.resolve(names)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp := make(map[string]interface{})
+	for _, idx := range indices {
+		resp[idx.name] = map[string]interface{}{"mappings": map[string]interface{}{"properties": idx.properties}}
+	}
+
+	return http.StatusOK, resp, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-create-index.html
+func (m *Memory) createIndex(name string, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var req struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &req)
+		if err != nil {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "parse_exception", "Failed to parse content to map")
+		}
+	}
+
+	_, exists := m.indices[name]
+	if _, ok := m.aliases[name]; ok || exists {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "resource_already_exists_exception", "index ["+name+"] already exists")
+	}
+
+	idx, err := m.writeIndex(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = mergeProperties(idx.properties, req.Mappings.Properties, "")
+	if err != nil {
+		delete(m.indices, name)
+		return 0, nil, err
+	}
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": name}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-put-mapping.html
+func (m *Memory) putMapping(names string, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var req struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "parse_exception", "Failed to parse content to map")
+	}
+
+	indices, err := m.resolve(names)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// every index is checked before any is changed
+	for _, idx := range indices {
+		err = mergeProperties(copyProperties(idx.properties), req.Properties, "")
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	for _, idx := range indices {
+		mergeProperties(idx.properties, req.Properties, "")
+	}
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}, nil
+}
+
+// mergeProperties adds the mapping properties, the types of the mapped ones can't change
+func mergeProperties(properties, update map[string]interface{}, prefix string) error {
+	for k, v := range update {
+		field, ok := v.(map[string]interface{})
+		if !ok {
+			return newMemoryError(http.StatusBadRequest, "mapper_parsing_exception", "Expected map for property [fields] on field ["+prefix+k+"]")
+		}
+
+		existing, ok := properties[k].(map[string]interface{})
+		if !ok {
+			properties[k] = copyProperties(field)
+			continue
+		}
+
+		sub, isObject := field["properties"].(map[string]interface{})
+		existingSub, wasObject := existing["properties"].(map[string]interface{})
+		if isObject != wasObject {
+			return newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "can't merge a non object mapping ["+prefix+k+"] with an object mapping")
+		}
+		if isObject {
+			err := mergeProperties(existingSub, sub, prefix+k+".")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if existing["type"] != field["type"] {
+			return newMemoryError(http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("mapper [%s%s] cannot be changed from type [%v] to [%v]", prefix, k, existing["type"], field["type"]))
+		}
+	}
+
+	return nil
+}
+
+// copyProperties deep copies a mapping
+func copyProperties(properties map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(properties))
+	for k, v := range properties {
+		if obj, ok := v.(map[string]interface{}); ok {
+			v = copyProperties(obj)
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/cat-indices.html
+func (m *Memory) catIndices(pattern string, params url.Values) (int, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	indices, err := m.resolve(pattern)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	columns := []string{"health", "status", "index", "uuid", "pri", "rep", "docs.count", "docs.deleted", "store.size", "pri.store.size"}
+	if h := params.Get("h"); h != "" {
+		columns = strings.Split(h, ",")
+	}
+
+	rows := []interface{}{}
+	text := ""
+	for _, idx := range indices {
+		all := map[string]string{
+			"health":         "yellow",
+			"status":         "open",
+			"index":          idx.name,
+			"uuid":           idx.uuid,
+			"pri":            "1",
+			"rep":            "1",
+			"docs.count":     strconv.Itoa(len(idx.docs)),
+			"docs.deleted":   "0",
+			"store.size":     "0b",
+			"pri.store.size": "0b",
+		}
+
+		row := make(map[string]interface{})
+		values := []string{}
+		for _, c := range columns {
+			row[c] = all[c]
+			values = append(values, all[c])
+		}
+		rows = append(rows, row)
+		text = text + strings.Join(values, " ") + "\n"
+	}
+
+	if params.Get("format") == "json" {
+		return http.StatusOK, rows, nil
+	}
+
+	return http.StatusOK, text, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-aliases.html
+func (m *Memory) updateAliases(body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var req struct {
+		Actions []map[string]struct {
+			Index string `json:"index"`
+			Alias string `json:"alias"`
+		} `json:"actions"`
+	}
+	err := json.Unmarshal(body, &req)
+	if err != nil || len(req.Actions) == 0 {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: no actions specified;")
+	}
+
+	// the actions are atomic, they are applied to a copy
+	aliases := make(map[string][]string)
+	for a, names := range m.aliases {
+		aliases[a] = append([]string{}, names...)
+	}
+	removed := make(map[string]bool)
+
+	for _, action := range req.Actions {
+		for op, a := range action {
+			if _, ok := m.indices[a.Index]; !ok || removed[a.Index] {
+				return 0, nil, newMemoryError(http.StatusNotFound, "index_not_found_exception", "no such index ["+a.Index+"]")
+			}
+
+			switch op {
+			case "add":
+				if _, ok := m.indices[a.Alias]; ok && !removed[a.Alias] {
+					return 0, nil, newMemoryError(http.StatusBadRequest, "invalid_alias_name_exception", "Invalid alias name ["+a.Alias+"]: an index or data stream exists with the same name as the alias")
+				}
+				exists := false
+				for _, n := range aliases[a.Alias] {
+					exists = exists || n == a.Index
+				}
+				if !exists {
+					aliases[a.Alias] = append(aliases[a.Alias], a.Index)
+				}
+
+			case "remove":
+				kept := []string{}
+				for _, n := range aliases[a.Alias] {
+					if n != a.Index {
+						kept = append(kept, n)
+					}
+				}
+				if len(kept) == len(aliases[a.Alias]) {
+					return 0, nil, newMemoryError(http.StatusNotFound, "aliases_not_found_exception", "aliases ["+a.Alias+"] missing")
+				}
+				aliases[a.Alias] = kept
+				if len(kept) == 0 {
+					delete(aliases, a.Alias)
+				}
+
+			case "remove_index":
+				removed[a.Index] = true
+
+			default:
+				return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "Unsupported alias action ["+op+"]")
+			}
+		}
+	}
+
+	for name := range removed {
+		delete(m.indices, name)
+		for a, names := range aliases {
+			kept := []string{}
+			for _, n := range names {
+				if n != name {
+					kept = append(kept, n)
+				}
+			}
+			aliases[a] = kept
+			if len(kept) == 0 {
+				delete(aliases, a)
+			}
+		}
+	}
+	m.aliases = aliases
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-search.html
+func (m *Memory) search(names string, params url.Values, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	indices := []*memoryIndex{}
+	if params.Get("ignore_unavailable") == "true" {
+		// missing indices are left out
+		for _, name := range strings.Split(names, ",") {
+			if found, err := m.resolve(name); err == nil {
+				indices = append(indices, found...)
+			}
+		}
+	} else {
+		found, err := m.resolve(names)
+		if err != nil {
+			return 0, nil, err
+		}
+		indices = found
+	}
+
+	var req map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		err := json.Unmarshal(body, &req)
+		if err != nil {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "parsing_exception", "failed to parse search source")
+		}
+	}
+
+	size := 10
+	if s, ok := req["size"].(float64); ok {
+		size = int(s)
+	}
+	if s := params.Get("size"); s != "" {
+		size, _ = strconv.Atoi(s)
+	}
+
+	docs, err := m.match(indices, req["query"])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hits := []interface{}{}
+	for i := 0; i < len(docs) && i < size; i++ {
+		hits = append(hits, map[string]interface{}{
+			"_index":  docs[i].index.name,
+			"_type":   "_doc",
+			"_id":     docs[i].id,
+			"_score":  1.0,
+			"_source": docs[i].source,
+		})
+	}
+
+	total := map[string]interface{}{"value": len(docs), "relation": "eq"}
+	if track, ok := req["track_total_hits"].(bool); !(ok && track) && len(docs) > 10000 {
+		total = map[string]interface{}{"value": 10000, "relation": "gte"}
+	}
+
+	resp := map[string]interface{}{
+		"took":      0,
+		"timed_out": false,
+		"_shards":   map[string]interface{}{"total": len(indices), "successful": len(indices), "skipped": 0, "failed": 0},
+		"hits":      map[string]interface{}{"total": total, "max_score": nil, "hits": hits},
+	}
+
+	aggs, ok := req["aggs"].(map[string]interface{})
+	if !ok {
+		aggs, ok = req["aggregations"].(map[string]interface{})
+	}
+	if ok {
+		result, err := m.aggregations(docs, aggs)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp["aggregations"] = result
+	}
+
+	return http.StatusOK, resp, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-multi-search.html
+func (m *Memory) msearch(defaultIndex string, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	lines := [][]byte{}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 || len(lines)%2 != 0 {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "The msearch request must have a header and a body for every search")
+	}
+
+	responses := []interface{}{}
+	for i := 0; i < len(lines); i += 2 {
+		var header map[string]interface{}
+		err := json.Unmarshal(lines[i], &header)
+		if err != nil {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "parsing_exception", "failed to parse msearch header")
+		}
+
+		names := defaultIndex
+		switch idx := header["index"].(type) {
+		case string:
+			names = idx
+		case []interface{}:
+			list := []string{}
+			for _, n := range idx {
+				list = append(list, fmt.Sprintf("%v", n))
+			}
+			names = strings.Join(list, ",")
+		}
+
+		params := url.Values{}
+		if ignore, ok := header["ignore_unavailable"].(bool); ok {
+			params.Set("ignore_unavailable", strconv.FormatBool(ignore))
+		}
+
+		status, resp, err := m.search(names, params, lines[i+1])
+		if err != nil {
+			e, ok := err.(*memoryError)
+			if !ok {
+				e = newMemoryError(http.StatusInternalServerError, "exception", err.Error())
+			}
+			responses = append(responses, map[string]interface{}{
+				"error":  map[string]interface{}{"type": e.typ, "reason": e.reason},
+				"status": e.status,
+			})
+			continue
+		}
+
+		r := resp.(map[string]interface{})
+		r["status"] = status
+		responses = append(responses, r)
+	}
+
+	return http.StatusOK, map[string]interface{}{"took": 0, "responses": responses}, nil
+}
+
+func (m *Memory) count(names string, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	indices, err := m.resolve(names)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var req map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "parsing_exception", "failed to parse count source")
+		}
+	}
+
+	docs, err := m.match(indices, req["query"])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusOK, map[string]interface{}{
+		"count":   len(docs),
+		"_shards": map[string]interface{}{"total": len(indices), "successful": len(indices), "skipped": 0, "failed": 0},
+	}, nil
+}
+
+// like elasticsearch's strict_date_optional_time, strings like this are mapped as dates
+var memoryDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(T\d{2}(:\d{2}(:\d{2}([.,]\d{1,9})?)?)?(Z|[+-]\d{2}(:?\d{2})?)?)?$`)
+
+// the field types whose values are checked, as normalizeValue parses them
+var memoryParsedTypes = map[string]bool{
+	"keyword": true, "text": true, "boolean": true, "date": true,
+	"long": true, "integer": true, "short": true, "byte": true,
+	"float": true, "double": true, "half_float": true, "scaled_float": true,
+}
+
+// mapProperties adds the fields of doc that are not mapped yet, the first type seen wins,
+// and checks the values of the mapped ones
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/dynamic-field-mapping.html
+func mapProperties(properties map[string]interface{}, doc map[string]interface{}) error {
+	for k, v := range doc {
+		items := []interface{}{v}
+		if arr, ok := v.([]interface{}); ok {
+			items = arr
+			v = nil
+			for _, item := range arr {
+				if item != nil {
+					v = item
+					break
+				}
+			}
+		}
+
+		if v == nil {
+			continue
+		}
+
+		if obj, ok := v.(map[string]interface{}); ok {
+			field, ok := properties[k].(map[string]interface{})
+			if !ok {
+				field = map[string]interface{}{"properties": map[string]interface{}{}}
+				properties[k] = field
+			}
+
+			props, ok := field["properties"].(map[string]interface{})
+			if !ok {
+				return newMemoryError(http.StatusBadRequest, "mapper_parsing_exception", "object mapping for ["+k+"] tried to parse field ["+k+"] as object, but found a concrete value")
+			}
+
+			err := mapProperties(props, obj)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field, ok := properties[k].(map[string]interface{}); ok {
+			if _, isObject := field["properties"]; isObject {
+				return newMemoryError(http.StatusBadRequest, "mapper_parsing_exception", "object mapping for ["+k+"] tried to parse field ["+k+"] as object, but found a concrete value")
+			}
+
+			// the values have to be parsed as the mapped type
+			typ, _ := field["type"].(string)
+			if !memoryParsedTypes[typ] {
+				continue
+			}
+			for _, item := range items {
+				if n, ok := item.(stdjson.Number); ok {
+					item, _ = n.Float64()
+				}
+				if _, ok := normalizeValue(item, typ); item != nil && !ok {
+					return newMemoryError(http.StatusBadRequest, "mapper_parsing_exception", fmt.Sprintf("failed to parse field [%s] of type [%s]", k, typ))
+				}
+			}
+			continue
+		}
+
+		switch val := v.(type) {
+		case string:
+			if memoryDateRe.MatchString(val) {
+				properties[k] = map[string]interface{}{"type": "date"}
+			} else {
+				properties[k] = map[string]interface{}{
+					"type":   "text",
+					"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+				}
+			}
+		case stdjson.Number:
+			if strings.ContainsAny(string(val), ".eE") {
+				properties[k] = map[string]interface{}{"type": "float"}
+			} else {
+				properties[k] = map[string]interface{}{"type": "long"}
+			}
+		case bool:
+			properties[k] = map[string]interface{}{"type": "boolean"}
+		}
+	}
+
+	return nil
+}
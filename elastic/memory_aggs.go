@@ -0,0 +1,718 @@
+package elastic
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// like search.max_buckets
+const memoryMaxBuckets = 65535
+
+var memoryDefaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+var fixedIntervalRe = regexp.MustCompile(`^(\d+)(ms|s|m|h|d)$`)
+
+var calendarIntervals = map[string]string{
+	"minute": "minute", "1m": "minute",
+	"hour": "hour", "1h": "hour",
+	"day": "day", "1d": "day",
+	"week": "week", "1w": "week",
+	"month": "month", "1M": "month",
+	"quarter": "quarter", "1q": "quarter",
+	"year": "year", "1y": "year",
+}
+
+func aggError(format string, a ...interface{}) error {
+	return newMemoryError(http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf(format, a...))
+}
+
+// memoryBucket is the documents of a bucket aggregation's bucket and its key
+type memoryBucket struct {
+	key         interface{}
+	keyAsString string
+	docs        []*memoryDoc
+}
+
+// aggregations computes the aggregations over the documents
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations.html
+func (m *Memory) aggregations(docs []*memoryDoc, aggs map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+
+	for name, a := range aggs {
+		agg, ok := a.(map[string]interface{})
+		if !ok {
+			return nil, aggError("Expected [START_OBJECT] under [%s]", name)
+		}
+
+		sub, _ := agg["aggs"].(map[string]interface{})
+		if sub == nil {
+			sub, _ = agg["aggregations"].(map[string]interface{})
+		}
+
+		found := false
+		for typ, p := range agg {
+			if typ == "aggs" || typ == "aggregations" {
+				continue
+			}
+			if found {
+				return nil, aggError("Found two aggregation type definitions in [%s]", name)
+			}
+			found = true
+
+			params, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, aggError("Expected [START_OBJECT] under [%s]", typ)
+			}
+
+			r, err := m.aggregation(docs, typ, params, sub)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = r
+		}
+
+		if !found {
+			return nil, aggError("Missing definition for aggregation [%s]", name)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *Memory) aggregation(docs []*memoryDoc, typ string, params, sub map[string]interface{}) (map[string]interface{}, error) {
+	switch typ {
+	case "terms":
+		return m.termsAgg(docs, params, sub)
+	case "date_histogram":
+		return m.dateHistogramAgg(docs, params, sub)
+	case "composite":
+		return m.compositeAgg(docs, params, sub)
+	case "filter":
+		return m.filterAgg(docs, params, sub)
+	}
+
+	field, _ := params["field"].(string)
+
+	if typ == "cardinality" {
+		distinct := make(map[interface{}]bool)
+		for _, doc := range docs {
+			terms, err := aggregatableValues(doc, field)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range terms {
+				distinct[t] = true
+			}
+		}
+		return map[string]interface{}{"value": len(distinct)}, nil
+	}
+
+	values := []float64{}
+	date := false
+	for _, doc := range docs {
+		terms, err := aggregatableValues(doc, field)
+		if err != nil {
+			return nil, err
+		}
+		if doc.index.fieldType(field) == "date" {
+			date = true
+		}
+		for _, t := range terms {
+			switch v := t.(type) {
+			case float64:
+				values = append(values, v)
+			case bool:
+				if v {
+					values = append(values, 1)
+				} else {
+					values = append(values, 0)
+				}
+			default:
+				return nil, aggError("Field [%s] of type [%s] is not supported for aggregation [%s]", field, doc.index.fieldType(field), typ)
+			}
+		}
+	}
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+
+	switch typ {
+	case "min", "max":
+		if len(values) == 0 {
+			return map[string]interface{}{"value": nil}, nil
+		}
+		value := values[0]
+		if typ == "max" {
+			value = values[len(values)-1]
+		}
+		result := map[string]interface{}{"value": value}
+		if date {
+			result["value_as_string"] = time.Unix(0, int64(value)*int64(time.Millisecond)).UTC().Format(timestampFormat)
+		}
+		return result, nil
+
+	case "sum":
+		return map[string]interface{}{"value": sum}, nil
+
+	case "avg":
+		if len(values) == 0 {
+			return map[string]interface{}{"value": nil}, nil
+		}
+		return map[string]interface{}{"value": sum / float64(len(values))}, nil
+
+	case "value_count":
+		return map[string]interface{}{"value": len(values)}, nil
+
+	case "percentiles":
+		percents := memoryDefaultPercents
+		if ps, ok := params["percents"].([]interface{}); ok {
+			percents = []float64{}
+			for _, p := range ps {
+				f, ok := p.(float64)
+				if !ok || f < 0 || f > 100 {
+					return nil, aggError("[percents] must be in the [0, 100] range")
+				}
+				percents = append(percents, f)
+			}
+		}
+
+		result := make(map[string]interface{})
+		for _, p := range percents {
+			key := strconv.FormatFloat(p, 'f', -1, 64)
+			if !strings.Contains(key, ".") {
+				key = key + ".0"
+			}
+
+			if len(values) == 0 {
+				result[key] = nil
+			} else {
+				result[key] = percentile(values, p)
+			}
+		}
+		return map[string]interface{}{"values": result}, nil
+
+	case "median_absolute_deviation":
+		if len(values) == 0 {
+			return map[string]interface{}{"value": nil}, nil
+		}
+		median := percentile(values, 50)
+		deviations := []float64{}
+		for _, v := range values {
+			deviations = append(deviations, math.Abs(v-median))
+		}
+		sort.Float64s(deviations)
+		return map[string]interface{}{"value": percentile(deviations, 50)}, nil
+
+	case "stats", "extended_stats":
+		if len(values) == 0 {
+			result := map[string]interface{}{"count": 0, "min": nil, "max": nil, "avg": nil, "sum": 0.0}
+			if typ == "extended_stats" {
+				for _, k := range []string{"sum_of_squares", "variance", "variance_population", "variance_sampling", "std_deviation", "std_deviation_population", "std_deviation_sampling"} {
+					result[k] = nil
+				}
+				result["std_deviation_bounds"] = map[string]interface{}{"upper": nil, "lower": nil}
+			}
+			return result, nil
+		}
+
+		n := float64(len(values))
+		avg := sum / n
+		result := map[string]interface{}{"count": len(values), "min": values[0], "max": values[len(values)-1], "avg": avg, "sum": sum}
+
+		if typ == "extended_stats" {
+			squares := 0.0
+			for _, v := range values {
+				squares += v * v
+			}
+			variance := math.Max(squares/n-avg*avg, 0)
+			sampling := math.NaN()
+			if n > 1 {
+				sampling = math.Max((squares-sum*sum/n)/(n-1), 0)
+			}
+			std := math.Sqrt(variance)
+
+			result["sum_of_squares"] = squares
+			result["variance"] = variance
+			result["variance_population"] = variance
+			result["std_deviation"] = std
+			result["std_deviation_population"] = std
+			result["std_deviation_bounds"] = map[string]interface{}{"upper": avg + 2*std, "lower": avg - 2*std}
+			if math.IsNaN(sampling) {
+				result["variance_sampling"] = nil
+				result["std_deviation_sampling"] = nil
+			} else {
+				result["variance_sampling"] = sampling
+				result["std_deviation_sampling"] = math.Sqrt(sampling)
+			}
+		}
+		return result, nil
+	}
+
+	return nil, newMemoryError(http.StatusBadRequest, "named_object_not_found_exception", "unknown aggregation ["+typ+"]")
+}
+
+// percentile interpolates linearly between the closest ranks of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// aggregatableValues returns the doc values of the field,
+// text fields can't be aggregated without fielddata.
+func aggregatableValues(doc *memoryDoc, field string) ([]interface{}, error) {
+	typ := doc.index.fieldType(field)
+	if typ == "text" {
+		return nil, aggError("Text fields are not optimised for operations that require per-document field data like aggregations and sorting, so these operations are disabled by default. Please use a keyword field instead. Alternatively, set fielddata=true on [%s] in order to load field data by uninverting the inverted index. Note that this can use significant memory.", field)
+	}
+
+	// the distinct values of the document
+	values := []interface{}{}
+	seen := make(map[interface{}]bool)
+	for _, v := range termValues(doc.values(field), typ) {
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+
+	return values, nil
+}
+
+// bucketResult is the doc_count and sub aggregations of a bucket
+func (m *Memory) bucketResult(bucket *memoryBucket, sub map[string]interface{}) (map[string]interface{}, error) {
+	result := map[string]interface{}{"key": bucket.key, "doc_count": len(bucket.docs)}
+	if bucket.keyAsString != "" {
+		result["key_as_string"] = bucket.keyAsString
+	}
+
+	if sub != nil {
+		aggs, err := m.aggregations(bucket.docs, sub)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range aggs {
+			result[k] = v
+		}
+	}
+
+	return result, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-filter-aggregation.html
+func (m *Memory) filterAgg(docs []*memoryDoc, query, sub map[string]interface{}) (map[string]interface{}, error) {
+	now := m.now()
+
+	bucket := &memoryBucket{docs: []*memoryDoc{}}
+	for _, doc := range docs {
+		ok, err := matchQuery(doc, query, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			bucket.docs = append(bucket.docs, doc)
+		}
+	}
+
+	result, err := m.bucketResult(bucket, sub)
+	if err != nil {
+		return nil, err
+	}
+	// a single bucket without key
+	delete(result, "key")
+
+	return result, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-terms-aggregation.html
+func (m *Memory) termsAgg(docs []*memoryDoc, params, sub map[string]interface{}) (map[string]interface{}, error) {
+	field, _ := params["field"].(string)
+
+	size := 10
+	if s, ok := params["size"].(float64); ok {
+		size = int(s)
+	}
+
+	byKey := false
+	asc := false
+	if order, ok := params["order"].(map[string]interface{}); ok {
+		for k, v := range order {
+			if k != "_key" && k != "_count" {
+				return nil, aggError("Invalid aggregation order path [%s]", k)
+			}
+			byKey = k == "_key"
+			asc = v == "asc"
+		}
+	}
+
+	buckets := []*memoryBucket{}
+	index := make(map[interface{}]*memoryBucket)
+	for _, doc := range docs {
+		values, err := aggregatableValues(doc, field)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range values {
+			b, ok := index[v]
+			if !ok {
+				b = &memoryBucket{key: v}
+				switch x := v.(type) {
+				case bool:
+					b.keyAsString = strconv.FormatBool(x)
+					b.key = 0
+					if x {
+						b.key = 1
+					}
+				case float64:
+					if doc.index.fieldType(field) == "date" {
+						b.keyAsString = time.Unix(0, int64(x)*int64(time.Millisecond)).UTC().Format(timestampFormat)
+					}
+				}
+				index[v] = b
+				buckets = append(buckets, b)
+			}
+			b.docs = append(b.docs, doc)
+		}
+	}
+
+	compareKeys := func(i, j int) int {
+		a, b := buckets[i].key, buckets[j].key
+		if _, ok := a.(int); ok {
+			return a.(int) - b.(int)
+		}
+		return compareValues(a, b)
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if !byKey && len(buckets[i].docs) != len(buckets[j].docs) {
+			if asc {
+				return len(buckets[i].docs) < len(buckets[j].docs)
+			}
+			return len(buckets[i].docs) > len(buckets[j].docs)
+		}
+		if byKey && !asc {
+			return compareKeys(i, j) > 0
+		}
+		return compareKeys(i, j) < 0
+	})
+
+	others := 0
+	results := []interface{}{}
+	for i, b := range buckets {
+		if i >= size {
+			others += len(b.docs)
+			continue
+		}
+
+		r, err := m.bucketResult(b, sub)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return map[string]interface{}{
+		"doc_count_error_upper_bound": 0,
+		"sum_other_doc_count":         others,
+		"buckets":                     results,
+	}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-datehistogram-aggregation.html
+func (m *Memory) dateHistogramAgg(docs []*memoryDoc, params, sub map[string]interface{}) (map[string]interface{}, error) {
+	field, _ := params["field"].(string)
+
+	loc := time.UTC
+	if tz, ok := params["time_zone"].(string); ok && tz != "" {
+		l, err := GetLocation(tz)
+		if err != nil {
+			return nil, aggError("Unknown time-zone ID: %s", tz)
+		}
+		loc = l
+	}
+
+	// round returns the start of the bucket ms is in and next the start of the following one
+	var round func(ms int64) int64
+	var next func(key int64) int64
+
+	toTime := func(ms int64) time.Time {
+		return time.Unix(0, ms*int64(time.Millisecond)).In(loc)
+	}
+	toMillis := func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+
+	if interval, ok := params["calendar_interval"].(string); ok {
+		unit, ok := calendarIntervals[interval]
+		if !ok {
+			return nil, aggError("The supplied interval [%s] could not be parsed as a calendar interval.", interval)
+		}
+		round = func(ms int64) int64 { return toMillis(truncateTime(toTime(ms), unit)) }
+		next = func(key int64) int64 { return toMillis(addUnits(toTime(key), unit, 1)) }
+	} else if interval, ok := params["fixed_interval"].(string); ok {
+		match := fixedIntervalRe.FindStringSubmatch(interval)
+		if match == nil {
+			return nil, aggError("failed to parse setting [date_histogram.fixedInterval] with value [%s] as a time value", interval)
+		}
+		n, _ := strconv.ParseInt(match[1], 10, 64)
+		units := map[string]int64{"ms": 1, "s": 1000, "m": 60 * 1000, "h": 3600 * 1000, "d": 24 * 3600 * 1000}
+		d := n * units[match[2]]
+		if d <= 0 {
+			return nil, aggError("Zero or negative time interval not supported")
+		}
+
+		round = func(ms int64) int64 {
+			_, offset := toTime(ms).Zone()
+			local := ms + int64(offset)*1000
+			key := local - local%d
+			if local%d < 0 {
+				key -= d
+			}
+			return key - int64(offset)*1000
+		}
+		next = func(key int64) int64 { return round(key + d) }
+	} else {
+		return nil, aggError("Invalid interval specified, must be non-null and non-empty")
+	}
+
+	minDocCount := 0
+	if n, ok := params["min_doc_count"].(float64); ok {
+		minDocCount = int(n)
+	}
+
+	index := make(map[int64]*memoryBucket)
+	for _, doc := range docs {
+		values, err := aggregatableValues(doc, field)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[int64]bool)
+		for _, v := range values {
+			ms, ok := v.(float64)
+			if !ok {
+				return nil, aggError("Field [%s] of type [%s] is not supported for aggregation [date_histogram]", field, doc.index.fieldType(field))
+			}
+
+			key := round(int64(ms))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			b, ok := index[key]
+			if !ok {
+				b = &memoryBucket{key: key}
+				index[key] = b
+			}
+			b.docs = append(b.docs, doc)
+		}
+	}
+
+	keys := []int64{}
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	if minDocCount == 0 {
+		first, last := int64(0), int64(0)
+		hasRange := len(keys) > 0
+		if hasRange {
+			first, last = keys[0], keys[len(keys)-1]
+		}
+
+		if bounds, ok := params["extended_bounds"].(map[string]interface{}); ok {
+			if min, ok := bounds["min"]; ok {
+				ms, ok := parseDateMillis(min, loc, m.now())
+				if !ok {
+					return nil, aggError("failed to parse date field [%v]", min)
+				}
+				if key := round(ms); !hasRange || key < first {
+					first = key
+					if !hasRange {
+						last = key
+					}
+					hasRange = true
+				}
+			}
+			if max, ok := bounds["max"]; ok {
+				ms, ok := parseDateMillis(max, loc, m.now())
+				if !ok {
+					return nil, aggError("failed to parse date field [%v]", max)
+				}
+				if key := round(ms); !hasRange || key > last {
+					last = key
+					if !hasRange {
+						first = key
+					}
+					hasRange = true
+				}
+			}
+		}
+
+		if hasRange {
+			keys = []int64{}
+			for key := first; key <= last; key = next(key) {
+				keys = append(keys, key)
+				if _, ok := index[key]; !ok {
+					index[key] = &memoryBucket{key: key}
+				}
+				if len(keys) > memoryMaxBuckets {
+					break
+				}
+			}
+		}
+	}
+
+	if len(keys) > memoryMaxBuckets {
+		return nil, newMemoryError(http.StatusServiceUnavailable, "too_many_buckets_exception", fmt.Sprintf("Trying to create too many buckets. Must be less than or equal to: [%d].", memoryMaxBuckets))
+	}
+
+	results := []interface{}{}
+	for _, key := range keys {
+		b := index[key]
+		if len(b.docs) < minDocCount {
+			continue
+		}
+		b.keyAsString = toTime(key).Format("2006-01-02T15:04:05.000Z07:00")
+
+		r, err := m.bucketResult(b, sub)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return map[string]interface{}{"buckets": results}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-bucket-composite-aggregation.html
+func (m *Memory) compositeAgg(docs []*memoryDoc, params, sub map[string]interface{}) (map[string]interface{}, error) {
+	size := 10
+	if s, ok := params["size"].(float64); ok {
+		size = int(s)
+	}
+
+	names := []string{}
+	fields := []string{}
+	sources, _ := params["sources"].([]interface{})
+	for _, s := range sources {
+		source, ok := s.(map[string]interface{})
+		if !ok || len(source) != 1 {
+			return nil, aggError("[composite] sources must be objects with a single source")
+		}
+		for name, def := range source {
+			terms, _ := def.(map[string]interface{})["terms"].(map[string]interface{})
+			if terms == nil {
+				return nil, aggError("[composite] only supports terms sources in the memory cluster")
+			}
+			field, _ := terms["field"].(string)
+			names = append(names, name)
+			fields = append(fields, field)
+		}
+	}
+	if len(names) == 0 {
+		return nil, aggError("Composite [sources] cannot be null or empty")
+	}
+
+	type composite struct {
+		key  []interface{}
+		docs []*memoryDoc
+	}
+
+	compare := func(a, b []interface{}) int {
+		for i := range a {
+			if c := compareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+
+	index := make(map[string]*composite)
+	for _, doc := range docs {
+		// every combination of the document's source values
+		keys := [][]interface{}{{}}
+		for _, field := range fields {
+			values, err := aggregatableValues(doc, field)
+			if err != nil {
+				return nil, err
+			}
+
+			combined := [][]interface{}{}
+			for _, k := range keys {
+				for _, v := range values {
+					combined = append(combined, append(append([]interface{}{}, k...), v))
+				}
+			}
+			keys = combined
+		}
+
+		for _, k := range keys {
+			id := fmt.Sprintf("%#v", k)
+			c, ok := index[id]
+			if !ok {
+				c = &composite{key: k}
+				index[id] = c
+			}
+			c.docs = append(c.docs, doc)
+		}
+	}
+
+	var after []interface{}
+	if a, ok := params["after"].(map[string]interface{}); ok {
+		for _, name := range names {
+			after = append(after, a[name])
+		}
+	}
+
+	composites := []*composite{}
+	for _, c := range index {
+		if after == nil || compare(c.key, after) > 0 {
+			composites = append(composites, c)
+		}
+	}
+	sort.Slice(composites, func(i, j int) bool { return compare(composites[i].key, composites[j].key) < 0 })
+
+	if len(composites) > size {
+		composites = composites[:size]
+	}
+
+	results := []interface{}{}
+	var afterKey map[string]interface{}
+	for _, c := range composites {
+		key := make(map[string]interface{})
+		for i, name := range names {
+			key[name] = c.key[i]
+		}
+
+		r, err := m.bucketResult(&memoryBucket{key: key, docs: c.docs}, sub)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+		afterKey = key
+	}
+
+	result := map[string]interface{}{"buckets": results}
+	if afterKey != nil {
+		result["after_key"] = afterKey
+	}
+
+	return result, nil
+}
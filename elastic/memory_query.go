@@ -0,0 +1,542 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// match returns the documents of the indices matching the query, in the order they were indexed
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl.html
+func (m *Memory) match(indices []*memoryIndex, query interface{}) ([]*memoryDoc, error) {
+	docs := []*memoryDoc{}
+	now := m.now()
+
+	for _, idx := range indices {
+		for _, doc := range idx.docs {
+			if query == nil {
+				docs = append(docs, doc)
+				continue
+			}
+
+			ok, err := matchQuery(doc, query, now)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+func queryError(format string, a ...interface{}) error {
+	return newMemoryError(http.StatusBadRequest, "parsing_exception", fmt.Sprintf(format, a...))
+}
+
+func matchQuery(doc *memoryDoc, query interface{}, now time.Time) (bool, error) {
+	q, ok := query.(map[string]interface{})
+	if !ok || len(q) != 1 {
+		return false, queryError("query malformed, must start with an object with a single query name")
+	}
+
+	for name, body := range q {
+		params, ok := body.(map[string]interface{})
+		if !ok {
+			return false, queryError("[%s] query malformed", name)
+		}
+
+		switch name {
+		case "match_all":
+			return true, nil
+		case "match_none":
+			return false, nil
+		case "bool":
+			return matchBool(doc, params, now)
+		case "exists":
+			field, _ := params["field"].(string)
+			return len(doc.values(field)) > 0, nil
+		}
+
+		if len(params) != 1 {
+			return false, queryError("[%s] query doesn't support multiple fields", name)
+		}
+
+		for field, p := range params {
+			typ := doc.index.fieldType(field)
+
+			switch name {
+			case "term":
+				if o, ok := p.(map[string]interface{}); ok {
+					p = o["value"]
+				}
+				return matchTerm(doc.values(field), typ, p), nil
+
+			case "terms":
+				values, ok := p.([]interface{})
+				if !ok {
+					return false, queryError("[terms] query does not support [%s]", field)
+				}
+				dv := doc.values(field)
+				for _, v := range values {
+					if matchTerm(dv, typ, v) {
+						return true, nil
+					}
+				}
+				return false, nil
+
+			case "range":
+				o, ok := p.(map[string]interface{})
+				if !ok {
+					return false, queryError("[range] query malformed, no start_object after query name")
+				}
+				return matchRange(doc.values(field), typ, o, now)
+
+			case "wildcard", "regexp":
+				value := p
+				if o, ok := p.(map[string]interface{}); ok {
+					value = o["value"]
+				}
+				pattern := fmt.Sprintf("%v", value)
+				if name == "wildcard" {
+					pattern = wildcardPattern(pattern)
+				}
+				re, err := regexp.Compile("^(?:" + pattern + ")$")
+				if err != nil {
+					return false, queryError("[%s] invalid pattern [%v]", name, value)
+				}
+				for _, v := range termValues(doc.values(field), typ) {
+					if s, ok := v.(string); ok && re.MatchString(s) {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+		}
+
+		return false, queryError("unknown query [%s]", name)
+	}
+
+	return false, nil
+}
+
+func matchBool(doc *memoryDoc, params map[string]interface{}, now time.Time) (bool, error) {
+	clauses := func(key string) []interface{} {
+		switch c := params[key].(type) {
+		case []interface{}:
+			return c
+		case map[string]interface{}:
+			return []interface{}{c}
+		}
+		return nil
+	}
+
+	for _, key := range []string{"must", "filter"} {
+		for _, q := range clauses(key) {
+			ok, err := matchQuery(doc, q, now)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+
+	for _, q := range clauses("must_not") {
+		ok, err := matchQuery(doc, q, now)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+
+	should := clauses("should")
+	if len(should) == 0 {
+		return true, nil
+	}
+
+	// with no must clauses one should has to match
+	minimum := 0
+	if len(clauses("must"))+len(clauses("filter")) == 0 {
+		minimum = 1
+	}
+	if n, ok := params["minimum_should_match"].(float64); ok {
+		minimum = int(n)
+	}
+
+	matched := 0
+	for _, q := range should {
+		ok, err := matchQuery(doc, q, now)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+
+	return matched >= minimum, nil
+}
+
+func matchTerm(values []interface{}, typ string, value interface{}) bool {
+	if typ == "text" {
+		// the term is not analyzed, it is compared to every token
+		for _, v := range termValues(values, typ) {
+			if v == fmt.Sprintf("%v", value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	qv, ok := normalizeValue(value, typ)
+	if !ok {
+		return false
+	}
+
+	for _, v := range termValues(values, typ) {
+		if v == qv {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchRange(values []interface{}, typ string, params map[string]interface{}, now time.Time) (bool, error) {
+	loc := time.UTC
+	if tz, ok := params["time_zone"].(string); ok && tz != "" {
+		l, err := GetLocation(tz)
+		if err != nil {
+			return false, queryError("[range] query malformed, invalid time_zone [%s]", tz)
+		}
+		loc = l
+	}
+
+	bounds := make(map[string]interface{})
+	for _, op := range []string{"gt", "gte", "lt", "lte"} {
+		b, ok := params[op]
+		if !ok || b == nil {
+			continue
+		}
+
+		if typ == "date" {
+			ms, ok := parseDateMillis(b, loc, now)
+			if !ok {
+				return false, queryError("failed to parse date field [%v]", b)
+			}
+			bounds[op] = float64(ms)
+			continue
+		}
+
+		v, ok := normalizeValue(b, typ)
+		if !ok {
+			return false, queryError("[range] query malformed, invalid value [%v]", b)
+		}
+		bounds[op] = v
+	}
+
+	for _, v := range termValues(values, typ) {
+		in := true
+		for op, b := range bounds {
+			c := compareValues(v, b)
+			switch op {
+			case "gt":
+				in = in && c > 0
+			case "gte":
+				in = in && c >= 0
+			case "lt":
+				in = in && c < 0
+			case "lte":
+				in = in && c <= 0
+			}
+		}
+		if in {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// wildcardPattern turns a wildcard like "*abc?" into a regular expression,
+// a character escaped with \ matches itself
+func wildcardPattern(wildcard string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range wildcard {
+		if escaped {
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+			continue
+		}
+
+		switch r {
+		case '\\':
+			escaped = true
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
+
+// compareValues compares two normalized values of the same type
+func compareValues(a, b interface{}) int {
+	switch x := a.(type) {
+	case float64:
+		y, _ := b.(float64)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, fmt.Sprintf("%v", b))
+	case bool:
+		y, _ := b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// fieldType returns the mapping type of field, "keyword" for the keyword sub field of text fields
+func (idx *memoryIndex) fieldType(field string) string {
+	props := idx.properties
+	parts := strings.Split(field, ".")
+
+	for i, part := range parts {
+		f, ok := props[part].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+
+		if p, ok := f["properties"].(map[string]interface{}); ok {
+			props = p
+			continue
+		}
+
+		typ, _ := f["type"].(string)
+		if i == len(parts)-1 {
+			return typ
+		}
+
+		if i == len(parts)-2 && parts[i+1] == "keyword" && typ == "text" {
+			return "keyword"
+		}
+
+		return ""
+	}
+
+	return ""
+}
+
+// values returns the values of field in the document, arrays flattened
+func (doc *memoryDoc) values(field string) []interface{} {
+	typ := doc.index.fieldType(field)
+	if typ == "" {
+		return nil
+	}
+
+	path := field
+	if typ == "keyword" && doc.index.fieldType(strings.TrimSuffix(field, ".keyword")) == "text" {
+		path = strings.TrimSuffix(field, ".keyword")
+	}
+
+	values := sourceValues(doc.source, path)
+	if typ == "keyword" && path != field {
+		// like ignore_above in the dynamic mapping
+		kept := []interface{}{}
+		for _, v := range values {
+			if s, ok := v.(string); !ok || len(s) <= 256 {
+				kept = append(kept, v)
+			}
+		}
+		values = kept
+	}
+
+	return values
+}
+
+// sourceValues follows the dotted path through objects and arrays
+func sourceValues(source map[string]interface{}, path string) []interface{} {
+	values := []interface{}{}
+
+	if v, ok := source[path]; ok {
+		return appendValues(values, v)
+	}
+
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+
+		switch v := source[path[:i]].(type) {
+		case map[string]interface{}:
+			values = append(values, sourceValues(v, path[i+1:])...)
+		case []interface{}:
+			for _, item := range v {
+				if obj, ok := item.(map[string]interface{}); ok {
+					values = append(values, sourceValues(obj, path[i+1:])...)
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+func appendValues(values []interface{}, v interface{}) []interface{} {
+	switch x := v.(type) {
+	case nil:
+		return values
+	case []interface{}:
+		for _, item := range x {
+			values = appendValues(values, item)
+		}
+		return values
+	}
+	return append(values, v)
+}
+
+// termValues returns what is indexed for the values,
+// tokens for text fields and normalized values for the others
+func termValues(values []interface{}, typ string) []interface{} {
+	terms := []interface{}{}
+
+	for _, v := range values {
+		if typ == "text" {
+			for _, token := range analyze(fmt.Sprintf("%v", keywordValue(v))) {
+				terms = append(terms, token)
+			}
+			continue
+		}
+
+		if n, ok := normalizeValue(v, typ); ok {
+			terms = append(terms, n)
+		}
+	}
+
+	return terms
+}
+
+// analyze splits text in lowercase tokens like the standard analyzer
+func analyze(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func keywordValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	return v
+}
+
+// normalizeValue coerces a value to what a field of the type indexes:
+// strings for keywords, float64 for numbers and epoch millis of dates, and bools
+func normalizeValue(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case "keyword", "text", "":
+		switch v.(type) {
+		case string, float64, bool:
+			return fmt.Sprintf("%v", keywordValue(v)), true
+		}
+		return nil, false
+
+	case "long", "integer", "short", "byte", "float", "double", "half_float", "scaled_float":
+		switch x := v.(type) {
+		case float64:
+			if typ == "long" || typ == "integer" || typ == "short" || typ == "byte" {
+				x = float64(int64(x))
+			}
+			return x, true
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, false
+			}
+			return normalizeValue(f, typ)
+		}
+		return nil, false
+
+	case "boolean":
+		switch x := v.(type) {
+		case bool:
+			return x, true
+		case string:
+			if x == "true" || x == "false" {
+				return x == "true", true
+			}
+		}
+		return nil, false
+
+	case "date":
+		ms, ok := parseDateMillis(v, time.UTC, time.Time{})
+		if !ok {
+			return nil, false
+		}
+		return float64(ms), true
+	}
+
+	return nil, false
+}
+
+// parseDateMillis parses dates like elasticsearch's strict_date_optional_time||epoch_millis,
+// dates without an offset are in loc
+func parseDateMillis(v interface{}, loc *time.Location, now time.Time) (int64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return int64(x), true
+	case int64:
+		return x, true
+	case int:
+		return int64(x), true
+	case string:
+		if x == "now" && !now.IsZero() {
+			return now.UnixNano() / int64(time.Millisecond), true
+		}
+
+		if !memoryDateRe.MatchString(x) {
+			if ms, err := strconv.ParseInt(x, 10, 64); err == nil {
+				return ms, true
+			}
+			return 0, false
+		}
+
+		s := strings.Replace(x, ",", ".", 1)
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700", "2006-01-02T15:04:05.999999999Z07", "2006-01-02T15:04Z07:00", "2006-01-02T15Z07:00"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UnixNano() / int64(time.Millisecond), true
+			}
+		}
+
+		for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02T15", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+				return t.UnixNano() / int64(time.Millisecond), true
+			}
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,284 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-reindex.html
+// Scripts can't be run, the documents are copied as they are.
+func (m *Memory) reindex(params url.Values, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var req struct {
+		Source struct {
+			Index interface{} `json:"index"`
+			Query interface{} `json:"query"`
+		} `json:"source"`
+		Dest struct {
+			Index  string `json:"index"`
+			OpType string `json:"op_type"`
+		} `json:"dest"`
+		Conflicts string      `json:"conflicts"`
+		Script    interface{} `json:"script"`
+	}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "parse_exception", "Failed to parse content to map")
+	}
+
+	if req.Script != nil {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "scripts are not supported by the memory cluster")
+	}
+
+	names := ""
+	switch x := req.Source.Index.(type) {
+	case string:
+		names = x
+	case []interface{}:
+		for _, n := range x {
+			names = names + "," + fmt.Sprintf("%v", n)
+		}
+		names = strings.TrimPrefix(names, ",")
+	}
+	if names == "" || req.Dest.Index == "" {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: use _reindex with a source and a destination index;")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	indices, err := m.resolve(names)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	docs, err := m.match(indices, req.Source.Query)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	created, updated, conflicts := 0, 0, 0
+	failures := []interface{}{}
+	for _, doc := range docs {
+		source, err := json.Marshal(doc.source)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		result, err := m.put(req.Dest.Index, doc.id, req.Dest.OpType, source)
+		if err != nil {
+			e, ok := err.(*memoryError)
+			if !ok {
+				e = newMemoryError(http.StatusInternalServerError, "exception", err.Error())
+			}
+			if e.status == http.StatusConflict && req.Conflicts == "proceed" {
+				conflicts++
+				continue
+			}
+
+			// the reindex stops at the first failure
+			failures = append(failures, map[string]interface{}{
+				"index":  req.Dest.Index,
+				"type":   "_doc",
+				"id":     doc.id,
+				"cause":  map[string]interface{}{"type": e.typ, "reason": e.reason},
+				"status": e.status,
+			})
+			break
+		}
+
+		if result == "created" {
+			created++
+		} else {
+			updated++
+		}
+	}
+
+	status := map[string]interface{}{
+		"total":             len(docs),
+		"created":           created,
+		"updated":           updated,
+		"deleted":           0,
+		"batches":           1,
+		"version_conflicts": conflicts,
+		"noops":             0,
+	}
+
+	response := map[string]interface{}{"took": 0, "timed_out": false, "failures": failures}
+	for k, v := range status {
+		response[k] = v
+	}
+
+	if params.Get("wait_for_completion") != "false" {
+		return http.StatusOK, response, nil
+	}
+
+	m.lastID++
+	id := fmt.Sprintf("memory:%d", m.lastID)
+	m.tasks[id] = map[string]interface{}{
+		"completed": true,
+		"task": map[string]interface{}{
+			"node":        "memory",
+			"id":          m.lastID,
+			"type":        "transport",
+			"action":      "indices:data/write/reindex",
+			"status":      status,
+			"description": "reindex from [" + names + "] to [" + req.Dest.Index + "]",
+		},
+		"response": response,
+	}
+
+	return http.StatusOK, map[string]interface{}{"task": id}, nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/tasks.html
+func (m *Memory) task(id string) (int, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return 0, nil, newMemoryError(http.StatusNotFound, "resource_not_found_exception", "task ["+id+"] isn't running and hasn't stored its results")
+	}
+
+	return http.StatusOK, task, nil
+}
+
+// cancelTask only finds the task, the memory cluster's tasks are completed when they start
+func (m *Memory) cancelTask(id string) (int, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.tasks[id]; !ok {
+		return 0, nil, newMemoryError(http.StatusNotFound, "resource_not_found_exception", "task ["+id+"] doesn't support cancellation")
+	}
+
+	return http.StatusOK, map[string]interface{}{"nodes": map[string]interface{}{}}, nil
+}
+
+// cloneIndex copies the documents and the mapping of an index whose writes are blocked,
+// the clone's writes are blocked too
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-clone-index.html
+func (m *Memory) cloneIndex(name, target string) (int, interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	source, ok := m.indices[name]
+	if !ok {
+		return 0, nil, newMemoryError(http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]")
+	}
+	if !source.blocked {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_state_exception", "index "+name+" must be read-only to resize index. use \"index.blocks.write=true\"")
+	}
+
+	_, exists := m.indices[target]
+	if _, isAlias := m.aliases[target]; isAlias || exists {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "resource_already_exists_exception", "index ["+target+"] already exists")
+	}
+
+	idx, err := m.writeIndex(target)
+	if err != nil {
+		return 0, nil, err
+	}
+	idx.properties = copyProperties(source.properties)
+	for _, doc := range source.docs {
+		clone := &memoryDoc{id: doc.id, source: doc.source, index: idx}
+		idx.docs = append(idx.docs, clone)
+		idx.ids[doc.id] = clone
+	}
+	idx.blocked = true
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": target}, nil
+}
+
+// putSettings only supports index.blocks.write
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/index-modules-blocks.html
+func (m *Memory) putSettings(names string, body []byte) (int, interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var settings map[string]interface{}
+	err := json.Unmarshal(body, &settings)
+	if err != nil {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "parse_exception", "Failed to parse content to map")
+	}
+
+	// index.blocks.write, flat or nested
+	var write interface{}
+	for k, v := range flattenSettings(settings, "") {
+		if k == "index.blocks.write" || k == "blocks.write" {
+			write = v
+			continue
+		}
+		return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "setting ["+k+"] is not supported by the memory cluster")
+	}
+
+	blocked, ok := write.(bool)
+	if s, isString := write.(string); isString {
+		blocked, ok = s == "true", s == "true" || s == "false"
+	}
+	if !ok {
+		return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "Failed to parse value for setting [index.blocks.write]")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	indices, err := m.resolve(names)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, idx := range indices {
+		idx.blocked = blocked
+	}
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}, nil
+}
+
+func flattenSettings(settings map[string]interface{}, prefix string) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for k, v := range settings {
+		if obj, ok := v.(map[string]interface{}); ok {
+			for fk, fv := range flattenSettings(obj, prefix+k+".") {
+				flat[fk] = fv
+			}
+			continue
+		}
+		flat[prefix+k] = v
+	}
+	return flat
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-delete-index.html
+func (m *Memory) deleteIndex(name string) (int, interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.indices[name]; !ok {
+		if _, isAlias := m.aliases[name]; isAlias {
+			return 0, nil, newMemoryError(http.StatusBadRequest, "illegal_argument_exception", "The provided expression ["+name+"] matches an alias, specify the corresponding concrete indices instead.")
+		}
+		return 0, nil, newMemoryError(http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]")
+	}
+
+	delete(m.indices, name)
+	for a, names := range m.aliases {
+		kept := []string{}
+		for _, n := range names {
+			if n != name {
+				kept = append(kept, n)
+			}
+		}
+		m.aliases[a] = kept
+		if len(kept) == 0 {
+			delete(m.aliases, a)
+		}
+	}
+
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}, nil
+}
@@ -0,0 +1,545 @@
+package elastic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const memoryTestProject = "memtest"
+
+// useMemoryBackend records the events of the collections in a new memory cluster
+// and makes it the backend until the returned function is called
+func useMemoryBackend(t *testing.T, events map[string][]string) (*http.Request, func()) {
+	es, mem, err := NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.Now = func() time.Time { return time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC) }
+
+	previous := backend
+	SetBackend(es)
+	// the events are from 2020, whenever the tests run
+	SetTimestampWindow(0, 0)
+	restore := func() {
+		SetBackend(previous)
+		SetTimestampWindow(DefaultTimestampPast, DefaultTimestampFuture)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	for collection, docs := range events {
+		for _, doc := range docs {
+			err := Record(r, GetIndex(memoryTestProject, collection), doc)
+			if err != nil {
+				restore()
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return r, restore
+}
+
+var memoryTestEvents = map[string][]string{
+	"clicks": {
+		`{"timestamp":"2020-01-05T10:00:00.000Z","user_id":"a","country":"US","price":10,"browser":"Chrome"}`,
+		`{"timestamp":"2020-01-20T10:00:00.000Z","user_id":"b","country":"FR","price":20.5,"browser":"Firefox"}`,
+		`{"timestamp":"2020-02-03T10:00:00.000Z","user_id":"a","country":"US","price":5,"browser":"Chrome"}`,
+		`{"timestamp":"2020-02-15T10:00:00.000Z","user_id":"c","country":"US","price":7,"browser":"Safari Mobile"}`,
+	},
+	"signups": {
+		`{"timestamp":"2020-01-06T10:00:00.000Z","user_id":"a"}`,
+		`{"timestamp":"2020-01-19T10:00:00.000Z","user_id":"b"}`,
+		`{"timestamp":"2020-02-16T10:00:00.000Z","user_id":"c"}`,
+	},
+}
+
+// assertJSON compares the result encoded as json with the expected json
+func assertJSON(t *testing.T, got interface{}, err error, want string) {
+	t.Helper()
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestMemoryCount(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "all",
+			body: `{}`,
+			want: `4`,
+		},
+		{
+			name: "eq",
+			body: `{"filters":[{"property_name":"browser","operator":"eq","property_value":"Chrome"}]}`,
+			want: `2`,
+		},
+		{
+			name: "ne",
+			body: `{"filters":[{"property_name":"price","operator":"ne","property_value":5}]}`,
+			want: `3`,
+		},
+		{
+			name: "contains",
+			body: `{"filters":[{"property_name":"browser","operator":"contains","property_value":"obi"}]}`,
+			want: `1`,
+		},
+		{
+			name: "contains a wildcard character",
+			body: `{"filters":[{"property_name":"browser","operator":"contains","property_value":"*"}]}`,
+			want: `0`,
+		},
+		{
+			name: "range",
+			body: `{"filters":[{"property_name":"price","operator":"gte","property_value":7}]}`,
+			want: `3`,
+		},
+		{
+			name: "in",
+			body: `{"filters":[{"property_name":"user_id","operator":"in","property_value":["a","c"]}]}`,
+			want: `3`,
+		},
+		{
+			name: "or group",
+			body: `{"filters":[{"operator":"or","operands":[{"property_name":"country","operator":"eq","property_value":"FR"},{"property_name":"price","operator":"lt","property_value":6}]}]}`,
+			want: `2`,
+		},
+		{
+			name: "timeframe",
+			body: `{"timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-01-31T00:00:00.000Z"}}`,
+			want: `2`,
+		},
+		{
+			name: "grouped",
+			body: `{"group_by":"browser"}`,
+			want: `[{"browser":"Chrome","count":2},{"browser":"Firefox","count":1},{"browser":"Safari Mobile","count":1}]`,
+		},
+		{
+			name: "grouped by two properties",
+			body: `{"group_by":["country","browser"]}`,
+			want: `[{"browser":"Chrome","count":2,"country":"US"},{"browser":"Safari Mobile","count":1,"country":"US"},{"browser":"Firefox","count":1,"country":"FR"}]`,
+		},
+		{
+			name: "interval",
+			body: `{"timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-03-01T00:00:00.000Z"},"interval":"month"}`,
+			want: `[{"count":2,"end":"2020-02-01T00:00:00.000Z","start":"2020-01-01T00:00:00.000Z"},{"count":2,"end":"2020-03-01T00:00:00.000Z","start":"2020-02-01T00:00:00.000Z"},{"count":0,"end":"2020-04-01T00:00:00.000Z","start":"2020-03-01T00:00:00.000Z"}]`,
+		},
+		{
+			name: "grouped interval",
+			body: `{"timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-02-29T00:00:00.000Z"},"interval":"month","group_by":"country"}`,
+			want: `[{"count":2,"end":"2020-02-01T00:00:00.000Z","start":"2020-01-01T00:00:00.000Z","value":[{"count":1,"country":"FR"},{"count":1,"country":"US"}]},{"count":2,"end":"2020-03-01T00:00:00.000Z","start":"2020-02-01T00:00:00.000Z","value":[{"count":2,"country":"US"}]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Count(r, idx, tt.body)
+			assertJSON(t, got, err, tt.want)
+		})
+	}
+}
+
+func TestMemoryAggregate(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	tests := []struct {
+		name string
+		fn   func(r *http.Request, idx, body string) (interface{}, error)
+		body string
+		want string
+	}{
+		// price is mapped as long by the first event, like elasticsearch the 20.5 is aggregated as 20
+		{"sum", Sum, `{"target_property":"price"}`, `42`},
+		{"avg", Avg, `{"target_property":"price"}`, `10.5`},
+		{"min", Min, `{"target_property":"price"}`, `5`},
+		{"max", Max, `{"target_property":"price"}`, `20`},
+		{"count unique", CountUnique, `{"target_property":"user_id"}`, `3`},
+		{"median", Median, `{"target_property":"price"}`, `2.5`},
+		{"standard deviation", StandardDeviation, `{"target_property":"price"}`, `5.766281297335398`},
+		{
+			name: "filtered",
+			fn:   Sum,
+			body: `{"target_property":"price","filters":[{"property_name":"country","operator":"eq","property_value":"US"}]}`,
+			want: `22`,
+		},
+		{
+			name: "grouped",
+			fn:   Min,
+			body: `{"target_property":"price","group_by":["browser"],"order":{"by":"key","direction":"desc"}}`,
+			want: `[{"browser":"Safari Mobile","count":1,"min":7},{"browser":"Firefox","count":1,"min":20},{"browser":"Chrome","count":2,"min":5}]`,
+		},
+		{
+			name: "interval",
+			fn:   Sum,
+			body: `{"target_property":"price","timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-02-29T00:00:00.000Z"},"interval":"month"}`,
+			want: `[{"count":2,"end":"2020-02-01T00:00:00.000Z","start":"2020-01-01T00:00:00.000Z","sum":30},{"count":2,"end":"2020-03-01T00:00:00.000Z","start":"2020-02-01T00:00:00.000Z","sum":12}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fn(r, idx, tt.body)
+			assertJSON(t, got, err, tt.want)
+		})
+	}
+}
+
+func TestMemoryPercentiles(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	got, err := Percentiles(r, GetIndex(memoryTestProject, "clicks"), `{"target_property":"price"}`)
+	assertJSON(t, got, err, `{"1.0":5.06,"25.0":6.5,"5.0":5.3,"50.0":8.5,"75.0":12.5,"95.0":18.499999999999996,"99.0":19.699999999999996}`)
+}
+
+func TestMemorySelectUnique(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	got, err := SelectUnique(r, idx, `{"target_property":"browser"}`)
+	assertJSON(t, got, err, `["Chrome","Firefox","Safari Mobile"]`)
+
+	got, err = SelectUnique(r, idx, `{"target_property":"price","filters":[{"property_name":"country","operator":"eq","property_value":"US"}]}`)
+	// in the order of the events
+	assertJSON(t, got, err, `[10,5,7]`)
+}
+
+func TestMemoryFunnel(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "steps in order",
+			body: `{"steps":[{"collection":"clicks","actor_property":"user_id"},{"collection":"signups","actor_property":"user_id"}]}`,
+			want: `[{"collection":"clicks","conversion_rate":1,"count":3,"drop_off":0,"overall_conversion_rate":1},{"collection":"signups","conversion_rate":0.6666666666666666,"count":2,"drop_off":1,"overall_conversion_rate":0.6666666666666666}]`,
+		},
+		{
+			name: "conversion window",
+			body: `{"steps":[{"collection":"clicks","actor_property":"user_id"},{"collection":"signups","actor_property":"user_id"}],"conversion_window":"12h"}`,
+			want: `[{"collection":"clicks","conversion_rate":1,"count":3,"drop_off":0,"overall_conversion_rate":1},{"collection":"signups","conversion_rate":0,"count":0,"drop_off":3,"overall_conversion_rate":0}]`,
+		},
+		{
+			name: "repeated collection needs another event",
+			body: `{"steps":[{"collection":"clicks","actor_property":"user_id"},{"collection":"clicks","actor_property":"user_id"}]}`,
+			want: `[{"collection":"clicks","conversion_rate":1,"count":3,"drop_off":0,"overall_conversion_rate":1},{"collection":"clicks","conversion_rate":0.3333333333333333,"count":1,"drop_off":2,"overall_conversion_rate":0.3333333333333333}]`,
+		},
+		{
+			name: "filtered step",
+			body: `{"steps":[{"collection":"clicks","actor_property":"user_id","filters":[{"property_name":"country","operator":"eq","property_value":"US"}]},{"collection":"signups","actor_property":"user_id"}]}`,
+			want: `[{"collection":"clicks","conversion_rate":1,"count":2,"drop_off":0,"overall_conversion_rate":1},{"collection":"signups","conversion_rate":1,"count":2,"drop_off":0,"overall_conversion_rate":1}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Funnel(r, memoryTestProject, tt.body)
+			assertJSON(t, got, err, tt.want)
+		})
+	}
+}
+
+func TestMemoryFunnelConversionWindow(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"visits": {
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-05T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"b"}`,
+		},
+		"carts": {
+			`{"timestamp":"2020-01-05T11:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-01T11:00:00.000Z","user_id":"b"}`,
+		},
+		"purchases": {
+			`{"timestamp":"2020-01-05T12:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-02T10:00:00.000Z","user_id":"b"}`,
+		},
+	})
+	defer restore()
+
+	// a's first visit is too early, the second one converts in the window,
+	// b's purchase is too late for its only visit
+	got, err := Funnel(r, memoryTestProject, `{"steps":[{"collection":"visits","actor_property":"user_id"},{"collection":"carts","actor_property":"user_id"},{"collection":"purchases","actor_property":"user_id"}],"conversion_window":"12h"}`)
+	assertJSON(t, got, err, `[{"collection":"visits","conversion_rate":1,"count":2,"drop_off":0,"overall_conversion_rate":1},{"collection":"carts","conversion_rate":1,"count":2,"drop_off":0,"overall_conversion_rate":1},{"collection":"purchases","conversion_rate":0.5,"count":1,"drop_off":1,"overall_conversion_rate":0.5}]`)
+}
+
+func TestMemoryRetention(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"signups": {
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-01T11:00:00.000Z","user_id":"b"}`,
+			`{"timestamp":"2020-01-02T10:00:00.000Z","user_id":"c"}`,
+		},
+		"logins": {
+			`{"timestamp":"2020-01-02T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-03T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-03T12:00:00.000Z","user_id":"c"}`,
+		},
+	})
+	defer restore()
+
+	got, err := Retention(r, memoryTestProject, `{"first_event":{"collection":"signups"},"return_event":{"collection":"logins"},"actor_property":"user_id","interval":"day","timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-01-03T00:00:00.000Z"},"periods":2}`)
+	assertJSON(t, got, err, `[{"size":2,"start":"2020-01-01T00:00:00.000Z","values":[{"count":0,"period":0,"rate":0},{"count":1,"period":1,"rate":0.5},{"count":1,"period":2,"rate":0.5}]},{"size":1,"start":"2020-01-02T00:00:00.000Z","values":[{"count":0,"period":0,"rate":0},{"count":1,"period":1,"rate":1},{"count":0,"period":2,"rate":0}]}]`)
+}
+
+func TestMemoryRetentionReturnsAfterFirstEvent(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"signups": {
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"b"}`,
+		},
+		"logins": {
+			// before the signup, the same day
+			`{"timestamp":"2020-01-01T08:00:00.000Z","user_id":"a"}`,
+			`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"b"}`,
+		},
+	})
+	defer restore()
+
+	got, err := Retention(r, memoryTestProject, `{"first_event":{"collection":"signups"},"return_event":{"collection":"logins"},"actor_property":"user_id","interval":"day","timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-01-02T00:00:00.000Z"},"periods":1}`)
+	assertJSON(t, got, err, `[{"size":2,"start":"2020-01-01T00:00:00.000Z","values":[{"count":1,"period":0,"rate":0.5},{"count":0,"period":1,"rate":0}]}]`)
+}
+
+func TestMemoryRetentionPeriods(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"signups": {`{"timestamp":"2020-01-01T10:00:00.000Z","user_id":"a"}`},
+		"logins":  {`{"timestamp":"2020-02-01T10:00:00.000Z","user_id":"a"}`},
+	})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		periods int
+		want    int
+	}{
+		{"one period", 1, 2},
+		// every month from the cohort's until the current one
+		{"until now", 0, (time.Now().UTC().Year()-2020)*12 + int(time.Now().UTC().Month())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Retention(r, memoryTestProject, `{"first_event":{"collection":"signups"},"return_event":{"collection":"logins"},"actor_property":"user_id","interval":"month","timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-01-31T00:00:00.000Z"},"periods":`+strconv.Itoa(tt.periods)+`}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("got %d cohorts, want 1", len(results))
+			}
+
+			values := results[0]["values"].([]map[string]interface{})
+			if len(values) != tt.want {
+				t.Errorf("got %d periods, want %d", len(values), tt.want)
+			}
+			if values[1]["count"] != 1 {
+				t.Errorf("got %v returns in period 1, want 1", values[1]["count"])
+			}
+		})
+	}
+}
+
+func TestMemoryMissingCollection(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	_, err := Count(r, GetIndex(memoryTestProject, "missing"), `{}`)
+	if err == nil {
+		t.Error("expected an error counting a collection without events")
+	}
+}
+
+func TestMemoryCompare(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	// the event of b is right at the start of the timeframe, it is only in the current period
+	got, err := Count(r, idx, `{"timeframe":{"from":"2020-01-20T10:00:00.000Z","to":"2020-02-19T10:00:00.000Z"},"compare":{"type":"previous_period"}}`)
+	assertJSON(t, got, err, `{"change":2,"change_percent":200,"current":3,"previous":1}`)
+
+	// grouped rows have the value and the previous one under the name of the analysis
+	got, err = Median(r, idx, `{"target_property":"price","group_by":"country","timeframe":{"from":"2020-01-20T10:00:00.000Z","to":"2020-02-19T10:00:00.000Z"},"compare":{"type":"previous_period"}}`)
+	assertJSON(t, got, err, `[{"change":1,"change_percent":null,"count":2,"country":"US","median":1,"previous":0},{"change":null,"change_percent":null,"count":1,"country":"FR","median":0,"previous":null}]`)
+}
+
+func TestMemoryMultiAnalysis(t *testing.T) {
+	r, restore := useMemoryBackend(t, memoryTestEvents)
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	got, err := MultiAnalysis(r, idx, `{"analyses":{"clicks":{"analysis_type":"count"},"revenue":{"analysis_type":"sum","target_property":"price"}},"group_by":"country"}`)
+	assertJSON(t, got, err, `[{"clicks":3,"count":3,"country":"US","revenue":22},{"clicks":1,"count":1,"country":"FR","revenue":20}]`)
+
+	for _, name := range []string{"start", "end", "value", "count", "country"} {
+		_, err := MultiAnalysis(r, idx, `{"analyses":{"`+name+`":{"analysis_type":"sum","target_property":"price"}},"group_by":"country","interval":"month"}`)
+		if err == nil {
+			t.Errorf("expected an error for the analysis named %s", name)
+		}
+	}
+}
+
+func TestMemoryRecordTimestamp(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"pings": {
+			`{"timestamp":1580378400}`,
+			`{"timestamp":1580378400000}`,
+		},
+	})
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "pings")
+
+	// the timestamps are kept as sent, the events are analysed on the normalized ones
+	mapping, err := GetMapping(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping["timestamp"] != "long" {
+		t.Errorf("timestamp is mapped as %s, want long", mapping["timestamp"])
+	}
+
+	got, err := Count(r, idx, `{"timeframe":{"from":"2020-01-30T10:00:00.000Z","to":"2020-01-30T10:00:00.000Z"}}`)
+	assertJSON(t, got, err, `2`)
+}
+
+// bulkStatuses returns the status of every item of the bulk, with its result when it succeeded
+func bulkStatuses(result *BulkResult) []string {
+	statuses := []string{}
+	for _, item := range result.Items {
+		status := strconv.Itoa(item.Status)
+		if item.Result != "" {
+			status += " " + item.Result
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func TestMemoryRecordBulk(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"clicks": {`{"timestamp":"2020-01-05T10:00:00.000Z","price":10}`},
+	})
+	defer restore()
+
+	result, err := RecordBulk(r, memoryTestProject, `{
+		"clicks": [
+			{"timestamp":"2020-01-06T10:00:00.000Z","price":20},
+			{"timestamp":"2020-01-07T10:00:00.000Z","price":"free"},
+			{"timestamp":"2020-01-08T10:00:00.000Z","datawaves":{"id":12}}
+		],
+		"signups": [{"timestamp":"2020-01-06T10:00:00.000Z"}, "signup"]
+	}`, BulkBestEffort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the events that fail don't stop the others
+	want := []string{"201 created", "400", "400", "201 created", "400"}
+	if got := bulkStatuses(result); !reflect.DeepEqual(got, want) || !result.Errors {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if result.Items[2].Error != "Invalid idempotency key, datawaves.id should be a string!" {
+		t.Errorf("got the error %s", result.Items[2].Error)
+	}
+
+	assertCount(t, r, GetIndex(memoryTestProject, "clicks"), 2)
+	assertCount(t, r, GetIndex(memoryTestProject, "signups"), 1)
+}
+
+func TestMemoryRecordBulkAllOrNothing(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"clicks": {`{"timestamp":"2020-01-05T10:00:00.000Z","price":10,"datawaves":{"id":"first"}}`},
+	})
+	defer restore()
+
+	idx := GetIndex(memoryTestProject, "clicks")
+
+	// invalid events fail the bulk before it is sent
+	result, err := RecordBulk(r, memoryTestProject, `{"clicks": [
+		{"timestamp":"2020-01-06T10:00:00.000Z","price":20},
+		{"timestamp":"2020-01-07T10:00:00.000Z","datawaves":{"id":""}}
+	]}`, BulkAllOrNothing)
+	if err == nil {
+		t.Fatal("expected an error for an invalid event")
+	}
+	if got, want := bulkStatuses(result), []string{"424", "400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertCount(t, r, idx, 1)
+
+	// the events created before one fails are deleted, the duplicates of older events are kept
+	result, err = RecordBulk(r, memoryTestProject, `{"clicks": [
+		{"timestamp":"2020-01-06T10:00:00.000Z","price":20},
+		{"timestamp":"2020-01-05T10:00:00.000Z","price":10,"datawaves":{"id":"first"}},
+		{"timestamp":"2020-01-07T10:00:00.000Z","price":"free"}
+	]}`, BulkAllOrNothing)
+	if err == nil {
+		t.Fatal("expected an error for a failed event")
+	}
+	if got, want := bulkStatuses(result), []string{"424", "200 " + BulkDuplicate, "400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertCount(t, r, idx, 1)
+}
+
+func TestMemoryRecordBulkDuplicates(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"clicks": {`{"timestamp":"2020-01-05T10:00:00.000Z","datawaves":{"id":"first"}}`},
+	})
+	defer restore()
+
+	result, err := RecordBulk(r, memoryTestProject, `{"clicks": [
+		{"timestamp":"2020-01-05T10:00:00.000Z","datawaves":{"id":"first"}},
+		{"timestamp":"2020-01-06T10:00:00.000Z","datawaves":{"id":"second"}},
+		{"timestamp":"2020-01-06T10:00:00.000Z","datawaves":{"id":"second"}}
+	]}`, BulkAllOrNothing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the duplicates succeed, within the bulk too
+	want := []string{"200 " + BulkDuplicate, "201 created", "200 " + BulkDuplicate}
+	if got := bulkStatuses(result); !reflect.DeepEqual(got, want) || result.Errors {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if result.Items[0].ID != "first" || result.Items[2].ID != "second" {
+		t.Errorf("got %+v", result.Items)
+	}
+
+	assertCount(t, r, GetIndex(memoryTestProject, "clicks"), 2)
+}
@@ -0,0 +1,262 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// analysis types that can be part of a multi analysis and their aggregations
+var multiAnalysisOps = map[string]string{
+	"count":              "count",
+	"count_unique":       "cardinality",
+	"sum":                "sum",
+	"min":                "min",
+	"max":                "max",
+	"avg":                "avg",
+	"median":             "median_absolute_deviation",
+	"standard_deviation": "extended_stats",
+}
+
+var analysisNameRe = regexp.MustCompile(`^[\w-]+$`)
+
+// columns of the grouped and interval rows that analyses can't be named after, nor after the group_by properties
+var reservedAnalysisNames = map[string]bool{
+	"start": true,
+	"end":   true,
+	"value": true,
+	"count": true,
+}
+
+type Analysis struct {
+	AnalysisType   string `json:"analysis_type"`
+	TargetProperty string `json:"target_property"`
+}
+
+type MultiAnalysisSearch struct {
+	Search
+	Analyses map[string]Analysis `json:"analyses"`
+}
+
+// MultiAnalysis runs every analysis over the same search in a single request.
+// The result is keyed by analysis name, grouped and interval results have
+// the analyses' values in every row and time bucket.
+func MultiAnalysis(r *http.Request, idx, body string) (interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var multi MultiAnalysisSearch
+	err := json.NewDecoder(strings.NewReader(body)).Decode(&multi)
+	if err != nil {
+		errors.Log(err)
+		return nil, errors.New("Error decoding request body!")
+	}
+	search := &multi.Search
+	search.Index = idx
+
+	if len(multi.Analyses) == 0 {
+		return nil, errors.New("Missing analyses!")
+	}
+
+	for name, analysis := range multi.Analyses {
+		if !analysisNameRe.MatchString(name) {
+			return nil, errors.New(fmt.Sprintf("Invalid analysis name \"%s\", it should only have letters, digits, _ and -!", name))
+		}
+
+		if reservedAnalysisNames[name] {
+			return nil, errors.New(fmt.Sprintf("Invalid analysis name \"%s\", start, end, value and count are reserved!", name))
+		}
+
+		for _, group := range search.GroupBy {
+			if name == group {
+				return nil, errors.New(fmt.Sprintf("Invalid analysis name \"%s\", it is a group_by property!", name))
+			}
+		}
+
+		op, ok := multiAnalysisOps[analysis.AnalysisType]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown analysis_type \"%s\" in %s!", analysis.AnalysisType, name))
+		}
+
+		if op != "count" && analysis.TargetProperty == "" {
+			return nil, errors.New(fmt.Sprintf("Missing target_property in %s!", name))
+		}
+	}
+
+	return backend.MultiAnalysis(r.Context(), search, multi.Analyses)
+}
+
+func (es *Elasticsearch) MultiAnalysis(ctx context.Context, search *Search, analyses map[string]Analysis) (interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var err error
+
+	idx := search.Index
+	needsMapping := len(search.GroupBy) > 0
+	for _, analysis := range analyses {
+		if multiAnalysisOps[analysis.AnalysisType] == "cardinality" {
+			needsMapping = true
+		}
+	}
+
+	// one mapping for all the analyses
+	if needsMapping {
+		search.Mapping, err = es.GetMapping(ctx, idx)
+		if err != nil {
+			search.Mapping = map[string]string{}
+		}
+	}
+
+	q, err := search.Body("multi_analysis")
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]interface{})
+	for name, analysis := range analyses {
+		op := multiAnalysisOps[analysis.AnalysisType]
+		if op != "count" {
+			metrics[name+"_value"] = search.metricAgg(op, analysis.TargetProperty)
+		}
+	}
+
+	aggs, err := search.bucketAggs(metrics)
+	if err != nil {
+		return nil, err
+	}
+	if aggs != nil {
+		q["aggs"] = aggs
+	}
+	// counts come from the total hits
+	q["track_total_hits"] = true
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return nil, errors.New("Error encoding query!")
+	}
+	query := string(b)
+
+	size := 0
+	// Set up the request object.
+	req := esapi.SearchRequest{
+		Index: []string{idx},
+		Body:  strings.NewReader(query),
+		Size:  &size,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+		return nil, errors.New("Error processing documents!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+		return nil, errors.New("Failed to process documents!")
+	}
+
+	var rr map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	// values sets the result of every analysis in the bucket on row
+	values := func(bucket, row map[string]interface{}) {
+		for name, analysis := range analyses {
+			op := multiAnalysisOps[analysis.AnalysisType]
+			if op == "count" {
+				row[name] = bucket["doc_count"]
+				continue
+			}
+
+			L := "value"
+			if op == "extended_stats" {
+				L = "std_deviation"
+			}
+
+			z, ok := bucket[name+"_value"].(map[string]interface{})
+			if ok {
+				row[name] = z[L]
+			}
+		}
+	}
+
+	_aggs, _ := rr["aggregations"].(map[string]interface{})
+
+	if search.Interval != "" {
+		rslt, ok := _aggs["result"].(map[string]interface{})
+		if !ok {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		rs, ok := rslt["buckets"].([]interface{})
+		if !ok {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		y := []map[string]interface{}{}
+		for i := range rs {
+			yy, ok := rs[i].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			x := map[string]interface{}{
+				"start": yy["key_as_string"],
+				"end":   search.BucketEnd(yy["key"]),
+			}
+
+			if len(search.GroupBy) > 0 {
+				x["value"] = search.groupRows(yy, values)
+			} else {
+				values(yy, x)
+			}
+
+			y = append(y, x)
+		}
+
+		return y, nil
+	}
+
+	if len(search.GroupBy) > 0 {
+		if _aggs == nil {
+			errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+			return nil, errors.New("Assertion error!")
+		}
+
+		return search.groupRows(_aggs, values), nil
+	}
+
+	hits, ok := rr["hits"].(map[string]interface{})
+	if !ok {
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+		return nil, errors.New("Assertion error!")
+	}
+
+	total, ok := hits["total"].(map[string]interface{})
+	if !ok {
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
+		return nil, errors.New("Assertion error!")
+	}
+
+	bucket := map[string]interface{}{"doc_count": total["value"]}
+	for k, v := range _aggs {
+		bucket[k] = v
+	}
+
+	result := make(map[string]interface{})
+	values(bucket, result)
+
+	return result, nil
+}
@@ -1,6 +1,7 @@
 package elastic
 
 import (
+	"context"
 	"datawaves/errors"
 	"fmt"
 	"net/http"
@@ -14,7 +15,6 @@ func Percentiles(r *http.Request, idx, body string) (map[string]interface{}, err
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 	var search Search
-	op := "percentiles"
 	err := json.NewDecoder(strings.NewReader(body)).Decode(&search)
 	if err != nil {
 		errors.Log(err)
@@ -26,7 +26,20 @@ func Percentiles(r *http.Request, idx, body string) (map[string]interface{}, err
 		return nil, errors.New("Missing target_property!")
 	}
 
-	query := search.GetQuery(op)
+	return backend.Percentiles(r.Context(), &search)
+}
+
+func (es *Elasticsearch) Percentiles(ctx context.Context, search *Search) (map[string]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	op := "percentiles"
+	idx := search.Index
+	es.loadMapping(ctx, search, op)
+
+	query, err := search.GetQuery(op)
+	if err != nil {
+		return nil, err
+	}
 
 	size := 0
 	// Set up the request object.
@@ -37,40 +50,40 @@ func Percentiles(r *http.Request, idx, body string) (map[string]interface{}, err
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error processing documents!")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Failed to process documents!")
 	}
 
 	var rr map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&rr)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return nil, errors.New("Error decoding response!")
 	}
 
 	__aggs, ok := rr["aggregations"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
 	_aggs, ok := __aggs[op+"_value"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
 	aggs, ok := _aggs["values"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return nil, errors.New("Assertion error!")
 	}
 
@@ -0,0 +1,161 @@
+package elastic
+
+import (
+	jsoniter "github.com/json-iterator/go"
+)
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl.html
+
+// Query is a node of the query DSL tree.
+// Source returns the value the node is marshalled to, so field names and
+// values always go through the json encoder and are escaped properly.
+type Query interface {
+	Source() interface{}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-bool-query.html
+type BoolQuery struct {
+	Must               []Query
+	MustNot            []Query
+	Should             []Query
+	MinimumShouldMatch int
+}
+
+func (q BoolQuery) Source() interface{} {
+	b := make(map[string]interface{})
+
+	if len(q.Must) > 0 {
+		b["must"] = clauses(q.Must)
+	}
+
+	if len(q.MustNot) > 0 {
+		b["must_not"] = clauses(q.MustNot)
+	}
+
+	if len(q.Should) > 0 {
+		b["should"] = clauses(q.Should)
+	}
+
+	if q.MinimumShouldMatch > 0 {
+		b["minimum_should_match"] = q.MinimumShouldMatch
+	}
+
+	return map[string]interface{}{"bool": b}
+}
+
+// IsEmpty reports whether the bool query has no clauses at all
+func (q BoolQuery) IsEmpty() bool {
+	return len(q.Must) == 0 && len(q.MustNot) == 0 && len(q.Should) == 0
+}
+
+// clauses returns a single clause as an object and many as an array,
+// duplicated clauses are dropped.
+func clauses(queries []Query) interface{} {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	src := []interface{}{}
+	happened := make(map[string]bool)
+	for _, q := range queries {
+		s := q.Source()
+		b, err := json.Marshal(s)
+		if err == nil {
+			if happened[string(b)] {
+				continue
+			}
+			happened[string(b)] = true
+		}
+		src = append(src, s)
+	}
+
+	if len(src) == 1 {
+		return src[0]
+	}
+
+	return src
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-term-query.html
+type TermQuery struct {
+	Field string
+	Value interface{}
+}
+
+func (q TermQuery) Source() interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{q.Field: q.Value}}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-terms-query.html
+type TermsQuery struct {
+	Field  string
+	Values []interface{}
+}
+
+func (q TermsQuery) Source() interface{} {
+	return map[string]interface{}{"terms": map[string]interface{}{q.Field: q.Values}}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
+// Bounds that are nil are left out.
+type RangeQuery struct {
+	Field    string
+	Gt       interface{}
+	Gte      interface{}
+	Lt       interface{}
+	Lte      interface{}
+	TimeZone string
+}
+
+func (q RangeQuery) Source() interface{} {
+	r := make(map[string]interface{})
+
+	if q.Gt != nil {
+		r["gt"] = q.Gt
+	}
+
+	if q.Gte != nil {
+		r["gte"] = q.Gte
+	}
+
+	if q.Lt != nil {
+		r["lt"] = q.Lt
+	}
+
+	if q.Lte != nil {
+		r["lte"] = q.Lte
+	}
+
+	if q.TimeZone != "" {
+		r["time_zone"] = q.TimeZone
+	}
+
+	return map[string]interface{}{"range": map[string]interface{}{q.Field: r}}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-wildcard-query.html
+type WildcardQuery struct {
+	Field string
+	Value string
+}
+
+func (q WildcardQuery) Source() interface{} {
+	return map[string]interface{}{"wildcard": map[string]interface{}{q.Field: map[string]interface{}{"value": q.Value}}}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-regexp-query.html
+type RegexpQuery struct {
+	Field string
+	Value string
+}
+
+func (q RegexpQuery) Source() interface{} {
+	return map[string]interface{}{"regexp": map[string]interface{}{q.Field: map[string]interface{}{"value": q.Value}}}
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-exists-query.html
+type ExistsQuery struct {
+	Field string
+}
+
+func (q ExistsQuery) Source() interface{} {
+	return map[string]interface{}{"exists": map[string]interface{}{"field": q.Field}}
+}
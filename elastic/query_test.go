@@ -0,0 +1,370 @@
+package elastic
+
+import (
+	"regexp"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestCompileFilter(t *testing.T) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	mapping := map[string]string{
+		"browser":         "text",
+		"browser.keyword": "keyword",
+		"country":         "keyword",
+		"price":           "float",
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   string
+	}{
+		{
+			name:   "eq string on text",
+			filter: `{"property_name":"browser","operator":"eq","property_value":"Chrome"}`,
+			want:   `{"term":{"browser.keyword":"Chrome"}}`,
+		},
+		{
+			name:   "eq string on keyword",
+			filter: `{"property_name":"country","operator":"eq","property_value":"US"}`,
+			want:   `{"term":{"country":"US"}}`,
+		},
+		{
+			name:   "eq string not in the mapping",
+			filter: `{"property_name":"city","operator":"eq","property_value":"Paris"}`,
+			want:   `{"term":{"city.keyword":"Paris"}}`,
+		},
+		{
+			name:   "eq number",
+			filter: `{"property_name":"price","operator":"eq","property_value":10}`,
+			want:   `{"term":{"price":10}}`,
+		},
+		{
+			name:   "eq boolean",
+			filter: `{"property_name":"paid","operator":"eq","property_value":true}`,
+			want:   `{"term":{"paid":true}}`,
+		},
+		{
+			name:   "ne",
+			filter: `{"property_name":"country","operator":"ne","property_value":"US"}`,
+			want:   `{"bool":{"must_not":{"term":{"country":"US"}}}}`,
+		},
+		{
+			name:   "lt",
+			filter: `{"property_name":"price","operator":"lt","property_value":10}`,
+			want:   `{"range":{"price":{"lt":10}}}`,
+		},
+		{
+			name:   "lte",
+			filter: `{"property_name":"price","operator":"lte","property_value":10}`,
+			want:   `{"range":{"price":{"lte":10}}}`,
+		},
+		{
+			name:   "gt",
+			filter: `{"property_name":"price","operator":"gt","property_value":10}`,
+			want:   `{"range":{"price":{"gt":10}}}`,
+		},
+		{
+			name:   "gte on a date",
+			filter: `{"property_name":"signed_up","operator":"gte","property_value":"2020-01-30T00:00:00.000Z"}`,
+			want:   `{"range":{"signed_up":{"gte":"2020-01-30T00:00:00.000Z"}}}`,
+		},
+		{
+			name:   "exists true",
+			filter: `{"property_name":"price","operator":"exists","property_value":true}`,
+			want:   `{"exists":{"field":"price"}}`,
+		},
+		{
+			name:   "exists false as a string",
+			filter: `{"property_name":"price","operator":"exists","property_value":"false"}`,
+			want:   `{"bool":{"must_not":{"exists":{"field":"price"}}}}`,
+		},
+		{
+			name:   "contains",
+			filter: `{"property_name":"browser","operator":"contains","property_value":"obi"}`,
+			want:   `{"wildcard":{"browser":{"value":"*obi*"}}}`,
+		},
+		{
+			name:   "not_contains",
+			filter: `{"property_name":"browser","operator":"not_contains","property_value":"obi"}`,
+			want:   `{"bool":{"must_not":{"wildcard":{"browser":{"value":"*obi*"}}}}}`,
+		},
+		{
+			name:   "regexp",
+			filter: `{"property_name":"browser","operator":"regexp","property_value":"Chrom.*"}`,
+			want:   `{"regexp":{"browser":{"value":"Chrom.*"}}}`,
+		},
+		{
+			name:   "regex",
+			filter: `{"property_name":"browser","operator":"regex","property_value":"Chrom.*"}`,
+			want:   `{"regexp":{"browser":{"value":"Chrom.*"}}}`,
+		},
+		{
+			name:   "in keeps every type",
+			filter: `{"property_name":"tag","operator":"in","property_value":["a",1,true,false,{"b":1}]}`,
+			want:   `{"terms":{"tag":["a",1,true,false,{"b":1}]}}`,
+		},
+		{
+			name:   "and",
+			filter: `{"operator":"and","operands":[{"property_name":"country","operator":"eq","property_value":"US"},{"property_name":"price","operator":"gt","property_value":5}]}`,
+			want:   `{"bool":{"must":[{"term":{"country":"US"}},{"range":{"price":{"gt":5}}}]}}`,
+		},
+		{
+			name:   "or",
+			filter: `{"operator":"or","operands":[{"property_name":"country","operator":"eq","property_value":"US"},{"property_name":"country","operator":"eq","property_value":"FR"}]}`,
+			want:   `{"bool":{"minimum_should_match":1,"should":[{"term":{"country":"US"}},{"term":{"country":"FR"}}]}}`,
+		},
+		{
+			name:   "not",
+			filter: `{"operator":"not","operands":[{"property_name":"country","operator":"eq","property_value":"US"}]}`,
+			want:   `{"bool":{"must_not":{"term":{"country":"US"}}}}`,
+		},
+		{
+			name:   "nested groups with a negative operand",
+			filter: `{"operator":"or","operands":[{"operator":"and","operands":[{"property_name":"country","operator":"ne","property_value":"US"},{"property_name":"price","operator":"exists","property_value":true}]},{"property_name":"price","operator":"lte","property_value":1}]}`,
+			want:   `{"bool":{"minimum_should_match":1,"should":[{"bool":{"must":[{"bool":{"must_not":{"term":{"country":"US"}}}},{"exists":{"field":"price"}}]}},{"range":{"price":{"lte":1}}}]}}`,
+		},
+		{
+			name:   "hostile value breaking out of the term",
+			filter: `{"property_name":"country","operator":"eq","property_value":"US\"}},{\"match_all\":{}}]}}"}`,
+			want:   `{"term":{"country":"US\"}},{\"match_all\":{}}]}}"}}`,
+		},
+		{
+			name:   "hostile property name",
+			filter: `{"property_name":"a\":1},\"b","operator":"gt","property_value":1}`,
+			want:   `{"range":{"a\":1},\"b":{"gt":1}}}`,
+		},
+		{
+			name:   "hostile range value",
+			filter: `{"property_name":"price","operator":"lt","property_value":"1}},\"lte\":{\"x"}`,
+			want:   `{"range":{"price":{"lt":"1}},\"lte\":{\"x"}}}`,
+		},
+		{
+			name:   "contains escapes the wildcards",
+			filter: `{"property_name":"browser","operator":"contains","property_value":"a*b?c\\d"}`,
+			want:   `{"wildcard":{"browser":{"value":"*a\\*b\\?c\\\\d*"}}}`,
+		},
+		{
+			name:   "not_contains escapes the wildcards",
+			filter: `{"property_name":"browser","operator":"not_contains","property_value":"*"}`,
+			want:   `{"bool":{"must_not":{"wildcard":{"browser":{"value":"*\\**"}}}}}`,
+		},
+		{
+			name:   "contains a number",
+			filter: `{"property_name":"code","operator":"contains","property_value":42}`,
+			want:   `{"wildcard":{"code":{"value":"*42*"}}}`,
+		},
+		{
+			name:   "hostile regexp stays a value",
+			filter: `{"property_name":"browser","operator":"regexp","property_value":"\"}},{\"match_all\":{}}"}`,
+			want:   `{"regexp":{"browser":{"value":"\"}},{\"match_all\":{}}"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filter Filter
+			err := json.Unmarshal([]byte(tt.filter), &filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := compileFilter(filter, mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.Marshal(q.Source())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"unknown operator", `{"property_name":"a","operator":"like","property_value":"b"}`},
+		{"missing property name", `{"operator":"eq","property_value":"b"}`},
+		{"missing property value", `{"property_name":"a","operator":"eq"}`},
+		{"exists not a boolean", `{"property_name":"a","operator":"exists","property_value":"yes"}`},
+		{"in not an array", `{"property_name":"a","operator":"in","property_value":"b"}`},
+		{"in empty", `{"property_name":"a","operator":"in","property_value":[]}`},
+		{"group without operands", `{"operator":"and"}`},
+		{"operands outside a group", `{"property_name":"a","operator":"eq","property_value":"b","operands":[{"property_name":"a","operator":"eq","property_value":"b"}]}`},
+		{"invalid nested operand", `{"operator":"or","operands":[{"property_name":"a","operator":"eq","property_value":"b"},{"operator":"not","operands":[{"property_name":"a","operator":"nope","property_value":1}]}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filter Filter
+			err := json.Unmarshal([]byte(tt.filter), &filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = compileFilter(filter, nil)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGetQuery(t *testing.T) {
+	mapping := map[string]string{"country": "keyword", "price": "float"}
+
+	tests := []struct {
+		name   string
+		search string
+		op     string
+		want   string
+	}{
+		{
+			name:   "no filter",
+			search: `{}`,
+			op:     "count",
+			want:   `{"query":{"bool":{"must":{"range":{"datawaves.timestamp":{"lte":"now"}}}}}}`,
+		},
+		{
+			name:   "top level filters are and-ed, negative ones go to must_not",
+			search: `{"filters":[{"property_name":"country","operator":"eq","property_value":"US"},{"property_name":"country","operator":"ne","property_value":"FR"}],"timeframe":{"from":"2020-01-01T00:00:00.000Z","to":"2020-02-01T00:00:00.000Z"}}`,
+			op:     "count",
+			want:   `{"query":{"bool":{"must":[{"term":{"country":"US"}},{"range":{"datawaves.timestamp":{"gte":"2020-01-01T00:00:00.000Z","lte":"2020-02-01T00:00:00.000Z"}}}],"must_not":{"term":{"country":"FR"}}}}}`,
+		},
+		{
+			name:   "timeframe without end",
+			search: `{"timeframe":{"from":"2020-01-01T00:00:00.000Z"}}`,
+			op:     "count",
+			want:   `{"query":{"bool":{"must":{"range":{"datawaves.timestamp":{"gte":"2020-01-01T00:00:00.000Z","lte":"now"}}}}}}`,
+		},
+		{
+			name:   "group filter",
+			search: `{"filters":[{"operator":"not","operands":[{"property_name":"price","operator":"lt","property_value":5}]}]}`,
+			op:     "count",
+			want:   `{"query":{"bool":{"must":[{"bool":{"must_not":{"range":{"price":{"lt":5}}}}},{"range":{"datawaves.timestamp":{"lte":"now"}}}]}}}`,
+		},
+		{
+			name:   "metric",
+			search: `{"target_property":"price","filters":[{"property_name":"country","operator":"in","property_value":["US",true]}]}`,
+			op:     "sum",
+			want:   `{"aggs":{"sum_value":{"sum":{"field":"price"}}},"query":{"bool":{"must":[{"terms":{"country":["US",true]}},{"range":{"datawaves.timestamp":{"lte":"now"}}}]}}}`,
+		},
+		{
+			name:   "hostile timezone and values",
+			search: `{"timezone":"\"}},\"x\":{\"","target_property":"price\"","filters":[{"property_name":"country","operator":"eq","property_value":"\"}]}}"}]}`,
+			op:     "max",
+			want:   `{"aggs":{"max_value":{"max":{"field":"price\""}}},"query":{"bool":{"must":[{"term":{"country":"\"}]}}"}},{"range":{"datawaves.timestamp":{"lte":"now","time_zone":"\"}},\"x\":{\""}}}]}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+			var search Search
+			err := json.Unmarshal([]byte(tt.search), &search)
+			if err != nil {
+				t.Fatal(err)
+			}
+			search.Mapping = mapping
+
+			got, err := search.GetQuery(tt.op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetQueryInvalidFilter(t *testing.T) {
+	search := Search{Filters: []Filter{{PropertyName: "country", Operator: "eq"}}}
+
+	_, err := search.GetQuery("count")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestEscapeWildcard(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`abc`, `abc`},
+		{`*`, `\*`},
+		{`?`, `\?`},
+		{`\`, `\\`},
+		{`a\*b`, `a\\\*b`},
+		{`"quoted"`, `"quoted"`},
+	}
+
+	for _, tt := range tests {
+		got := escapeWildcard(tt.value)
+		if got != tt.want {
+			t.Errorf("escapeWildcard(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+
+		// the memory cluster reads the escapes back as the value itself
+		re := regexp.MustCompile("^" + wildcardPattern(got) + "$")
+		if !re.MatchString(tt.value) {
+			t.Errorf("%q doesn't match its escaped wildcard %q", tt.value, got)
+		}
+	}
+}
+
+func TestGetQueryKeepsTheSearch(t *testing.T) {
+	search := Search{
+		Filters:     []Filter{{PropertyName: "country", Operator: "ne", PropertyValue: "US"}},
+		MustFilters: []Query{TermQuery{Field: "paid", Value: true}},
+	}
+
+	first, err := search.GetQuery("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := search.GetQuery("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Errorf("the second query %s differs from the first %s", second, first)
+	}
+	if len(search.MustFilters) != 1 || len(search.MustNotFilters) != 0 {
+		t.Errorf("the filters of the search changed: %v, %v", search.MustFilters, search.MustNotFilters)
+	}
+}
+
+func TestGetQueryWithoutMapping(t *testing.T) {
+	// the backend loads the mapping, the search never does it on its own
+	search := Search{Index: "memtest.clicks", GroupBy: Properties{"country"}}
+	if _, err := search.GetQuery("count"); err == nil {
+		t.Error("expected an error grouping without the mapping")
+	}
+
+	search = Search{Index: "memtest.clicks", TargetProperty: "country"}
+	if _, err := search.GetQuery("cardinality"); err == nil {
+		t.Error("expected an error counting the unique values without the mapping")
+	}
+
+	search.Mapping = map[string]string{}
+	if _, err := search.GetQuery("cardinality"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,9 +1,12 @@
 package elastic
 
 import (
+	"bufio"
+	"context"
 	"datawaves/errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,34 +14,111 @@ import (
 	jsoniter "github.com/json-iterator/go"
 )
 
-// Record saves a document in an index
+// IdempotencyHeader is the request header with the idempotency key of the recorded event
+const IdempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the size limit of document IDs
+const maxIdempotencyKey = 512
+
+// Record saves a document in an index, events of collections with a schema
+// are checked against it, see SetSchema.
+// The event's ID is its idempotency key, the IdempotencyHeader or else datawaves.id in the body,
+// when it has one. Recording an event with the key of one already recorded does nothing.
+// With a buffer, see SetBuffer, the event is queued and recorded with the next flush.
 // body: should be a valid json string
 func Record(r *http.Request, idx, body string) error {
-	id := GetID()
-
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 	var data map[string]interface{}
 	err := json.NewDecoder(strings.NewReader(body)).Decode(&data)
 	if err != nil {
-		errors.Log(err, "Error decoding data.\nIndex: "+idx+".\nDocument ID: "+id+"."+"\nBody: "+body+".")
+		errors.Log(err, "Error decoding data.\nIndex: "+idx+".\nBody: "+body+".")
 		return errors.New("Error decoding document.")
 	}
 
-	// year-month-day
-	now := time.Now().Format("2006-01-02T15:04:05.000Z")
-	timestamp := now
+	id, err := idempotencyKey(data, r.Header.Get(IdempotencyHeader))
+	if err != nil {
+		return err
+	}
+
+	err = conformEvent(r.Context(), idx, data)
+	if err != nil {
+		return err
+	}
+
+	problem := stampEvent(data, id)
+	if problem != "" {
+		return errors.New("Invalid event: " + problem + "!")
+	}
+
+	// the buffer registers the collection once the event is flushed
+	if ingestBuffer != nil {
+		return ingestBuffer.Add(r.Context(), idx, id, data)
+	}
 
-	stamp, ok := data["timestamp"].(string)
+	err = backend.Record(r.Context(), idx, id, data)
+	if err != nil {
+		return err
+	}
+
+	registerIndex(r.Context(), idx)
+
+	return nil
+}
+
+// idempotencyKey returns the event's ID, the header's key, else the event's datawaves.id,
+// else a new one. The datawaves metadata of the event is removed, it is set when recorded.
+func idempotencyKey(data map[string]interface{}, header string) (string, error) {
+	key := strings.TrimSpace(header)
+
+	if meta, ok := data["datawaves"].(map[string]interface{}); ok && key == "" {
+		if id, ok := meta["id"]; ok {
+			key, ok = id.(string)
+			if !ok || strings.TrimSpace(key) == "" {
+				return "", errors.New("Invalid idempotency key, datawaves.id should be a string!")
+			}
+		}
+	}
+	delete(data, "datawaves")
+
+	if key == "" {
+		return GetID(), nil
+	}
+
+	if len(key) > maxIdempotencyKey {
+		return "", errors.New(fmt.Sprintf("Invalid idempotency key, it should have at most %d bytes!", maxIdempotencyKey))
+	}
+
+	return key, nil
+}
+
+// stampEvent adds the datawaves metadata to the event: its ID, when it is recorded,
+// and its timestamp, the event's one normalized to UTC if it has one, else when it is recorded.
+// The event's timestamp is kept as sent, the index may already map it as a number or a date.
+// It returns what is wrong with the event's timestamp without stamping it.
+func stampEvent(data map[string]interface{}, id string) string {
+	now := time.Now().UTC()
+	meta := map[string]interface{}{"id": id, "created_at": now.Format(timestampFormat), "timestamp": now.Format(timestampFormat)}
+
+	t, ok, problem := eventTimestamp(data, now)
+	if problem != "" {
+		return problem
+	}
 	if ok {
-		timestamp = stamp
+		meta["timestamp"] = t.Format(timestampFormat)
 	}
 
-	data["datawaves"] = map[string]interface{}{"id": id, "created_at": now, "timestamp": timestamp}
+	data["datawaves"] = meta
+
+	return ""
+}
+
+func (es *Elasticsearch) Record(ctx context.Context, idx, id string, doc map[string]interface{}) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-	input, err := json.Marshal(data)
+	input, err := json.Marshal(doc)
 	if err != nil {
-		errors.Log(err, "Error decoding data.\nIndex: "+idx+".\nDocument ID: "+id+"."+"\nBody: "+body+".")
+		errors.Log(err, "Error encoding data.\nIndex: "+idx+".\nDocument ID: "+id+".")
 		return errors.New("Error decoding document.")
 	}
 
@@ -47,28 +127,287 @@ func Record(r *http.Request, idx, body string) error {
 		Index:      idx,
 		Body:       strings.NewReader(string(input)),
 		DocumentID: id,
+		// an event is never replaced, see idempotencyKey
+		OpType: "create",
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, "Error getting response. Index: "+idx+". Document ID: "+id+"."+" Body: "+body+".")
+		errors.Log(err, "Error getting response. Index: "+idx+". Document ID: "+id+"."+" Body: "+string(input)+".")
 		return errors.New("Error saving document.")
 	}
 	defer res.Body.Close()
 
+	// the event was already recorded
+	if res.StatusCode == http.StatusConflict {
+		return nil
+	}
+
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Failed to index document.\nIndex: %s.\nDocument ID: %s.\nBody: %s.\nResponse: %v.", idx, id, body, res)))
+		errors.Log(errors.New(fmt.Sprintf("Failed to index document.\nIndex: %s.\nDocument ID: %s.\nBody: %s.\nResponse: %v.", idx, id, input, res)))
 		return errors.New("Failed to index document.")
 	}
 
+	es.mappings.observe(idx, doc)
+
 	return nil
 }
 
-// RecordBulk saves a bulk of events
-// body: should be a valid bulk string
-// https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html
-func RecordBulk(r *http.Request, body string) error {
+// BulkMode is what happens to the other events of a bulk when some fail
+type BulkMode string
+
+const (
+	// BulkBestEffort records the events that don't fail
+	BulkBestEffort BulkMode = "best_effort"
+	// BulkAllOrNothing records none of the events when one fails,
+	// the ones already recorded are deleted
+	BulkAllOrNothing BulkMode = "all_or_nothing"
+)
+
+// ParseBulkMode returns the mode named mode, best effort when empty
+func ParseBulkMode(mode string) (BulkMode, error) {
+	switch BulkMode(mode) {
+	case "", BulkBestEffort:
+		return BulkBestEffort, nil
+	case BulkAllOrNothing:
+		return BulkAllOrNothing, nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown bulk mode \"%s\", it should be best_effort or all_or_nothing!", mode))
+}
+
+// BulkDuplicate is the result of the events of a bulk whose idempotency key
+// is the one of an event already recorded, they succeed without being recorded again
+const BulkDuplicate = "duplicate"
+
+// BulkItem is the result of an action of a bulk
+type BulkItem struct {
+	// Collection is the collection of the event, only set by RecordBulk
+	Collection string `json:"collection,omitempty"`
+	// Index is the index the action was sent to
+	Index  string `json:"index"`
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	// Result is created, updated, deleted or BulkDuplicate when it succeeded
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Failed reports whether the action failed
+func (item BulkItem) Failed() bool {
+	return item.Status < 200 || item.Status >= 300
+}
+
+// BulkResult has an item for every action of the bulk, in order
+type BulkResult struct {
+	Errors bool       `json:"errors"`
+	Items  []BulkItem `json:"items"`
+}
+
+// RecordBulk saves the events of the project's collections and returns the result of each one.
+// Events that don't conform to their schema or whose idempotency key is invalid fail without
+// being sent, in all or nothing mode the whole bulk does. The result is returned along with
+// the error when an all or nothing bulk fails.
+// Events are identified by their idempotency key as in Record, duplicates succeed as BulkDuplicate.
+// body: should be a json object of the events by collection, as in {"purchases": [{...}, {...}]},
+// the items are sorted by collection then in the order of its events.
+func RecordBulk(r *http.Request, projectID, body string, mode BulkMode) (*BulkResult, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	ctx := r.Context()
+
+	var collections map[string][]interface{}
+	err := json.NewDecoder(strings.NewReader(body)).Decode(&collections)
+	if err != nil {
+		errors.Log(err, "Error decoding bulk.\nProject: "+projectID+".\nBody: "+body+".")
+		return nil, errors.New("Invalid bulk, it should be a json object of the events by collection!")
+	}
+
+	names := []string{}
+	for collection := range collections {
+		err = ValidateCollection(collection)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, collection)
+	}
+	sort.Strings(names)
+
+	result := &BulkResult{Items: []BulkItem{}}
+	events := []bulkEvent{}
+	// errors of the events that can't be sent by position in the bulk
+	rejected := make(map[int]string)
+	for _, collection := range names {
+		idx := GetIndex(projectID, collection)
+		for _, e := range collections[collection] {
+			doc, _ := e.(map[string]interface{})
+			id, err := idempotencyKey(doc, "")
+			if err != nil {
+				rejected[len(events)] = err.Error()
+			}
+			events = append(events, bulkEvent{index: idx, id: id, doc: doc})
+			result.Items = append(result.Items, BulkItem{Collection: collection, Index: idx, ID: id})
+		}
+	}
+
+	invalid, err := conformBulk(ctx, events)
+	if err != nil {
+		return nil, err
+	}
+	for i, reason := range invalid {
+		if _, ok := rejected[i]; !ok {
+			rejected[i] = "Invalid event: " + reason + "!"
+		}
+	}
+
+	for i, event := range events {
+		if _, ok := rejected[i]; ok {
+			continue
+		}
+
+		problem := stampEvent(event.doc, event.id)
+		if problem != "" {
+			rejected[i] = "Invalid event: " + problem + "!"
+		}
+	}
+
+	for i, message := range rejected {
+		result.Items[i].Status = http.StatusBadRequest
+		result.Items[i].Error = message
+		result.Errors = true
+	}
+
+	if len(rejected) > 0 && mode == BulkAllOrNothing {
+		for i := range result.Items {
+			if _, ok := rejected[i]; !ok {
+				result.Items[i].Status = http.StatusFailedDependency
+				result.Items[i].Error = "Not recorded, other events of the bulk are invalid."
+			}
+		}
+		return result, errors.New(fmt.Sprintf("%d events of the bulk are invalid, none was recorded!", len(rejected)))
+	}
+
+	// positions of the sent events in the bulk
+	sent := []int{}
+	var bulk strings.Builder
+	for i, event := range events {
+		if _, ok := rejected[i]; ok {
+			continue
+		}
+
+		meta, err := json.Marshal(map[string]interface{}{"create": map[string]interface{}{"_index": event.index, "_id": event.id}})
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", event.index))
+			return nil, errors.New("Error encoding bulk!")
+		}
+		doc, err := json.Marshal(event.doc)
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", event.index))
+			return nil, errors.New("Error encoding document!")
+		}
+
+		bulk.WriteString(string(meta) + "\n" + string(doc) + "\n")
+		sent = append(sent, i)
+	}
+
+	if len(sent) > 0 {
+		items, err := backend.RecordBulk(ctx, bulk.String())
+		if err != nil {
+			return nil, err
+		}
+
+		for j, item := range items {
+			if j < len(sent) {
+				i := sent[j]
+				item.Collection = result.Items[i].Collection
+				item.Index = events[i].index
+				if item.Status == http.StatusConflict {
+					item = BulkItem{Collection: item.Collection, Index: item.Index, ID: item.ID, Status: http.StatusOK, Result: BulkDuplicate}
+				}
+				result.Items[i] = item
+			}
+		}
+	}
+
+	failed := 0
+	for _, item := range result.Items {
+		if item.Failed() {
+			failed++
+		}
+	}
+	result.Errors = failed > 0
+
+	if failed > 0 && mode == BulkAllOrNothing {
+		return result, rollbackBulk(ctx, result, failed)
+	}
+
+	for i, event := range events {
+		if !result.Items[i].Failed() {
+			registerIndex(ctx, event.index)
+		}
+	}
+
+	return result, nil
+}
+
+// rollbackBulk deletes the events the bulk created, the duplicates of
+// events recorded before the bulk are kept as they aren't the bulk's.
+func rollbackBulk(ctx context.Context, result *BulkResult, failed int) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	created := []int{}
+	var bulk strings.Builder
+	for i, item := range result.Items {
+		if item.Result != "created" {
+			continue
+		}
+
+		meta, err := json.Marshal(map[string]interface{}{"delete": map[string]interface{}{"_index": item.Index, "_id": item.ID}})
+		if err != nil {
+			errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", item.Index))
+			return errors.New("Error encoding bulk!")
+		}
+		bulk.WriteString(string(meta) + "\n")
+		created = append(created, i)
+	}
+
+	if len(created) > 0 {
+		items, err := backend.RecordBulk(ctx, bulk.String())
+		if err != nil {
+			return errors.New(fmt.Sprintf("%d events of the bulk failed and the others couldn't be deleted!", failed))
+		}
+
+		// by index and ID
+		deleted := make(map[[2]string]bool)
+		for j, item := range items {
+			if j < len(created) && !item.Failed() {
+				i := created[j]
+				deleted[[2]string{result.Items[i].Index, result.Items[i].ID}] = true
+			}
+		}
+
+		// the duplicates of the deleted events are deleted with them
+		for i, item := range result.Items {
+			if deleted[[2]string{item.Index, item.ID}] && !item.Failed() {
+				result.Items[i].Status = http.StatusFailedDependency
+				result.Items[i].Result = ""
+				result.Items[i].Error = "Deleted, other events of the bulk failed."
+			}
+		}
+	}
+
+	for _, item := range result.Items {
+		if item.Result == "created" {
+			return errors.New(fmt.Sprintf("%d events of the bulk failed and the others couldn't all be deleted!", failed))
+		}
+	}
+
+	return errors.New(fmt.Sprintf("%d events of the bulk failed, none was recorded!", failed))
+}
+
+// RecordBulk sends the bulk and returns the result of each of its actions
+func (es *Elasticsearch) RecordBulk(ctx context.Context, body string) ([]BulkItem, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 	// Set up the request object.
 	req := esapi.BulkRequest{
@@ -76,17 +415,138 @@ func RecordBulk(r *http.Request, body string) error {
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
 		errors.Log(err, "Error getting response. body: "+body)
-		return errors.New("Error saving document.")
+		return nil, errors.New("Error saving document.")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
 		errors.Log(errors.New(fmt.Sprintf("Failed to index documents. %v", res)))
-		return errors.New("Failed to index document.")
+		return nil, errors.New("Failed to index document.")
 	}
 
-	return nil
+	// the request succeeds even when some of the actions fail
+	var rr struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Index  string `json:"_index"`
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+			Result string `json:"result"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Response: %v.\n", res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	if rr.Errors {
+		errors.Log(errors.New(fmt.Sprintf("Failed to index some documents. %v", res)))
+	}
+
+	items := []BulkItem{}
+	for _, i := range rr.Items {
+		for _, r := range i {
+			item := BulkItem{Index: r.Index, ID: r.ID, Status: r.Status, Result: r.Result}
+			if r.Error != nil {
+				item.Error = r.Error.Reason
+			}
+			items = append(items, item)
+		}
+	}
+
+	es.observeBulk(body)
+
+	return items, nil
+}
+
+// observeBulk invalidates the mappings the bulk's documents add properties to
+func (es *Elasticsearch) observeBulk(body string) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	actions, err := parseBulk(body)
+	if err != nil {
+		return
+	}
+
+	for _, action := range actions {
+		if action.op != "index" && action.op != "create" {
+			continue
+		}
+
+		lines := strings.SplitN(action.lines, "\n", 3)
+		if len(lines) < 2 {
+			continue
+		}
+
+		var doc map[string]interface{}
+		if json.Unmarshal([]byte(lines[1]), &doc) == nil {
+			es.mappings.observe(action.index, doc)
+		}
+	}
+}
+
+// bulkEvent is an event of a bulk with the index it is recorded in and its ID
+type bulkEvent struct {
+	index string
+	id    string
+	// doc is nil when the event isn't a json object
+	doc map[string]interface{}
+}
+
+// bulkAction is an action of a bulk body with its lines
+type bulkAction struct {
+	op    string
+	index string
+	id    string
+	lines string
+}
+
+// parseBulk splits a bulk body in its actions
+func parseBulk(body string) ([]bulkAction, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	actions := []bulkAction{}
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var meta map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		err := json.Unmarshal([]byte(line), &meta)
+		if err != nil || len(meta) != 1 {
+			errors.Log(errors.New(fmt.Sprintf("Invalid bulk action: %s", line)))
+			return nil, errors.New("Invalid bulk body!")
+		}
+
+		for op, m := range meta {
+			action := bulkAction{op: op, index: m.Index, id: m.ID, lines: line + "\n"}
+
+			// every action but delete is followed by the document
+			if op != "delete" {
+				if !scanner.Scan() {
+					return nil, errors.New("Invalid bulk body!")
+				}
+				action.lines = action.lines + scanner.Text() + "\n"
+			}
+
+			actions = append(actions, action)
+		}
+	}
+
+	return actions, nil
 }
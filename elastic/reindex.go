@@ -0,0 +1,943 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// PropertyChange is the new type of a property and how its values are converted to it
+type PropertyChange struct {
+	// Name is the dotted path of the property, like user.address.city
+	Name string `json:"name"`
+	// Type is keyword, text, long, double, boolean or date, like in schemas
+	Type string `json:"type"`
+	// Conversion is one of reindexConversions. Without one values are copied as they are
+	// and parsed as the new type.
+	Conversion string `json:"conversion,omitempty"`
+	// NewName is the dotted path the rename conversion moves the values to, with the new type
+	NewName string `json:"new_name,omitempty"`
+}
+
+// reindexConversions are how the values of a property can be converted, values that
+// can't be converted to a number are removed and numbers converted to a date are epoch millis
+var reindexConversions = map[string]bool{
+	"to_string":  true,
+	"to_number":  true,
+	"to_boolean": true,
+	"to_date":    true,
+	"rename":     true,
+}
+
+// target is the property with the new type
+func (change PropertyChange) target() string {
+	if change.Conversion == "rename" {
+		return change.NewName
+	}
+	return change.Name
+}
+
+// reindexPollInterval is how often the server moves the reindexings along
+const reindexPollInterval = 5 * time.Second
+
+// reindexWriteBlockLimit is how long events can't be recorded while a reindexing
+// catches up, it fails when catching up takes longer
+const reindexWriteBlockLimit = time.Minute
+
+// Reindexing is the progress of a collection being copied to a new index with other property types,
+// the collection is queried from its current indices until the new one replaces them.
+type Reindexing struct {
+	// Status is copying, catching_up, cleaning_up, done or failed. Events recorded while copying
+	// are copied when catching up, they can't be recorded then. Once the new index replaces the
+	// current ones they are deleted when cleaning up.
+	Status  string           `json:"status"`
+	Changes []PropertyChange `json:"changes"`
+	// From are the indices of the collection and To the one replacing them
+	From []string `json:"from"`
+	To   string   `json:"to"`
+	// Task is the elasticsearch task copying the events
+	Task string `json:"task"`
+	// Total is the events the step copies and Copied the ones it copied so far
+	Total  int64  `json:"total"`
+	Copied int64  `json:"copied"`
+	Error  string `json:"error,omitempty"`
+	// BlockedAt is when the writes to the current indices were blocked to catch up
+	BlockedAt string `json:"blocked_at,omitempty"`
+	// Retired are the indices replaced by the new one, deleted when cleaning up
+	Retired    []string `json:"retired,omitempty"`
+	StartedAt  string   `json:"started_at"`
+	FinishedAt string   `json:"finished_at,omitempty"`
+}
+
+// Running reports whether the reindexing is neither done nor failed
+func (reindexing *Reindexing) Running() bool {
+	return reindexing.Status == "copying" || reindexing.Status == "catching_up" || reindexing.Status == "cleaning_up"
+}
+
+// ReindexCollection starts copying the collection to a new index where the properties
+// have their new types, the server moves it along until the new index replaces the current one.
+func ReindexCollection(r *http.Request, projectID, collection, body string) (*Reindexing, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	err := ValidateCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireMigrated(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var req struct {
+		Properties []PropertyChange `json:"properties"`
+	}
+	err = json.NewDecoder(strings.NewReader(body)).Decode(&req)
+	if err != nil {
+		errors.Log(err)
+		return nil, errors.New("Error decoding request body!")
+	}
+
+	if len(req.Properties) == 0 {
+		return nil, errors.New("Missing properties to change!")
+	}
+
+	names := make(map[string]bool)
+	for _, change := range req.Properties {
+		if change.Conversion != "" && !reindexConversions[change.Conversion] {
+			return nil, errors.New(fmt.Sprintf("Invalid conversion \"%s\" of property %s, it should be to_string, to_number, to_boolean, to_date or rename!", change.Conversion, change.Name))
+		}
+		if (change.Conversion == "rename") != (change.NewName != "") {
+			return nil, errors.New(fmt.Sprintf("Property %s should have a new_name only when it is renamed!", change.Name))
+		}
+
+		err := validateProperty(change.target(), change.Type)
+		if err != nil {
+			return nil, err
+		}
+		if change.Conversion == "rename" {
+			err = validateProperty(change.Name, change.Type)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, name := range []string{change.Name, change.NewName} {
+			if name == "" {
+				continue
+			}
+			if names[name] {
+				return nil, errors.New(fmt.Sprintf("Property %s is changed twice!", name))
+			}
+			names[name] = true
+		}
+	}
+
+	return backend.ReindexCollection(r.Context(), projectID, collection, req.Properties)
+}
+
+// ReindexingProgress returns the progress of the collection's last reindexing,
+// the server moves it to the next step when the current one is over.
+func ReindexingProgress(r *http.Request, projectID, collection string) (*Reindexing, error) {
+	err := ValidateCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.ReindexingProgress(r.Context(), projectID, collection)
+}
+
+func (es *Elasticsearch) ReindexCollection(ctx context.Context, projectID, collection string, changes []PropertyChange) (*Reindexing, error) {
+	c, err := es.RegisterCollection(ctx, projectID, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Reindexing != nil && c.Reindexing.Running() {
+		return nil, errors.New("The collection is already being reindexed!")
+	}
+
+	from, err := es.concreteIndices(ctx, c.Index)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 {
+		return nil, errors.New("The collection has no events to reindex!")
+	}
+
+	properties, err := es.rawMapping(ctx, c.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if !setMappingProperty(properties, change.target(), schemaTypes[change.Type]) {
+			return nil, errors.New(fmt.Sprintf("Property %s can't be changed, it is in a property that isn't an object!", change.target()))
+		}
+	}
+
+	now := time.Now().UTC()
+	reindexing := &Reindexing{
+		Status:    "copying",
+		Changes:   changes,
+		From:      from,
+		To:        reindexName(c.Index, now),
+		StartedAt: now.Format(timestampFormat),
+	}
+
+	err = es.createIndex(ctx, reindexing.To, map[string]interface{}{"properties": properties})
+	if err != nil {
+		return nil, err
+	}
+
+	reindexing.Task, err = es.startReindex(ctx, reindexing, false)
+	if err != nil {
+		es.deleteIndex(ctx, reindexing.To)
+		return nil, err
+	}
+
+	c.Reindexing = reindexing
+	err = es.saveCollection(ctx, projectID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	es.watchReindexing(projectID, collection)
+
+	return reindexing, nil
+}
+
+// ReindexingProgress refreshes the progress of the running step without moving the reindexing along,
+// the server does it, see watchReindexing
+func (es *Elasticsearch) ReindexingProgress(ctx context.Context, projectID, collection string) (*Reindexing, error) {
+	c, err := es.getCollection(ctx, registryIndex(projectID), strings.ToLower(collection))
+	if err != nil {
+		return nil, err
+	}
+
+	reindexing := c.Reindexing
+	if reindexing == nil {
+		return nil, errors.New("The collection was never reindexed!")
+	}
+
+	if reindexing.Status == "copying" || reindexing.Status == "catching_up" {
+		_, _, err = es.reindexTask(ctx, reindexing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// after a restart, before ResumeReindexings
+	if reindexing.Running() {
+		es.watchReindexing(projectID, collection)
+	}
+
+	return reindexing, nil
+}
+
+// watchReindexing moves the collection's reindexing along in the background until it is over,
+// once per collection on this server
+func (es *Elasticsearch) watchReindexing(projectID, collection string) {
+	key := registryIndex(projectID) + "/" + strings.ToLower(collection)
+	if _, watching := es.reindexings.LoadOrStore(key, true); watching {
+		return
+	}
+
+	go func() {
+		defer es.reindexings.Delete(key)
+
+		ticker := time.NewTicker(reindexPollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), reindexPollInterval)
+			reindexing, err := es.advanceReindexing(ctx, projectID, collection)
+			cancel()
+
+			if err != nil {
+				errors.Log(err, "Error reindexing collection "+collection+" of project "+projectID+".")
+				continue
+			}
+			if !reindexing.Running() {
+				return
+			}
+		}
+	}()
+}
+
+// ResumeReindexings has the server move along the reindexings that were running when it stopped
+func ResumeReindexings(ctx context.Context) error {
+	resumer, ok := backend.(interface {
+		ResumeReindexings(ctx context.Context) error
+	})
+	if !ok {
+		return errors.New("The backend can't resume reindexings!")
+	}
+
+	return resumer.ResumeReindexings(ctx)
+}
+
+// ResumeReindexings watches the running reindexings of every project's registry
+func (es *Elasticsearch) ResumeReindexings(ctx context.Context) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	pattern := "*" + indexSeparator + "_collections"
+	query := `{"query":{"exists":{"field":"reindexing.status"}}}`
+
+	size := 10000
+	// Set up the request object.
+	req := esapi.SearchRequest{
+		Index: []string{pattern},
+		Body:  strings.NewReader(query),
+		Size:  &size,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", pattern, query, res))
+		return errors.New("Error getting reindexings!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", pattern, query, res)))
+		return errors.New("Failed to get reindexings!")
+	}
+
+	var rr struct {
+		Hits struct {
+			Hits []struct {
+				Index  string     `json:"_index"`
+				Source Collection `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", pattern, query, res))
+		return errors.New("Error decoding response!")
+	}
+
+	for _, hit := range rr.Hits.Hits {
+		if hit.Source.Reindexing == nil || !hit.Source.Reindexing.Running() {
+			continue
+		}
+
+		// the registry is named with the project's prefix, which is a valid project ID
+		projectID := strings.TrimSuffix(hit.Index, indexSeparator+"_collections")
+		es.watchReindexing(projectID, hit.Source.Name)
+	}
+
+	return nil
+}
+
+// advanceReindexing moves the reindexing to the next step when the current one is over
+func (es *Elasticsearch) advanceReindexing(ctx context.Context, projectID, collection string) (*Reindexing, error) {
+	c, err := es.getCollection(ctx, registryIndex(projectID), strings.ToLower(collection))
+	if err != nil {
+		return nil, err
+	}
+
+	reindexing := c.Reindexing
+	if reindexing == nil || !reindexing.Running() {
+		return reindexing, nil
+	}
+
+	if reindexing.Status == "cleaning_up" {
+		for _, idx := range reindexing.Retired {
+			es.deleteIndex(ctx, idx)
+		}
+
+		reindexing.Status = "done"
+		reindexing.FinishedAt = time.Now().UTC().Format(timestampFormat)
+
+		err = es.saveCollection(ctx, projectID, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return reindexing, nil
+	}
+
+	completed, failure, err := es.reindexTask(ctx, reindexing)
+	if err != nil {
+		return nil, err
+	}
+	if failure != "" {
+		return es.failReindexing(ctx, projectID, c, failure)
+	}
+
+	if reindexing.Status == "catching_up" && !completed {
+		blockedAt, err := time.Parse(timestampFormat, reindexing.BlockedAt)
+		if err != nil {
+			// the limit can't be checked, it starts again
+			errors.Log(err, "Invalid blocked_at of the reindexing of collection "+collection+" of project "+projectID+".")
+			reindexing.BlockedAt = time.Now().UTC().Format(timestampFormat)
+		} else if time.Since(blockedAt) > reindexWriteBlockLimit {
+			return es.failReindexing(ctx, projectID, c, fmt.Sprintf("catching up took more than %v, events couldn't be recorded for too long", reindexWriteBlockLimit))
+		}
+	}
+
+	if !completed {
+		return reindexing, es.saveCollection(ctx, projectID, c)
+	}
+
+	if reindexing.Status == "copying" {
+		// what was recorded since it started is copied while events can't be recorded
+		err = es.blockWrites(ctx, reindexing.From, true)
+		if err != nil {
+			return es.failReindexing(ctx, projectID, c, err.Error())
+		}
+		reindexing.BlockedAt = time.Now().UTC().Format(timestampFormat)
+
+		task, err := es.startReindex(ctx, reindexing, true)
+		if err != nil {
+			return es.failReindexing(ctx, projectID, c, err.Error())
+		}
+
+		reindexing.Status = "catching_up"
+		reindexing.Task = task
+		reindexing.Total = 0
+		reindexing.Copied = 0
+
+		err = es.saveCollection(ctx, projectID, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return reindexing, nil
+	}
+
+	err = es.swapIndices(ctx, c.Index, reindexing)
+	if err != nil {
+		return es.failReindexing(ctx, projectID, c, err.Error())
+	}
+
+	reindexing.Status = "cleaning_up"
+
+	// the schema follows the new types
+	if c.Schema != nil {
+		for _, change := range reindexing.Changes {
+			for i := range c.Schema.Properties {
+				if c.Schema.Properties[i].Name == change.Name {
+					c.Schema.Properties[i].Name = change.target()
+					c.Schema.Properties[i].Type = change.Type
+				}
+			}
+		}
+	}
+
+	err = es.saveCollection(ctx, projectID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	es.mappings.invalidate(c.Index)
+	es.schemas.set(c.Index, c.Schema)
+
+	return reindexing, nil
+}
+
+// failReindexing stops the reindexing, the collection keeps its indices
+func (es *Elasticsearch) failReindexing(ctx context.Context, projectID string, c *Collection, reason string) (*Reindexing, error) {
+	reindexing := c.Reindexing
+	reindexing.Status = "failed"
+	reindexing.Error = reason
+	reindexing.FinishedAt = time.Now().UTC().Format(timestampFormat)
+
+	es.cancelTask(ctx, reindexing.Task)
+
+	err := es.blockWrites(ctx, reindexing.From, false)
+	if err != nil {
+		errors.Log(err, "Error unblocking the writes of "+strings.Join(reindexing.From, ",")+".")
+	}
+	es.deleteIndex(ctx, reindexing.To)
+	// backups of the indices, they weren't replaced
+	for _, idx := range reindexing.Retired {
+		es.deleteIndex(ctx, idx)
+	}
+	reindexing.Retired = nil
+
+	err = es.saveCollection(ctx, projectID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return reindexing, nil
+}
+
+// reindexName is the name of the index replacing the collection's index, it can't be a collection's
+func reindexName(idx string, now time.Time) string {
+	i := strings.Index(idx, indexSeparator)
+	return fmt.Sprintf("%s%s_%s-%d", idx[:i], indexSeparator, idx[i+1:], now.UnixNano()/int64(time.Millisecond))
+}
+
+// setMappingProperty sets the mapping of the property at the dotted path,
+// it is false when one of its parents isn't an object.
+func setMappingProperty(properties map[string]interface{}, path string, mapping map[string]interface{}) bool {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := properties[part].(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{"properties": make(map[string]interface{})}
+			properties[part] = obj
+		}
+
+		properties, ok = obj["properties"].(map[string]interface{})
+		if !ok {
+			return false
+		}
+	}
+
+	properties[parts[len(parts)-1]] = mapping
+	return true
+}
+
+// reindexConversionScript converts the values of the changed properties, params.changes has
+// their paths, conversions and new paths. Its source is fixed, changes are only params.
+const reindexConversionScript = `
+for (def c : params.changes) {
+  def o = ctx._source;
+  List p = c.path;
+  for (int i = 0; i < p.size() - 1 && o instanceof Map; i++) { o = o[p[i]]; }
+  String k = p[p.size() - 1];
+  if (!(o instanceof Map) || o[k] == null) { continue; }
+  def v = o[k];
+  if (c.conversion == 'rename') {
+    o.remove(k);
+    def t = ctx._source;
+    List q = c.new_path;
+    for (int i = 0; i < q.size() - 1; i++) {
+      if (!(t[q[i]] instanceof Map)) { t[q[i]] = new HashMap(); }
+      t = t[q[i]];
+    }
+    t[q[q.size() - 1]] = v;
+  } else if (c.conversion == 'to_string') {
+    o[k] = String.valueOf(v);
+  } else if (c.conversion == 'to_number') {
+    if (!(v instanceof Number)) {
+      try { o[k] = Double.parseDouble(v.toString().trim()); } catch (NumberFormatException e) { o.remove(k); }
+    }
+  } else if (c.conversion == 'to_boolean') {
+    if (!(v instanceof Boolean)) {
+      String b = v.toString().trim().toLowerCase();
+      o[k] = b == 'true' || b == 'yes' || b == '1';
+    }
+  } else if (c.conversion == 'to_date') {
+    if (v instanceof Number) { o[k] = Instant.ofEpochMilli(((Number) v).longValue()).toString(); }
+  }
+}`
+
+// reindexScript converts the values of the properties with a conversion, nil when none has one
+func reindexScript(changes []PropertyChange) map[string]interface{} {
+	conversions := []interface{}{}
+	for _, change := range changes {
+		if change.Conversion == "" {
+			continue
+		}
+
+		conversion := map[string]interface{}{
+			"path":       strings.Split(change.Name, "."),
+			"conversion": change.Conversion,
+		}
+		if change.Conversion == "rename" {
+			conversion["new_path"] = strings.Split(change.NewName, ".")
+		}
+		conversions = append(conversions, conversion)
+	}
+
+	if len(conversions) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"lang":   "painless",
+		"source": reindexConversionScript,
+		"params": map[string]interface{}{"changes": conversions},
+	}
+}
+
+// startReindex starts the task copying the events, catching up only copies the ones missing
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-reindex.html
+func (es *Elasticsearch) startReindex(ctx context.Context, reindexing *Reindexing, catchUp bool) (string, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	dest := map[string]interface{}{"index": reindexing.To}
+	q := map[string]interface{}{
+		"source": map[string]interface{}{"index": reindexing.From},
+		"dest":   dest,
+	}
+	if catchUp {
+		dest["op_type"] = "create"
+		q["conflicts"] = "proceed"
+	}
+	if script := reindexScript(reindexing.Changes); script != nil {
+		q["script"] = script
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", reindexing.To))
+		return "", errors.New("Error encoding query!")
+	}
+	query := string(b)
+
+	wait := false
+	// Set up the request object.
+	req := esapi.ReindexRequest{
+		Body:              strings.NewReader(query),
+		WaitForCompletion: &wait,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Query: %s.\n Response: %v.\n", query, res))
+		return "", errors.New("Error reindexing collection!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Query: %s.\n Response: %v.\n", query, res)))
+		return "", errors.New("Failed to reindex collection!")
+	}
+
+	var rr struct {
+		Task string `json:"task"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Query: %s.\n Response: %v.\n", query, res))
+		return "", errors.New("Error decoding response!")
+	}
+
+	return rr.Task, nil
+}
+
+// reindexTask sets the progress of the reindexing's task,
+// failure is why it failed, or the first event it couldn't copy.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/tasks.html
+func (es *Elasticsearch) reindexTask(ctx context.Context, reindexing *Reindexing) (completed bool, failure string, err error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	// Set up the request object.
+	req := esapi.TasksGetRequest{
+		TaskID: reindexing.Task,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Task: %s.\n Response: %v.\n", reindexing.Task, res))
+		return false, "", errors.New("Error getting reindexing progress!")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, "the reindexing task was lost", nil
+	}
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Task: %s.\n Response: %v.\n", reindexing.Task, res)))
+		return false, "", errors.New("Failed to get reindexing progress!")
+	}
+
+	var rr struct {
+		Completed bool `json:"completed"`
+		Task      struct {
+			Status struct {
+				Total            int64 `json:"total"`
+				Created          int64 `json:"created"`
+				Updated          int64 `json:"updated"`
+				VersionConflicts int64 `json:"version_conflicts"`
+			} `json:"status"`
+		} `json:"task"`
+		Error *struct {
+			Reason string `json:"reason"`
+		} `json:"error"`
+		Response struct {
+			Failures []struct {
+				ID    string `json:"id"`
+				Cause struct {
+					Reason string `json:"reason"`
+				} `json:"cause"`
+			} `json:"failures"`
+		} `json:"response"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Task: %s.\n Response: %v.\n", reindexing.Task, res))
+		return false, "", errors.New("Error decoding response!")
+	}
+
+	status := rr.Task.Status
+	reindexing.Total = status.Total
+	// events already copied are conflicts when catching up
+	reindexing.Copied = status.Created + status.Updated + status.VersionConflicts
+
+	if rr.Error != nil {
+		return true, rr.Error.Reason, nil
+	}
+	if len(rr.Response.Failures) > 0 {
+		f := rr.Response.Failures[0]
+		return true, fmt.Sprintf("event %s: %s", f.ID, f.Cause.Reason), nil
+	}
+
+	return rr.Completed, "", nil
+}
+
+// blockWrites sets whether events can be recorded to the indices
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/index-modules-blocks.html
+func (es *Elasticsearch) blockWrites(ctx context.Context, indices []string, block bool) error {
+	body := fmt.Sprintf(`{"index.blocks.write": %t}`, block)
+
+	// Set up the request object.
+	req := esapi.IndicesPutSettingsRequest{
+		Index: indices,
+		Body:  strings.NewReader(body),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Indices: %v.\n Response: %v.\n", indices, res))
+		return errors.New("Error blocking writes!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Indices: %v.\n Response: %v.\n", indices, res)))
+		return errors.New("Failed to block writes!")
+	}
+
+	return nil
+}
+
+// swapIndices makes the collection's name an alias of the new index once it has every event.
+// The current indices are retired, they are deleted once the swap is checked. The one named as the
+// collection can't stay with an alias of the same name, it is cloned to a backup and removed.
+func (es *Elasticsearch) swapIndices(ctx context.Context, alias string, reindexing *Reindexing) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	copied, err := es.countIndices(ctx, []string{reindexing.To})
+	if err != nil {
+		return err
+	}
+	total, err := es.countIndices(ctx, reindexing.From)
+	if err != nil {
+		return err
+	}
+	if copied < total {
+		return errors.New(fmt.Sprintf("Only %d of the %d events were copied!", copied, total))
+	}
+
+	actions := []interface{}{}
+	for _, idx := range reindexing.From {
+		if idx != alias {
+			actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": idx, "alias": alias}})
+			reindexing.Retired = append(reindexing.Retired, idx)
+			continue
+		}
+
+		backup := reindexing.To + "-backup"
+		err = es.cloneIndex(ctx, idx, backup)
+		if err != nil {
+			return err
+		}
+		reindexing.Retired = append(reindexing.Retired, backup)
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": idx}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": reindexing.To, "alias": alias}})
+
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Alias: %s.\n", alias))
+		return errors.New("Error encoding aliases!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: strings.NewReader(string(b)),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Actions: %s.\n Response: %v.\n", b, res))
+		return errors.New("Error replacing collection index!")
+	}
+	defer res.Body.Close()
+
+	// the actions are atomic, nothing was removed
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Actions: %s.\n Response: %v.\n", b, res)))
+		return errors.New("Failed to replace collection index!")
+	}
+
+	current, err := es.concreteIndices(ctx, alias)
+	if err != nil {
+		return err
+	}
+	if len(current) != 1 || current[0] != reindexing.To {
+		errors.Log(errors.New(fmt.Sprintf("Unexpected indices after the swap. Alias: %s.\n Indices: %v.\n", alias, current)))
+		return errors.New("Failed to replace collection index!")
+	}
+
+	return nil
+}
+
+// cloneIndex copies the index, whose writes are blocked, to a new one
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-clone-index.html
+func (es *Elasticsearch) cloneIndex(ctx context.Context, idx, target string) error {
+	// Set up the request object.
+	req := esapi.IndicesCloneRequest{
+		Index:  idx,
+		Target: target,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Target: %s.\n Response: %v.\n", idx, target, res))
+		return errors.New("Error backing up collection index!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Target: %s.\n Response: %v.\n", idx, target, res)))
+		return errors.New("Failed to back up collection index!")
+	}
+
+	return nil
+}
+
+// countIndices returns how many events the indices have
+func (es *Elasticsearch) countIndices(ctx context.Context, indices []string) (int64, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	// Set up the request object.
+	req := esapi.CountRequest{
+		Index: indices,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Indices: %v.\n Response: %v.\n", indices, res))
+		return 0, errors.New("Error counting events!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Indices: %v.\n Response: %v.\n", indices, res)))
+		return 0, errors.New("Failed to count events!")
+	}
+
+	var rr struct {
+		Count int64 `json:"count"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Indices: %v.\n Response: %v.\n", indices, res))
+		return 0, errors.New("Error decoding response!")
+	}
+
+	return rr.Count, nil
+}
+
+// cancelTask cancels the task if it is still running, failing to do so is only logged
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/tasks.html
+func (es *Elasticsearch) cancelTask(ctx context.Context, task string) {
+	if task == "" {
+		return
+	}
+
+	// Set up the request object.
+	req := esapi.TasksCancelRequest{
+		TaskID: task,
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Task: %s.\n Response: %v.\n", task, res))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Task: %s.\n Response: %v.\n", task, res)))
+	}
+}
+
+// concreteIndices returns the indices of the index or alias, none when it doesn't exist
+func (es *Elasticsearch) concreteIndices(ctx context.Context, name string) ([]string, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	// Set up the request object.
+	req := esapi.CatIndicesRequest{
+		Index:  []string{name},
+		Format: "json",
+		H:      []string{"index"},
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Response: %v.\n", name, res))
+		return nil, errors.New("Error listing indices!")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return []string{}, nil
+	}
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Response: %v.\n", name, res)))
+		return nil, errors.New("Failed to list indices!")
+	}
+
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&indices)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Response: %v.\n", name, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	names := []string{}
+	for _, i := range indices {
+		names = append(names, i.Index)
+	}
+
+	return names, nil
+}
+
+// deleteIndex deletes an index that was never used or was retired, failing to do so is only logged
+func (es *Elasticsearch) deleteIndex(ctx context.Context, idx string) {
+	// Set up the request object.
+	req := esapi.IndicesDeleteRequest{
+		Index: []string{idx},
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Response: %v.\n", idx, res))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Response: %v.\n", idx, res)))
+	}
+}
@@ -0,0 +1,216 @@
+package elastic
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// advance moves the collection's reindexing to its next step, like the server does
+func advance(t *testing.T, es *Elasticsearch, collection, want string) *Reindexing {
+	t.Helper()
+
+	reindexing, err := es.advanceReindexing(context.Background(), memoryTestProject, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reindexing.Status != want {
+		t.Fatalf("got the status %s (%s), want %s", reindexing.Status, reindexing.Error, want)
+	}
+	return reindexing
+}
+
+// hasIndex tells if the cluster has the concrete index
+func hasIndex(t *testing.T, es *Elasticsearch, idx string) bool {
+	t.Helper()
+
+	indices, err := es.Indices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range indices {
+		if i == idx {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReindexCollection(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"orders": {
+			`{"timestamp":"2020-01-05T10:00:00.000Z","code":1}`,
+			`{"timestamp":"2020-01-06T10:00:00.000Z","code":2}`,
+		},
+	})
+	defer restore()
+
+	es := backend.(*Elasticsearch)
+	idx := GetIndex(memoryTestProject, "orders")
+
+	reindexing, err := ReindexCollection(r, memoryTestProject, "orders", `{"properties":[{"name":"code","type":"keyword"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reindexing.Status != "copying" || len(reindexing.From) != 1 || reindexing.From[0] != idx || !strings.HasPrefix(reindexing.To, memoryTestProject+"._orders-") {
+		t.Fatalf("got %+v", reindexing)
+	}
+
+	if _, err := ReindexCollection(r, memoryTestProject, "orders", `{"properties":[{"name":"code","type":"long"}]}`); err == nil {
+		t.Error("expected an error reindexing a collection being reindexed")
+	}
+
+	// events can't be recorded while catching up
+	advance(t, es, "orders", "catching_up")
+	if err := Record(r, idx, `{"timestamp":"2020-01-07T10:00:00.000Z","code":3}`); err == nil {
+		t.Error("expected an error recording while catching up")
+	}
+
+	// the new index replaces the collection's, it stays queryable
+	reindexing = advance(t, es, "orders", "cleaning_up")
+	if reindexing.Total != 2 || reindexing.Copied != 2 {
+		t.Errorf("got %d copied of %d, want 2 of 2", reindexing.Copied, reindexing.Total)
+	}
+
+	mapping, err := GetMapping(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping["code"] != "keyword" {
+		t.Errorf("code is mapped as %s, want keyword", mapping["code"])
+	}
+
+	err = Record(r, idx, `{"timestamp":"2020-01-07T10:00:00.000Z","code":"A3"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(t, r, idx, 3)
+
+	// the replaced indices are deleted
+	retired := reindexing.Retired
+	advance(t, es, "orders", "done")
+	for _, i := range append(retired, reindexing.From...) {
+		if hasIndex(t, es, i) {
+			t.Errorf("the index %s isn't deleted", i)
+		}
+	}
+	assertCount(t, r, idx, 3)
+
+	progress, err := ReindexingProgress(r, memoryTestProject, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Status != "done" || progress.FinishedAt == "" {
+		t.Errorf("got %+v", progress)
+	}
+}
+
+func TestReindexCollectionFailure(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"people": {
+			`{"timestamp":"2020-01-05T10:00:00.000Z","age":"30"}`,
+			`{"timestamp":"2020-01-06T10:00:00.000Z","age":"41"}`,
+		},
+	})
+	defer restore()
+
+	es := backend.(*Elasticsearch)
+	idx := GetIndex(memoryTestProject, "people")
+
+	reindexing, err := ReindexCollection(r, memoryTestProject, "people", `{"properties":[{"name":"age","type":"long"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// recorded while copying, it can't be copied when catching up
+	err = Record(r, idx, `{"timestamp":"2020-01-07T10:00:00.000Z","age":"unknown"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advance(t, es, "people", "catching_up")
+	failed := advance(t, es, "people", "failed")
+	if !strings.Contains(failed.Error, "age") {
+		t.Errorf("got the error %s, want the event that failed", failed.Error)
+	}
+
+	// the collection keeps its index, its writes are unblocked
+	if hasIndex(t, es, reindexing.To) {
+		t.Errorf("the new index %s isn't deleted", reindexing.To)
+	}
+	err = Record(r, idx, `{"timestamp":"2020-01-08T10:00:00.000Z","age":"52"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(t, r, idx, 4)
+
+	mapping, err := GetMapping(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping["age"] != "text" {
+		t.Errorf("age is mapped as %s, want text", mapping["age"])
+	}
+
+	// it can be reindexed again
+	_, err = ReindexCollection(r, memoryTestProject, "people", `{"properties":[{"name":"age","type":"keyword"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeReindexings(t *testing.T) {
+	r, restore := useMemoryBackend(t, map[string][]string{
+		"visits": {`{"timestamp":"2020-01-05T10:00:00.000Z","page":1}`},
+	})
+	defer restore()
+
+	_, err := ReindexCollection(r, memoryTestProject, "visits", `{"properties":[{"name":"page","type":"keyword"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server restarts with the same cluster
+	restarted := NewElasticsearch(backend.(*Elasticsearch).client)
+	SetBackend(restarted)
+
+	err = ResumeReindexings(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, watching := restarted.reindexings.Load(registryIndex(memoryTestProject) + "/visits"); !watching {
+		t.Error("the reindexing isn't resumed")
+	}
+
+	advance(t, restarted, "visits", "catching_up")
+	advance(t, restarted, "visits", "cleaning_up")
+	advance(t, restarted, "visits", "done")
+
+	// the reindexings that are over aren't resumed
+	again := NewElasticsearch(restarted.client)
+	SetBackend(again)
+
+	err = ResumeReindexings(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, watching := again.reindexings.Load(registryIndex(memoryTestProject) + "/visits"); watching {
+		t.Error("a reindexing that is done is resumed")
+	}
+}
+
+func TestReindexScript(t *testing.T) {
+	if script := reindexScript([]PropertyChange{{Name: "code", Type: "keyword"}}); script != nil {
+		t.Errorf("got the script %v without conversion", script)
+	}
+
+	// the properties are parameters of the script, never part of its source
+	script := reindexScript([]PropertyChange{
+		{Name: "price", Type: "double", Conversion: "to_number"},
+		{Name: "user.name", Type: "keyword", Conversion: "rename", NewName: "user.login"},
+	})
+	assertJSON(t, script["params"], nil, `{"changes":[{"conversion":"to_number","path":["price"]},{"conversion":"rename","new_path":["user","login"],"path":["user","name"]}]}`)
+	if script["source"] != reindexConversionScript || script["lang"] != "painless" {
+		t.Errorf("got %v", script)
+	}
+}
@@ -0,0 +1,182 @@
+package elastic
+
+import (
+	"datawaves/errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type RetentionEvent struct {
+	Collection string    `json:"collection"`
+	Filters    []Filter  `json:"filters"`
+	Timeframe  Timeframe `json:"timeframe"`
+}
+
+type RetentionSearch struct {
+	FirstEvent    RetentionEvent `json:"first_event"`
+	ReturnEvent   RetentionEvent `json:"return_event"`
+	ActorProperty string         `json:"actor_property"`
+	// day, week or month
+	Interval  string    `json:"interval"`
+	Timeframe Timeframe `json:"timeframe"`
+	Timezone  string    `json:"timezone"`
+	// how many periods after the first one to report, 0 reports every period
+	// that started by now, the current one included
+	Periods int `json:"periods"`
+}
+
+// Retention groups actors in cohorts by the interval of their first event
+// and reports which fraction of each cohort did the return event in each later interval,
+// period 0 is the interval of the first event itself. Only the return events at or after
+// the actor's first event count, a return earlier in period 0 isn't a return.
+func Retention(r *http.Request, projectID, body string) ([]map[string]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var retention RetentionSearch
+	err := json.NewDecoder(strings.NewReader(body)).Decode(&retention)
+	if err != nil {
+		errors.Log(err)
+		return nil, errors.New("Error decoding request body!")
+	}
+
+	if retention.FirstEvent.Collection == "" {
+		return nil, errors.New("Missing first_event collection!")
+	}
+
+	if retention.ReturnEvent.Collection == "" {
+		return nil, errors.New("Missing return_event collection!")
+	}
+
+	for _, collection := range []string{retention.FirstEvent.Collection, retention.ReturnEvent.Collection} {
+		if err := ValidateCollection(collection); err != nil {
+			return nil, err
+		}
+	}
+
+	if retention.ActorProperty == "" {
+		return nil, errors.New("Missing actor_property!")
+	}
+
+	unit := strings.ToLower(retention.Interval)
+	if unit != "day" && unit != "week" && unit != "month" {
+		return nil, errors.New("Invalid interval, it should be day, week or month!")
+	}
+
+	if retention.Periods < 0 {
+		return nil, errors.New("Invalid periods, it should be positive!")
+	}
+
+	loc, err := GetLocation(retention.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	firstTimeframe := retention.FirstEvent.Timeframe
+	if firstTimeframe.IsEmpty() {
+		firstTimeframe = retention.Timeframe
+	}
+
+	now := time.Now()
+	from, _, err := firstTimeframe.Bounds(retention.Timezone, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// returns are looked for from the first cohort on, unless told otherwise
+	returnTimeframe := retention.ReturnEvent.Timeframe
+	if returnTimeframe.IsEmpty() && !from.IsZero() {
+		returnTimeframe = Timeframe{From: truncateTime(from.In(loc), unit).UTC().Format(timestampFormat)}
+	}
+
+	first, err := backend.ActorEvents(r.Context(), &Search{
+		Index:     GetIndex(projectID, retention.FirstEvent.Collection),
+		Filters:   retention.FirstEvent.Filters,
+		Timeframe: firstTimeframe,
+		Timezone:  retention.Timezone,
+	}, retention.ActorProperty)
+	if err != nil {
+		return nil, err
+	}
+
+	returns, err := backend.ActorEvents(r.Context(), &Search{
+		Index:     GetIndex(projectID, retention.ReturnEvent.Collection),
+		Filters:   retention.ReturnEvent.Filters,
+		Timeframe: returnTimeframe,
+		Timezone:  retention.Timezone,
+	}, retention.ActorProperty)
+	if err != nil {
+		return nil, err
+	}
+
+	// cohort start -> actors
+	cohorts := make(map[int64][]string)
+	for actor, timestamps := range first {
+		start := truncateTime(time.Unix(0, timestamps[0]*int64(time.Millisecond)).In(loc), unit)
+		cohorts[start.UnixNano()] = append(cohorts[start.UnixNano()], actor)
+	}
+
+	starts := []int64{}
+	for start := range cohorts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	results := []map[string]interface{}{}
+	for _, s := range starts {
+		start := time.Unix(0, s).In(loc)
+		actors := cohorts[s]
+
+		// period boundaries, only the ones that already started
+		bounds := []int64{}
+		for p := 0; retention.Periods == 0 || p <= retention.Periods; p++ {
+			b := addUnits(start, unit, p)
+			if b.After(now) {
+				break
+			}
+			bounds = append(bounds, b.UnixNano()/int64(time.Millisecond))
+		}
+		if len(bounds) == 0 {
+			// first events in the future
+			continue
+		}
+		end := addUnits(start, unit, len(bounds)).UnixNano() / int64(time.Millisecond)
+
+		counts := make([]int, len(bounds))
+		for _, actor := range actors {
+			// the events before the actor's first one, in period 0, aren't returns
+			firstEvent := first[actor][0]
+			seen := make(map[int]bool)
+			for _, ts := range returns[actor] {
+				if ts < firstEvent || ts >= end {
+					continue
+				}
+				p := sort.Search(len(bounds), func(k int) bool { return bounds[k] > ts }) - 1
+				if !seen[p] {
+					seen[p] = true
+					counts[p]++
+				}
+			}
+		}
+
+		values := []map[string]interface{}{}
+		for p := range bounds {
+			values = append(values, map[string]interface{}{
+				"period": p,
+				"count":  counts[p],
+				"rate":   rate(counts[p], len(actors)),
+			})
+		}
+
+		results = append(results, map[string]interface{}{
+			"start":  start.Format("2006-01-02T15:04:05.000Z07:00"),
+			"size":   len(actors),
+			"values": values,
+		})
+	}
+
+	return results, nil
+}
@@ -0,0 +1,410 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"datawaves/secrets"
+	"datawaves/util"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+	nrelasticsearch "github.com/newrelic/go-agent/v3/integrations/nrelasticsearch-v7"
+)
+
+// Clusters is the registry of the dedicated clusters and of the projects using them
+type Clusters struct {
+	// by cluster name
+	Clusters map[string]Config `json:"clusters"`
+	// project ID to cluster name
+	Projects map[string]string `json:"projects"`
+}
+
+// Router is the Backend sending each project's requests to its dedicated cluster,
+// projects without one use the default cluster.
+// Requests are routed by index, which starts with the project as in GetIndex.
+type Router struct {
+	mu       sync.RWMutex
+	fallback Backend
+	configs  map[string]Config
+	clusters map[string]Backend
+	// by project prefix of the indices
+	projects map[string]Backend
+
+	// NewBackend creates the backend of a cluster, an Elasticsearch client by default
+	NewBackend func(cfg Config) (Backend, error)
+}
+
+func NewRouter(fallback Backend) *Router {
+	return &Router{
+		fallback: fallback,
+		configs:  make(map[string]Config),
+		clusters: make(map[string]Backend),
+		projects: make(map[string]Backend),
+	}
+}
+
+// newElasticsearchBackend creates the client of a dedicated cluster,
+// in production it is traced with New Relic like the default cluster's, see LoadConfig.
+func newElasticsearchBackend(cfg Config) (Backend, error) {
+	if cfg.WrapTransport == nil && util.IsProduction() {
+		cfg.WrapTransport = nrelasticsearch.NewRoundTripper
+	}
+
+	client, transport, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	es := NewElasticsearch(client)
+	es.transport = transport
+
+	return es, nil
+}
+
+// Reload replaces the registry, clusters whose config didn't change keep their client
+// and the idle connections of the others are closed.
+// Nothing changes when a cluster can't be created or a project uses an unknown cluster.
+func (r *Router) Reload(registry Clusters) error {
+	newBackend := r.NewBackend
+	if newBackend == nil {
+		newBackend = newElasticsearchBackend
+	}
+
+	r.mu.RLock()
+	configs := r.configs
+	current := r.clusters
+	r.mu.RUnlock()
+
+	clusters := make(map[string]Backend)
+	for name, cfg := range registry.Clusters {
+		if b, ok := current[name]; ok && reflect.DeepEqual(configs[name], cfg) {
+			clusters[name] = b
+			continue
+		}
+
+		b, err := newBackend(cfg)
+		if err != nil {
+			errors.Log(err, "Error creating the client of cluster "+name+".")
+			return errors.New(fmt.Sprintf("Error creating the client of cluster %s!", name))
+		}
+		clusters[name] = b
+	}
+
+	projects := make(map[string]Backend)
+	for projectID, name := range registry.Projects {
+		b, ok := clusters[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Project %s uses the unknown cluster %s!", projectID, name))
+		}
+		projects[projectPrefix(projectID)] = b
+	}
+
+	r.mu.Lock()
+	r.configs = registry.Clusters
+	r.clusters = clusters
+	r.projects = projects
+	r.mu.Unlock()
+
+	// requests still running on the replaced clusters keep their connections
+	for name, b := range current {
+		if clusters[name] == b {
+			continue
+		}
+		if closer, ok := b.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+
+	return nil
+}
+
+// Project returns the backend of the project
+func (r *Router) Project(projectID string) Backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if b, ok := r.projects[projectPrefix(projectID)]; ok {
+		return b
+	}
+	return r.fallback
+}
+
+// Index returns the backend of the project the index belongs to,
+// for legacy indices without separator the longest project prefix wins.
+func (r *Router) Index(idx string) Backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if i := strings.Index(idx, indexSeparator); i > 0 {
+		if b, ok := r.projects[idx[:i]]; ok {
+			return b
+		}
+		return r.fallback
+	}
+
+	b := r.fallback
+	longest := 0
+	for prefix, pb := range r.projects {
+		if len(prefix) > longest && strings.HasPrefix(idx, prefix) {
+			b = pb
+			longest = len(prefix)
+		}
+	}
+
+	return b
+}
+
+func (r *Router) Count(ctx context.Context, search *Search) (interface{}, error) {
+	return r.Index(search.Index).Count(ctx, search)
+}
+
+func (r *Router) Aggregate(ctx context.Context, op string, search *Search) (interface{}, error) {
+	return r.Index(search.Index).Aggregate(ctx, op, search)
+}
+
+func (r *Router) Percentiles(ctx context.Context, search *Search) (map[string]interface{}, error) {
+	return r.Index(search.Index).Percentiles(ctx, search)
+}
+
+func (r *Router) SelectUnique(ctx context.Context, search *Search) ([]interface{}, error) {
+	return r.Index(search.Index).SelectUnique(ctx, search)
+}
+
+func (r *Router) MultiAnalysis(ctx context.Context, search *Search, analyses map[string]Analysis) (interface{}, error) {
+	return r.Index(search.Index).MultiAnalysis(ctx, search, analyses)
+}
+
+func (r *Router) ActorEvents(ctx context.Context, search *Search, actorProperty string) (map[string][]int64, error) {
+	return r.Index(search.Index).ActorEvents(ctx, search, actorProperty)
+}
+
+func (r *Router) Record(ctx context.Context, idx, id string, doc map[string]interface{}) error {
+	return r.Index(idx).Record(ctx, idx, id, doc)
+}
+
+// RecordBulk splits the bulk by cluster, keeping the order of the actions of each one
+func (r *Router) RecordBulk(ctx context.Context, body string) ([]BulkItem, error) {
+	actions, err := parseBulk(body)
+	if err != nil {
+		return nil, err
+	}
+
+	order := []Backend{}
+	bulks := make(map[Backend]*strings.Builder)
+	// positions of the actions of every backend in the bulk
+	positions := make(map[Backend][]int)
+	for i, action := range actions {
+		b := r.Index(action.index)
+
+		bulk, ok := bulks[b]
+		if !ok {
+			bulk = &strings.Builder{}
+			bulks[b] = bulk
+			order = append(order, b)
+		}
+		bulk.WriteString(action.lines)
+		positions[b] = append(positions[b], i)
+	}
+
+	items := make([]BulkItem, len(actions))
+	for _, b := range order {
+		result, err := b.RecordBulk(ctx, bulks[b].String())
+		if err != nil {
+			return nil, err
+		}
+
+		for j, item := range result {
+			if j < len(positions[b]) {
+				items[positions[b][j]] = item
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func (r *Router) GetMapping(ctx context.Context, idx string) (map[string]string, error) {
+	return r.Index(idx).GetMapping(ctx, idx)
+}
+
+func (r *Router) DescribeCollection(ctx context.Context, idx string) (*CollectionDescription, error) {
+	return r.Index(idx).DescribeCollection(ctx, idx)
+}
+
+func (r *Router) RegisterCollection(ctx context.Context, projectID, collection string) (*Collection, error) {
+	return r.Project(projectID).RegisterCollection(ctx, projectID, collection)
+}
+
+func (r *Router) Collections(ctx context.Context, projectID string) ([]Collection, error) {
+	return r.Project(projectID).Collections(ctx, projectID)
+}
+
+func (r *Router) SetSchema(ctx context.Context, projectID, collection string, schema *Schema) (*Collection, error) {
+	return r.Project(projectID).SetSchema(ctx, projectID, collection, schema)
+}
+
+func (r *Router) Schema(ctx context.Context, idx string) (*Schema, error) {
+	return r.Index(idx).Schema(ctx, idx)
+}
+
+func (r *Router) ReindexCollection(ctx context.Context, projectID, collection string, changes []PropertyChange) (*Reindexing, error) {
+	return r.Project(projectID).ReindexCollection(ctx, projectID, collection, changes)
+}
+
+func (r *Router) ReindexingProgress(ctx context.Context, projectID, collection string) (*Reindexing, error) {
+	return r.Project(projectID).ReindexingProgress(ctx, projectID, collection)
+}
+
+// ResumeReindexings resumes the reindexings of every cluster
+func (r *Router) ResumeReindexings(ctx context.Context) error {
+	r.mu.RLock()
+	backends := []Backend{r.fallback}
+	for _, b := range r.clusters {
+		backends = append(backends, b)
+	}
+	r.mu.RUnlock()
+
+	for _, b := range backends {
+		resumer, ok := b.(interface {
+			ResumeReindexings(ctx context.Context) error
+		})
+		if !ok {
+			continue
+		}
+
+		err := resumer.ResumeReindexings(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateCollections migrates the legacy indices of every cluster
+func (r *Router) MigrateCollections(ctx context.Context, projectIDs []string) (*CollectionMigration, error) {
+	r.mu.RLock()
+	backends := []Backend{r.fallback}
+	for _, b := range r.clusters {
+		backends = append(backends, b)
+	}
+	r.mu.RUnlock()
+
+	migration := &CollectionMigration{
+		Migrated:  make(map[string]string),
+		Ambiguous: make(map[string][]string),
+		Skipped:   make(map[string]string),
+	}
+
+	for _, b := range backends {
+		migrator, ok := b.(interface {
+			MigrateCollections(ctx context.Context, projectIDs []string) (*CollectionMigration, error)
+		})
+		if !ok {
+			continue
+		}
+
+		m, err := migrator.MigrateCollections(ctx, projectIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range m.Migrated {
+			migration.Migrated[k] = v
+		}
+		for k, v := range m.Ambiguous {
+			migration.Ambiguous[k] = v
+		}
+		for k, v := range m.Skipped {
+			migration.Skipped[k] = v
+		}
+	}
+
+	return migration, nil
+}
+
+// Indices returns the names of the indices of every cluster
+func (r *Router) Indices(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	backends := []Backend{r.fallback}
+	for _, b := range r.clusters {
+		backends = append(backends, b)
+	}
+	r.mu.RUnlock()
+
+	indices := []string{}
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		lister, ok := b.(interface {
+			Indices(ctx context.Context) ([]string, error)
+		})
+		if !ok {
+			continue
+		}
+
+		names, err := lister.Indices(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				indices = append(indices, name)
+			}
+		}
+	}
+
+	return indices, nil
+}
+
+// LoadClusters returns the environment's registry, in production it is the
+// elasticsearch_clusters secret, elsewhere the elasticsearch_testing_clusters
+// environment variable, as json. No registry means every project uses the default cluster.
+func LoadClusters() (Clusters, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var registry Clusters
+	var data string
+
+	if util.IsProduction() {
+		s, err := secrets.Get("elasticsearch_clusters")
+		if err != nil {
+			return registry, err
+		}
+		data = s
+	} else {
+		data = os.Getenv("elasticsearch_testing_clusters")
+	}
+
+	if strings.TrimSpace(data) == "" {
+		return registry, nil
+	}
+
+	err := json.Unmarshal([]byte(data), &registry)
+	if err != nil {
+		errors.Log(err, "Decoding error of the clusters registry.")
+		return registry, errors.New("Invalid clusters registry!")
+	}
+
+	return registry, nil
+}
+
+// ReloadClusters reloads the registry of the Router set by Connect
+func ReloadClusters() error {
+	router, ok := backend.(*Router)
+	if !ok {
+		return errors.New("The backend is not a Router!")
+	}
+
+	registry, err := LoadClusters()
+	if err != nil {
+		return err
+	}
+
+	return router.Reload(registry)
+}
@@ -0,0 +1,204 @@
+package elastic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// clusterBackend is a memory cluster of the router that tells when its idle connections are closed
+type clusterBackend struct {
+	Backend
+	name   string
+	closed bool
+}
+
+func (b *clusterBackend) CloseIdleConnections() {
+	b.closed = true
+}
+
+// useRouter makes a router of memory clusters the backend until the returned function is called,
+// the clusters it creates are named after their first address
+func useRouter(t *testing.T) (*Router, *http.Request, func()) {
+	fallback, _, err := NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewRouter(&clusterBackend{Backend: fallback, name: "default"})
+	router.NewBackend = func(cfg Config) (Backend, error) {
+		es, _, err := NewMemoryBackend()
+		if err != nil {
+			return nil, err
+		}
+		return &clusterBackend{Backend: es, name: cfg.Addresses[0]}, nil
+	}
+
+	previous := backend
+	SetBackend(router)
+	SetTimestampWindow(0, 0)
+	restore := func() {
+		SetBackend(previous)
+		SetTimestampWindow(DefaultTimestampPast, DefaultTimestampFuture)
+	}
+
+	return router, httptest.NewRequest(http.MethodPost, "/", nil), restore
+}
+
+// clusterName returns the name of the router's cluster
+func clusterName(b Backend) string {
+	if c, ok := b.(*clusterBackend); ok {
+		return c.name
+	}
+	return "unknown"
+}
+
+var testClusters = Clusters{
+	Clusters: map[string]Config{
+		"a": {Addresses: []string{"http://a"}},
+		"b": {Addresses: []string{"http://b"}},
+	},
+	Projects: map[string]string{"ab": "a", "ab-c": "b"},
+}
+
+func TestRouterProjects(t *testing.T) {
+	router, r, restore := useRouter(t)
+	defer restore()
+
+	err := router.Reload(testClusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  Backend
+		want string
+	}{
+		{"project", router.Project("ab"), "http://a"},
+		{"project with dashes", router.Project("AB-C"), "http://b"},
+		{"project without cluster", router.Project("xy"), "default"},
+		{"index", router.Index("ab.cdef"), "http://a"},
+		{"index of the other project", router.Index("abc.def"), "http://b"},
+		{"registry", router.Index(registryIndex("abc")), "http://b"},
+		// the legacy index of abc would also match ab's prefix
+		{"legacy index", router.Index("abcdef"), "http://b"},
+		{"legacy index of the shorter prefix", router.Index("abxyz"), "http://a"},
+		{"legacy index without cluster", router.Index("xyzabc"), "default"},
+		{"index of a project without cluster", router.Index("a.b"), "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterName(tt.got); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// the events are recorded in the cluster of their project
+	err = Record(r, "ab.clicks", `{"timestamp":"2020-01-05T10:00:00.000Z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.Project("ab").Count(context.Background(), &Search{Index: "ab.clicks"})
+	assertJSON(t, got, err, `1`)
+	if _, err := router.fallback.Count(context.Background(), &Search{Index: "ab.clicks"}); err == nil {
+		t.Error("expected the default cluster not to have the events")
+	}
+}
+
+func TestRouterRecordBulk(t *testing.T) {
+	router, _, restore := useRouter(t)
+	defer restore()
+
+	err := router.Reload(testClusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := router.RecordBulk(context.Background(), `{"create":{"_index":"ab.clicks","_id":"1"}}
+{"datawaves":{"timestamp":"2020-01-05T10:00:00.000Z"}}
+{"create":{"_index":"xy.clicks","_id":"2"}}
+{"datawaves":{"timestamp":"2020-01-05T10:00:00.000Z"}}
+{"create":{"_index":"ab.clicks","_id":"3"}}
+{"datawaves":{"timestamp":"2020-01-05T10:00:00.000Z"}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the items keep the order of the bulk
+	for i, want := range []string{"1", "2", "3"} {
+		if items[i].ID != want || items[i].Failed() {
+			t.Errorf("got the item %+v, want %s created", items[i], want)
+		}
+	}
+
+	got, err := router.Project("ab").Count(context.Background(), &Search{Index: "ab.clicks"})
+	assertJSON(t, got, err, `2`)
+	got, err = router.fallback.Count(context.Background(), &Search{Index: "xy.clicks"})
+	assertJSON(t, got, err, `1`)
+}
+
+func TestRouterReload(t *testing.T) {
+	router, _, restore := useRouter(t)
+	defer restore()
+
+	err := router.Reload(testClusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := router.Project("ab").(*clusterBackend)
+	b := router.Project("ab-c").(*clusterBackend)
+
+	// the unchanged cluster keeps its client, the other one is replaced
+	err = router.Reload(Clusters{
+		Clusters: map[string]Config{
+			"a": {Addresses: []string{"http://a"}},
+			"b": {Addresses: []string{"http://b2"}},
+		},
+		Projects: map[string]string{"ab": "a", "ab-c": "b", "xy": "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if router.Project("ab") != a || a.closed {
+		t.Error("the unchanged cluster is replaced")
+	}
+	if got := clusterName(router.Project("ab-c")); got != "http://b2" {
+		t.Errorf("got %s, want http://b2", got)
+	}
+	if !b.closed {
+		t.Error("the idle connections of the replaced cluster aren't closed")
+	}
+	if router.Project("xy") != a {
+		t.Error("the project isn't moved to its cluster")
+	}
+
+	// nothing changes with an unknown cluster
+	err = router.Reload(Clusters{
+		Clusters: map[string]Config{"a": {Addresses: []string{"http://a"}}},
+		Projects: map[string]string{"ab": "c"},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown cluster")
+	}
+	if got := clusterName(router.Project("ab-c")); got != "http://b2" {
+		t.Errorf("got %s, want http://b2", got)
+	}
+
+	// the projects without cluster go back to the default one
+	err = router.Reload(Clusters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := clusterName(router.Project("ab")); got != "default" {
+		t.Errorf("got %s, want default", got)
+	}
+	if !a.closed {
+		t.Error("the idle connections of the removed cluster aren't closed")
+	}
+}
@@ -0,0 +1,664 @@
+package elastic
+
+import (
+	"context"
+	"datawaves/errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// DefaultSchemaTTL is how long the Elasticsearch backend caches the schema of a collection
+const DefaultSchemaTTL = time.Minute
+
+// schema property types and their mapping, text has a keyword subfield like dynamic mappings
+var schemaTypes = map[string]map[string]interface{}{
+	"keyword": {"type": "keyword", "ignore_above": 256},
+	"text": {
+		"type":   "text",
+		"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+	},
+	"long":    {"type": "long"},
+	"double":  {"type": "double"},
+	"boolean": {"type": "boolean"},
+	"date":    {"type": "date"},
+}
+
+var schemaTypeNames = map[string]string{
+	"keyword": "a string",
+	"text":    "a string",
+	"long":    "an integer",
+	"double":  "a number",
+	"boolean": "a boolean",
+	"date":    "a date",
+}
+
+// Schema is the types of the properties of a collection, its events are checked
+// against it when recorded and its index is mapped from it.
+type Schema struct {
+	Properties []SchemaProperty `json:"properties"`
+	// Coerce converts values to the type of their property when possible, like "12" to 12,
+	// instead of rejecting the event
+	Coerce bool `json:"coerce"`
+	// Strict rejects events with properties that are not in the schema
+	Strict bool `json:"strict"`
+}
+
+type SchemaProperty struct {
+	// Name is the dotted path of the property, like user.address.city
+	Name string `json:"name"`
+	// Type is keyword, text, long, double, boolean or date
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// Validate checks the schema can map an index
+func (schema *Schema) Validate() error {
+	if len(schema.Properties) == 0 {
+		return errors.New("The schema has no properties!")
+	}
+
+	names := make(map[string]bool)
+	for _, p := range schema.Properties {
+		err := validateProperty(p.Name, p.Type)
+		if err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return errors.New(fmt.Sprintf("Property %s is in the schema twice!", p.Name))
+		}
+		names[p.Name] = true
+	}
+
+	// a property can't be an object of other properties
+	for _, p := range schema.Properties {
+		parts := strings.Split(p.Name, ".")
+		for i := 1; i < len(parts); i++ {
+			parent := strings.Join(parts[:i], ".")
+			if names[parent] {
+				return errors.New(fmt.Sprintf("Property %s can't have the property %s, it isn't an object!", parent, p.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateProperty checks the dotted name of a property and that the type is a schema type
+func validateProperty(name, typ string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return errors.New(fmt.Sprintf("Invalid property name \"%s\"!", name))
+	}
+	if name == "datawaves" || strings.HasPrefix(name, "datawaves.") {
+		return errors.New("The datawaves property is reserved!")
+	}
+	if _, ok := schemaTypes[typ]; !ok {
+		return errors.New(fmt.Sprintf("Unknown type \"%s\" of property %s, it should be keyword, text, long, double, boolean or date!", typ, name))
+	}
+	return nil
+}
+
+// mapping returns the index mapping of the properties, other properties are mapped dynamically
+func (schema *Schema) mapping() map[string]interface{} {
+	properties := make(map[string]interface{})
+
+	for _, p := range schema.Properties {
+		props := properties
+		parts := strings.Split(p.Name, ".")
+		for _, part := range parts[:len(parts)-1] {
+			obj, ok := props[part].(map[string]interface{})
+			if !ok {
+				obj = map[string]interface{}{"properties": make(map[string]interface{})}
+				props[part] = obj
+			}
+			props = obj["properties"].(map[string]interface{})
+		}
+		props[parts[len(parts)-1]] = schemaTypes[p.Type]
+	}
+
+	return map[string]interface{}{"properties": properties}
+}
+
+// Conform checks the event against the schema, coercing its values in place when allowed.
+// It returns why the event doesn't conform by property, nil when it does.
+func (schema *Schema) Conform(doc map[string]interface{}) map[string]string {
+	problems := make(map[string]string)
+
+	types := make(map[string]string)
+	for _, p := range schema.Properties {
+		types[p.Name] = p.Type
+	}
+
+	schema.conform(doc, "", types, problems)
+
+	for _, p := range schema.Properties {
+		if p.Required && problems[p.Name] == "" && !hasValue(doc, p.Name) {
+			problems[p.Name] = "is required"
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+func (schema *Schema) conform(doc map[string]interface{}, prefix string, types map[string]string, problems map[string]string) {
+	for k, v := range doc {
+		path := prefix + k
+		if path == "datawaves" || v == nil {
+			continue
+		}
+
+		if typ, ok := types[path]; ok {
+			value, problem := conformValue(v, typ, schema.Coerce)
+			if problem != "" {
+				problems[path] = problem
+				continue
+			}
+			doc[k] = value
+			continue
+		}
+
+		// objects of properties in the schema
+		isParent := false
+		for name := range types {
+			if strings.HasPrefix(name, path+".") {
+				isParent = true
+				break
+			}
+		}
+
+		if isParent {
+			objects := []interface{}{v}
+			if arr, ok := v.([]interface{}); ok {
+				objects = arr
+			}
+			for _, o := range objects {
+				obj, ok := o.(map[string]interface{})
+				if !ok {
+					if o != nil {
+						problems[path] = "should be an object, got " + describeValue(o)
+					}
+					continue
+				}
+				schema.conform(obj, path+".", types, problems)
+			}
+			continue
+		}
+
+		if schema.Strict {
+			problems[path] = "is not in the schema"
+		}
+	}
+}
+
+// conformValue returns the value as the type, every item of arrays
+func conformValue(v interface{}, typ string, coerce bool) (interface{}, string) {
+	if arr, ok := v.([]interface{}); ok {
+		values := make([]interface{}, len(arr))
+		for i, item := range arr {
+			value, problem := conformValue(item, typ, coerce)
+			if problem != "" {
+				return nil, problem
+			}
+			values[i] = value
+		}
+		return values, ""
+	}
+
+	if v == nil {
+		return nil, ""
+	}
+
+	problem := "should be " + schemaTypeNames[typ] + ", got " + describeValue(v)
+
+	switch typ {
+	case "keyword", "text":
+		switch x := v.(type) {
+		case string:
+			return x, ""
+		case float64:
+			if coerce {
+				return strconv.FormatFloat(x, 'f', -1, 64), ""
+			}
+		case bool:
+			if coerce {
+				return strconv.FormatBool(x), ""
+			}
+		}
+
+	case "long":
+		switch x := v.(type) {
+		case float64:
+			if x == math.Trunc(x) {
+				return x, ""
+			}
+		case string:
+			if coerce {
+				f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+				if err == nil && f == math.Trunc(f) {
+					return f, ""
+				}
+			}
+		}
+
+	case "double":
+		switch x := v.(type) {
+		case float64:
+			return x, ""
+		case string:
+			if coerce {
+				f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+				if err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+					return f, ""
+				}
+			}
+		}
+
+	case "boolean":
+		switch x := v.(type) {
+		case bool:
+			return x, ""
+		case string:
+			if coerce && (x == "true" || x == "false") {
+				return x == "true", ""
+			}
+		}
+
+	case "date":
+		switch x := v.(type) {
+		case string:
+			if _, ok := parseDate(x); ok {
+				return x, ""
+			}
+		case float64:
+			// epoch millis
+			if x == math.Trunc(x) {
+				if coerce {
+					return time.Unix(0, int64(x)*int64(time.Millisecond)).UTC().Format(timestampFormat), ""
+				}
+				return x, ""
+			}
+		}
+	}
+
+	return nil, problem
+}
+
+// date formats of the elasticsearch strict_date_optional_time format
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func describeValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// hasValue reports whether the doc has a value at the dotted path
+func hasValue(doc map[string]interface{}, path string) bool {
+	v, ok := doc[path]
+	if ok {
+		if arr, isArray := v.([]interface{}); isArray {
+			for _, item := range arr {
+				if item != nil {
+					return true
+				}
+			}
+			return false
+		}
+		return v != nil
+	}
+
+	i := strings.Index(path, ".")
+	if i < 0 {
+		return false
+	}
+
+	objects := []interface{}{doc[path[:i]]}
+	if arr, ok := doc[path[:i]].([]interface{}); ok {
+		objects = arr
+	}
+	for _, o := range objects {
+		if obj, ok := o.(map[string]interface{}); ok && hasValue(obj, path[i+1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// conformError is the message of the problems of an event, sorted by property
+func conformError(problems map[string]string) string {
+	names := []string{}
+	for name := range problems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := []string{}
+	for _, name := range names {
+		messages = append(messages, name+" "+problems[name])
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+// conformEvent checks the event against the schema of its index, if it has one
+func conformEvent(ctx context.Context, idx string, doc map[string]interface{}) error {
+	schema, err := backend.Schema(ctx, idx)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return nil
+	}
+
+	problems := schema.Conform(doc)
+	if problems != nil {
+		return errors.New("Invalid event: " + conformError(problems) + "!")
+	}
+
+	return nil
+}
+
+// conformBulk checks the events of the bulk against the schemas of their indices,
+// coercing them in place. It returns why events don't conform by position in the bulk.
+func conformBulk(ctx context.Context, events []bulkEvent) (map[int]string, error) {
+	schemas := make(map[string]*Schema)
+	invalid := make(map[int]string)
+
+	for i, event := range events {
+		if event.doc == nil {
+			invalid[i] = "the event is not a json object"
+			continue
+		}
+
+		schema, ok := schemas[event.index]
+		if !ok {
+			var err error
+			schema, err = backend.Schema(ctx, event.index)
+			if err != nil {
+				return nil, err
+			}
+			schemas[event.index] = schema
+		}
+		if schema == nil {
+			continue
+		}
+
+		problems := schema.Conform(event.doc)
+		if problems != nil {
+			invalid[i] = conformError(problems)
+		}
+	}
+
+	return invalid, nil
+}
+
+// SetSchema sets the schema of the collection, registering it if needed.
+// Its index is created with the schema's mapping or, when it exists, the new properties
+// are added to its mapping. The type of a property can't be changed this way.
+func SetSchema(r *http.Request, projectID, collection, body string) (*Collection, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	err := ValidateCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireMigrated(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema Schema
+	err = json.NewDecoder(strings.NewReader(body)).Decode(&schema)
+	if err != nil {
+		errors.Log(err)
+		return nil, errors.New("Error decoding request body!")
+	}
+
+	err = schema.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := backend.SetSchema(r.Context(), projectID, collection, &schema)
+	if err != nil {
+		return nil, err
+	}
+	registered.Store(c.Index, true)
+
+	return c, nil
+}
+
+func (es *Elasticsearch) SetSchema(ctx context.Context, projectID, collection string, schema *Schema) (*Collection, error) {
+	c, err := es.RegisterCollection(ctx, projectID, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	// the mapping would be lost when the new index replaces the current one
+	if c.Reindexing != nil && c.Reindexing.Running() {
+		return nil, errors.New("The collection is being reindexed, its schema can be set once it is done!")
+	}
+
+	err = es.putMapping(ctx, c.Index, schema.mapping())
+	if err != nil {
+		return nil, err
+	}
+	es.mappings.invalidate(c.Index)
+
+	c.Schema = schema
+	err = es.saveCollection(ctx, projectID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	es.schemas.set(c.Index, schema)
+
+	return c, nil
+}
+
+// putMapping adds the properties to the mapping of the index, creating it when missing
+func (es *Elasticsearch) putMapping(ctx context.Context, idx string, mapping map[string]interface{}) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	b, err := json.Marshal(mapping)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return errors.New("Error encoding mapping!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndicesPutMappingRequest{
+		Index: []string{idx},
+		Body:  strings.NewReader(string(b)),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Mapping: %s.\n Response: %v.\n", idx, b, res))
+		return errors.New("Error mapping collection!")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return es.createIndex(ctx, idx, mapping)
+	}
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Mapping: %s.\n Response: %v.\n", idx, b, res)))
+		if res.StatusCode == http.StatusBadRequest {
+			return errors.New("The schema conflicts with the types of the collection's properties!")
+		}
+		return errors.New("Failed to map collection!")
+	}
+
+	return nil
+}
+
+// createIndex creates the index with the mapping
+func (es *Elasticsearch) createIndex(ctx context.Context, idx string, mapping map[string]interface{}) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	b, err := json.Marshal(map[string]interface{}{"mappings": mapping})
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Encoding error. Index: %s.\n", idx))
+		return errors.New("Error encoding mapping!")
+	}
+
+	// Set up the request object.
+	req := esapi.IndicesCreateRequest{
+		Index: idx,
+		Body:  strings.NewReader(string(b)),
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Response: %v.\n", idx, b, res))
+		return errors.New("Error creating collection!")
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Response: %v.\n", idx, b, res)))
+		return errors.New("Failed to create collection!")
+	}
+
+	return nil
+}
+
+// Schema returns the schema of the collection of the index, nil when it has none.
+// It is cached for the schema TTL.
+func (es *Elasticsearch) Schema(ctx context.Context, idx string) (*Schema, error) {
+	if schema, ok := es.schemas.get(idx); ok {
+		return schema, nil
+	}
+
+	schema, err := es.fetchSchema(ctx, idx)
+	if err != nil {
+		return nil, err
+	}
+	es.schemas.set(idx, schema)
+
+	return schema, nil
+}
+
+func (es *Elasticsearch) fetchSchema(ctx context.Context, idx string) (*Schema, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	i := strings.Index(idx, indexSeparator)
+	if i <= 0 || ValidateCollection(idx[i+1:]) != nil {
+		// legacy or internal index
+		return nil, nil
+	}
+	registry := registryIndex(idx[:i])
+
+	// Set up the request object.
+	req := esapi.GetRequest{
+		Index:      registry,
+		DocumentID: idx[i+1:],
+	}
+
+	// Perform the request with the client.
+	res, err := req.Do(ctx, es.client)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Response: %v.\n", idx, res))
+		return nil, errors.New("Error getting schema!")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		// not registered yet
+		return nil, nil
+	}
+
+	if res.IsError() {
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Response: %v.\n", idx, res)))
+		return nil, errors.New("Failed to get schema!")
+	}
+
+	var rr struct {
+		Source Collection `json:"_source"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rr)
+	if err != nil {
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Response: %v.\n", idx, res))
+		return nil, errors.New("Error decoding response!")
+	}
+
+	return rr.Source.Schema, nil
+}
+
+// schemaCache caches the schemas of the indices, nil for the ones without
+type schemaCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]schemaEntry
+}
+
+type schemaEntry struct {
+	schema  *Schema
+	fetched time.Time
+}
+
+func newSchemaCache(ttl time.Duration) *schemaCache {
+	return &schemaCache{ttl: ttl, entries: make(map[string]schemaEntry)}
+}
+
+func (c *schemaCache) get(idx string) (*Schema, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[idx]
+	if !ok || time.Since(entry.fetched) >= c.ttl {
+		return nil, false
+	}
+	return entry.schema, true
+}
+
+func (c *schemaCache) set(idx string, schema *Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl > 0 {
+		c.entries[idx] = schemaEntry{schema: schema, fetched: time.Now()}
+	}
+}
@@ -0,0 +1,181 @@
+package elastic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConformValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		typ     string
+		coerce  bool
+		want    interface{}
+		problem string
+	}{
+		{"keyword", "a", "keyword", false, "a", ""},
+		{"keyword from number", 12.5, "keyword", true, "12.5", ""},
+		{"keyword from boolean", true, "text", true, "true", ""},
+		{"keyword from number without coercion", 12.0, "keyword", false, nil, "should be a string, got 12"},
+		{"long", 12.0, "long", false, 12.0, ""},
+		{"long with decimals", 12.5, "long", true, nil, "should be an integer, got 12.5"},
+		{"long from string", " 12 ", "long", true, 12.0, ""},
+		{"long from string without coercion", "12", "long", false, nil, "should be an integer, got \"12\""},
+		{"long from decimal string", "12.5", "long", true, nil, "should be an integer, got \"12.5\""},
+		{"double", 12.5, "double", false, 12.5, ""},
+		{"double from string", "12.5", "double", true, 12.5, ""},
+		{"double from NaN", "NaN", "double", true, nil, "should be a number, got \"NaN\""},
+		{"boolean", false, "boolean", false, false, ""},
+		{"boolean from string", "true", "boolean", true, true, ""},
+		{"boolean from other string", "yes", "boolean", true, nil, "should be a boolean, got \"yes\""},
+		{"date", "2020-01-05T10:00:00.000Z", "date", false, "2020-01-05T10:00:00.000Z", ""},
+		{"date without time", "2020-01-05", "date", false, "2020-01-05", ""},
+		{"invalid date", "yesterday", "date", true, nil, "should be a date, got \"yesterday\""},
+		{"date from epoch millis", 1578218400000.0, "date", false, 1578218400000.0, ""},
+		{"date coerced from epoch millis", 1578218400000.0, "date", true, "2020-01-05T10:00:00.000Z", ""},
+		{"object", map[string]interface{}{}, "keyword", true, nil, "should be a string, got an object"},
+		{"array", []interface{}{"1", 2.0}, "long", true, []interface{}{1.0, 2.0}, ""},
+		{"array with invalid item", []interface{}{1.0, "a"}, "long", true, nil, "should be an integer, got \"a\""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problem := conformValue(tt.value, tt.typ, tt.coerce)
+			if problem != tt.problem {
+				t.Errorf("got the problem %q, want %q", problem, tt.problem)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConform(t *testing.T) {
+	schema := &Schema{
+		Properties: []SchemaProperty{
+			{Name: "price", Type: "double", Required: true},
+			{Name: "user.id", Type: "keyword", Required: true},
+			{Name: "user.age", Type: "long"},
+		},
+		Coerce: true,
+	}
+	strict := *schema
+	strict.Strict = true
+
+	tests := []struct {
+		name     string
+		schema   *Schema
+		doc      map[string]interface{}
+		want     map[string]interface{}
+		problems map[string]string
+	}{
+		{
+			"conforms",
+			schema,
+			map[string]interface{}{"price": "10", "user": map[string]interface{}{"id": 7.0}, "other": true},
+			map[string]interface{}{"price": 10.0, "user": map[string]interface{}{"id": "7"}, "other": true},
+			nil,
+		},
+		{
+			"objects of an array",
+			schema,
+			map[string]interface{}{"price": 1.0, "user": []interface{}{map[string]interface{}{"id": "a"}, map[string]interface{}{"age": "3"}}},
+			map[string]interface{}{"price": 1.0, "user": []interface{}{map[string]interface{}{"id": "a"}, map[string]interface{}{"age": 3.0}}},
+			nil,
+		},
+		{
+			"missing required properties",
+			schema,
+			map[string]interface{}{"user": map[string]interface{}{"age": 30.0}},
+			nil,
+			map[string]string{"price": "is required", "user.id": "is required"},
+		},
+		{
+			"null required property",
+			schema,
+			map[string]interface{}{"price": nil, "user": map[string]interface{}{"id": "a"}},
+			nil,
+			map[string]string{"price": "is required"},
+		},
+		{
+			"invalid required property",
+			schema,
+			map[string]interface{}{"price": "free", "user": map[string]interface{}{"id": "a"}},
+			nil,
+			map[string]string{"price": "should be a number, got \"free\""},
+		},
+		{
+			"not an object",
+			schema,
+			map[string]interface{}{"price": 1.0, "user": "a"},
+			nil,
+			map[string]string{"user": "should be an object, got \"a\"", "user.id": "is required"},
+		},
+		{
+			"unknown properties",
+			&strict,
+			map[string]interface{}{"price": 1.0, "user": map[string]interface{}{"id": "a", "name": "b"}, "other": true},
+			nil,
+			map[string]string{"user.name": "is not in the schema", "other": "is not in the schema"},
+		},
+		{
+			"datawaves properties",
+			&strict,
+			map[string]interface{}{"price": 1.0, "user": map[string]interface{}{"id": "a"}, "datawaves": map[string]interface{}{"id": "x"}},
+			map[string]interface{}{"price": 1.0, "user": map[string]interface{}{"id": "a"}, "datawaves": map[string]interface{}{"id": "x"}},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.schema.Conform(tt.doc)
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("got the problems %v, want %v", problems, tt.problems)
+			}
+			if tt.want != nil && !reflect.DeepEqual(tt.doc, tt.want) {
+				t.Errorf("got %v, want %v", tt.doc, tt.want)
+			}
+		})
+	}
+}
+
+func TestConformBulk(t *testing.T) {
+	r, restore := useMemoryBackend(t, nil)
+	defer restore()
+
+	_, err := SetSchema(r, memoryTestProject, "orders", `{"properties":[{"name":"price","type":"double","required":true}],"coerce":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []bulkEvent{
+		{index: GetIndex(memoryTestProject, "orders"), doc: map[string]interface{}{"price": "10"}},
+		{index: GetIndex(memoryTestProject, "orders"), doc: map[string]interface{}{"price": "free"}},
+		{index: GetIndex(memoryTestProject, "orders"), doc: nil},
+		// without schema
+		{index: GetIndex(memoryTestProject, "clicks"), doc: map[string]interface{}{"price": "free"}},
+	}
+
+	invalid, err := conformBulk(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]string{
+		1: "price should be a number, got \"free\"",
+		2: "the event is not a json object",
+	}
+	if !reflect.DeepEqual(invalid, want) {
+		t.Errorf("got %v, want %v", invalid, want)
+	}
+	if events[0].doc["price"] != 10.0 {
+		t.Errorf("got the price %#v, want it coerced", events[0].doc["price"])
+	}
+	if events[3].doc["price"] != "free" {
+		t.Errorf("got the price %#v, want it unchanged", events[3].doc["price"])
+	}
+}
@@ -1,6 +1,7 @@
 package elastic
 
 import (
+	"context"
 	"datawaves/errors"
 	"fmt"
 	"net/http"
@@ -14,9 +15,7 @@ import (
 func SelectUnique(r *http.Request, idx, body string) ([]interface{}, error) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	values := []interface{}{}
-	valuesMap := make(map[interface{}]bool)
 	var search Search
-	op := "select_unique"
 	err := json.NewDecoder(strings.NewReader(body)).Decode(&search)
 	if err != nil {
 		errors.Log(err)
@@ -30,7 +29,22 @@ func SelectUnique(r *http.Request, idx, body string) ([]interface{}, error) {
 
 	search.Filters = append(search.Filters, Filter{PropertyName: search.TargetProperty, Operator: "exists", PropertyValue: "true"})
 
-	query := search.GetQuery(op)
+	return backend.SelectUnique(r.Context(), &search)
+}
+
+func (es *Elasticsearch) SelectUnique(ctx context.Context, search *Search) ([]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	values := []interface{}{}
+	valuesMap := make(map[interface{}]bool)
+
+	op := "select_unique"
+	idx := search.Index
+	es.loadMapping(ctx, search, op)
+
+	query, err := search.GetQuery(op)
+	if err != nil {
+		return values, err
+	}
 
 	size := 10000
 	// Set up the request object.
@@ -41,34 +55,34 @@ func SelectUnique(r *http.Request, idx, body string) ([]interface{}, error) {
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(r.Context(), client)
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Error getting response. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return values, errors.New("Error counting documents!")
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Response error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return values, errors.New("Failed to count documents!")
 	}
 
 	var rr map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&rr)
 	if err != nil {
-		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res))
+		errors.Log(err, fmt.Sprintf("Decoding error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res))
 		return values, errors.New("Error decoding response!")
 	}
 
 	__hits, ok := rr["hits"].(map[string]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return values, errors.New("Assertion error!")
 	}
 
 	_hits, ok := __hits["hits"].([]interface{})
 	if !ok {
-		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+		errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 		return values, errors.New("Assertion error!")
 	}
 
@@ -76,13 +90,13 @@ func SelectUnique(r *http.Request, idx, body string) ([]interface{}, error) {
 		for _, valObj := range _hits {
 			__obj, ok := valObj.(map[string]interface{})
 			if !ok {
-				errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+				errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 				return values, errors.New("Assertion error!")
 			}
 
 			_obj, ok := __obj["_source"].(map[string]interface{})
 			if !ok {
-				errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Body: %s.\n Query: %s.\n Response: %v.\n", idx, body, query, res)))
+				errors.Log(errors.New(fmt.Sprintf("Assertion error. Index: %s.\n Query: %s.\n Response: %v.\n", idx, query, res)))
 				return values, errors.New("Assertion error!")
 			}
 
@@ -0,0 +1,237 @@
+package elastic
+
+import (
+	"datawaves/errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Dates should be in this format 'YYYY-MM-DDTHH:mm:ss.sssZ' like '2020-01-30T00:00:00.000Z'
+const timestampFormat = "2006-01-02T15:04:05.000Z"
+
+// Timeframe is either an absolute from/to pair or a relative window like
+// "this_7_days", "previous_1_month", "today" or "yesterday".
+// A relative timeframe can be sent as the whole value: "timeframe": "this_7_days",
+// it can't be sent with from or to.
+type Timeframe struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Relative string `json:"relative"`
+}
+
+func (timeframe *Timeframe) UnmarshalJSON(b []byte) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	var relative string
+	if err := json.Unmarshal(b, &relative); err == nil {
+		*timeframe = Timeframe{Relative: relative}
+		return nil
+	}
+
+	type plain Timeframe
+	var p plain
+	err := json.Unmarshal(b, &p)
+	if err != nil {
+		return err
+	}
+	*timeframe = Timeframe(p)
+
+	return nil
+}
+
+func (timeframe Timeframe) IsEmpty() bool {
+	return timeframe.From == "" && timeframe.To == "" && timeframe.Relative == ""
+}
+
+var relativeRe = regexp.MustCompile(`^(this|previous)_(\d+)_(minute|hour|day|week|month|quarter|year)s?$`)
+
+// Bounds resolves the timeframe against now in the timezone,
+// a zero time means the timeframe is open on that side.
+// Relative timeframes are aligned to the calendar, "previous_1_week" is
+// the whole last week and "this_2_days" is yesterday and today so far.
+func (timeframe Timeframe) Bounds(timezone string, now time.Time) (time.Time, time.Time, error) {
+	var from, to time.Time
+
+	if timeframe.Relative != "" && (timeframe.From != "" || timeframe.To != "") {
+		return from, to, errors.New("Invalid timeframe, it should be either relative or from/to!")
+	}
+
+	if timeframe.Relative == "" {
+		if timeframe.From != "" {
+			t, err := time.Parse(time.RFC3339, timeframe.From)
+			if err != nil {
+				return from, to, errors.New(fmt.Sprintf("Invalid timeframe from \"%s\", it should be like 2020-01-30T00:00:00.000Z!", timeframe.From))
+			}
+			from = t
+		}
+
+		if timeframe.To != "" {
+			t, err := time.Parse(time.RFC3339, timeframe.To)
+			if err != nil {
+				return from, to, errors.New(fmt.Sprintf("Invalid timeframe to \"%s\", it should be like 2020-01-30T00:00:00.000Z!", timeframe.To))
+			}
+			to = t
+		}
+
+		if !from.IsZero() && !to.IsZero() && from.After(to) {
+			return from, to, errors.New("Invalid timeframe, from is after to!")
+		}
+
+		return from, to, nil
+	}
+
+	loc, err := GetLocation(timezone)
+	if err != nil {
+		return from, to, err
+	}
+	now = now.In(loc)
+
+	relative := strings.ToLower(timeframe.Relative)
+	if relative == "today" {
+		relative = "this_1_days"
+	}
+	if relative == "yesterday" {
+		relative = "previous_1_days"
+	}
+
+	m := relativeRe.FindStringSubmatch(relative)
+	if m == nil {
+		return from, to, errors.New(fmt.Sprintf("Invalid timeframe \"%s\", it should be like this_7_days or previous_1_month!", timeframe.Relative))
+	}
+
+	n, err := strconv.Atoi(m[2])
+	if err != nil || n < 1 {
+		return from, to, errors.New(fmt.Sprintf("Invalid timeframe \"%s\", the number of units should be at least 1!", timeframe.Relative))
+	}
+
+	start := truncateTime(now, m[3])
+	if m[1] == "this" {
+		// the current unit counts as one
+		return addUnits(start, m[3], -(n - 1)), now, nil
+	}
+
+	return addUnits(start, m[3], -n), start, nil
+}
+
+// Query returns the range query on datawaves.timestamp for the timeframe,
+// no timeframe, or no end, means up to now.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
+func (timeframe Timeframe) Query(timezone string) (Query, error) {
+	q := RangeQuery{Field: "datawaves.timestamp", TimeZone: timezone}
+
+	if timeframe.IsEmpty() {
+		q.Lte = "now"
+		return q, nil
+	}
+
+	from, to, err := timeframe.Bounds(timezone, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if timeframe.Relative != "" {
+		// bounds are absolute instants already
+		q.TimeZone = ""
+		q.Gte = from.UTC().Format(timestampFormat)
+		q.Lt = to.UTC().Format(timestampFormat)
+		return q, nil
+	}
+
+	if !from.IsZero() {
+		q.Gte = timeframe.From
+	}
+
+	if !to.IsZero() {
+		q.Lte = timeframe.To
+	} else {
+		// events timestamped in the future are left out, as without timeframe
+		q.Lte = "now"
+	}
+
+	return q, nil
+}
+
+// GetLocation accepts the same timezones as elasticsearch,
+// IANA names like "America/Los_Angeles" and offsets like "+01:00".
+func GetLocation(timezone string) (*time.Location, error) {
+	if timezone == "" || strings.ToUpper(timezone) == "UTC" || timezone == "Z" {
+		return time.UTC, nil
+	}
+
+	if timezone[0] == '+' || timezone[0] == '-' {
+		offset := strings.ReplaceAll(timezone[1:], ":", "")
+		if len(offset) == 2 {
+			offset = offset + "00"
+		}
+
+		if len(offset) == 4 {
+			h, err := strconv.Atoi(offset[:2])
+			m, err2 := strconv.Atoi(offset[2:])
+			if err == nil && err2 == nil && h <= 18 && m < 60 {
+				seconds := h*3600 + m*60
+				if timezone[0] == '-' {
+					seconds = -seconds
+				}
+				return time.FixedZone(timezone, seconds), nil
+			}
+		}
+
+		return nil, errors.New(fmt.Sprintf("Invalid timezone \"%s\"!", timezone))
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid timezone \"%s\"!", timezone))
+	}
+
+	return loc, nil
+}
+
+// truncateTime returns the start of the calendar unit t is in, weeks start on monday like elasticsearch's.
+func truncateTime(t time.Time, unit string) time.Time {
+	switch unit {
+	case "minute":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "week":
+		d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case "quarter":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	return t
+}
+
+func addUnits(t time.Time, unit string, n int) time.Time {
+	switch unit {
+	case "minute":
+		return t.Add(time.Duration(n) * time.Minute)
+	case "hour":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "day":
+		return t.AddDate(0, 0, n)
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month":
+		return t.AddDate(0, n, 0)
+	case "quarter":
+		return t.AddDate(0, 3*n, 0)
+	case "year":
+		return t.AddDate(n, 0, 0)
+	}
+
+	return t
+}
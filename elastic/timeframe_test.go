@@ -0,0 +1,93 @@
+package elastic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeframeBounds(t *testing.T) {
+	// a tuesday
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	sunday := time.Date(2020, 3, 8, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		timeframe Timeframe
+		timezone  string
+		now       time.Time
+		from      string
+		to        string
+	}{
+		{"today", Timeframe{Relative: "today"}, "", now, "2020-03-10T00:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"yesterday", Timeframe{Relative: "yesterday"}, "", now, "2020-03-09T00:00:00.000Z", "2020-03-10T00:00:00.000Z"},
+		// this counts the current unit so far, previous only whole units
+		{"this days", Timeframe{Relative: "this_2_days"}, "", now, "2020-03-09T00:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"previous days", Timeframe{Relative: "previous_2_days"}, "", now, "2020-03-08T00:00:00.000Z", "2020-03-10T00:00:00.000Z"},
+		{"this hour", Timeframe{Relative: "this_1_hour"}, "", now.Add(30 * time.Minute), "2020-03-10T12:00:00.000Z", "2020-03-10T12:30:00.000Z"},
+		// weeks start on monday
+		{"this week", Timeframe{Relative: "this_1_week"}, "", now, "2020-03-09T00:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"previous week", Timeframe{Relative: "previous_1_week"}, "", now, "2020-03-02T00:00:00.000Z", "2020-03-09T00:00:00.000Z"},
+		{"this week on sunday", Timeframe{Relative: "this_1_week"}, "", sunday, "2020-03-02T00:00:00.000Z", "2020-03-08T12:00:00.000Z"},
+		{"previous month", Timeframe{Relative: "previous_1_month"}, "", now, "2020-02-01T00:00:00.000Z", "2020-03-01T00:00:00.000Z"},
+		{"this quarter", Timeframe{Relative: "this_1_quarter"}, "", now, "2020-01-01T00:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"previous quarters", Timeframe{Relative: "previous_2_quarters"}, "", now, "2019-07-01T00:00:00.000Z", "2020-01-01T00:00:00.000Z"},
+		{"previous year", Timeframe{Relative: "Previous_1_Year"}, "", now, "2019-01-01T00:00:00.000Z", "2020-01-01T00:00:00.000Z"},
+		// the units are aligned to the calendar of the time zone
+		{"today in a time zone", Timeframe{Relative: "today"}, "America/Los_Angeles", now, "2020-03-10T07:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"today in an offset", Timeframe{Relative: "today"}, "+05:30", now, "2020-03-09T18:30:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"today on the previous day", Timeframe{Relative: "today"}, "-13", now, "2020-03-09T13:00:00.000Z", "2020-03-10T12:00:00.000Z"},
+		{"week in a time zone", Timeframe{Relative: "this_1_week"}, "+14:00", sunday, "2020-03-08T10:00:00.000Z", "2020-03-08T12:00:00.000Z"},
+		{"absolute", Timeframe{From: "2020-01-01T00:00:00.000Z", To: "2020-02-01T00:00:00.000+01:00"}, "Europe/Paris", now, "2020-01-01T00:00:00.000Z", "2020-01-31T23:00:00.000Z"},
+		{"absolute without end", Timeframe{From: "2020-01-01T00:00:00.000Z"}, "", now, "2020-01-01T00:00:00.000Z", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := tt.timeframe.Bounds(tt.timezone, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := formatBound(from); got != tt.from {
+				t.Errorf("got from %s, want %s", got, tt.from)
+			}
+			if got := formatBound(to); got != tt.to {
+				t.Errorf("got to %s, want %s", got, tt.to)
+			}
+		})
+	}
+}
+
+// formatBound formats the bound in UTC, empty for an open side
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timestampFormat)
+}
+
+func TestTimeframeBoundsErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeframe Timeframe
+		timezone  string
+	}{
+		{"relative and absolute", Timeframe{Relative: "this_7_days", From: "2020-01-01T00:00:00.000Z"}, ""},
+		{"relative and end", Timeframe{Relative: "today", To: "2020-01-01T00:00:00.000Z"}, ""},
+		{"unknown unit", Timeframe{Relative: "this_7_fortnights"}, ""},
+		{"no unit", Timeframe{Relative: "this_0_days"}, ""},
+		{"invalid from", Timeframe{From: "2020-01-01"}, ""},
+		{"from after to", Timeframe{From: "2020-02-01T00:00:00.000Z", To: "2020-01-01T00:00:00.000Z"}, ""},
+		{"invalid time zone", Timeframe{Relative: "today"}, "Mars/Olympus"},
+		{"invalid offset", Timeframe{Relative: "today"}, "+19:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.timeframe.Bounds(tt.timezone, time.Now())
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
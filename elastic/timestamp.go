@@ -0,0 +1,153 @@
+package elastic
+
+import (
+	"datawaves/errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default window of the timestamps of recorded events around the time they are recorded
+const (
+	DefaultTimestampPast   = 10 * 365 * 24 * time.Hour
+	DefaultTimestampFuture = time.Hour
+)
+
+var timestampWindow = struct {
+	mu     sync.RWMutex
+	past   time.Duration
+	future time.Duration
+}{past: DefaultTimestampPast, future: DefaultTimestampFuture}
+
+// SetTimestampWindow changes how far in the past and in the future the timestamps
+// of recorded events can be, zero doesn't limit that side
+func SetTimestampWindow(past, future time.Duration) {
+	timestampWindow.mu.Lock()
+	defer timestampWindow.mu.Unlock()
+
+	timestampWindow.past = past
+	timestampWindow.future = future
+}
+
+// LoadTimestampWindow returns the environment's timestamp window, the TIMESTAMP_MAX_PAST
+// and TIMESTAMP_MAX_FUTURE environment variables like "3650d" or "1h", 0 doesn't limit that side.
+// The defaults are used for the ones that are not set.
+func LoadTimestampWindow() (time.Duration, time.Duration, error) {
+	past, err := windowDuration("TIMESTAMP_MAX_PAST", DefaultTimestampPast)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	future, err := windowDuration("TIMESTAMP_MAX_FUTURE", DefaultTimestampFuture)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return past, future, nil
+}
+
+func windowDuration(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	if v == "0" {
+		return 0, nil
+	}
+
+	d, err := ParseDuration(v)
+	if err != nil {
+		errors.Log(err, "Invalid "+name+".")
+		return 0, errors.New(fmt.Sprintf("Invalid %s \"%s\", it should be like 3650d, 12h or 0!", name, v))
+	}
+
+	return d, nil
+}
+
+// ISO 8601 variants of the timestamps, without offset they are in UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds,
+// in seconds it is in the year 5138 and in milliseconds in 1973
+const epochMillisThreshold = 1e11
+
+// parseTimestamp parses a timestamp in one of the timestampLayouts or in epoch
+// seconds or milliseconds, as a number or a string
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	switch x := v.(type) {
+	case string:
+		s := strings.TrimSpace(x)
+		for _, layout := range timestampLayouts {
+			t, err := time.Parse(layout, s)
+			if err == nil {
+				return t.UTC(), true
+			}
+		}
+
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return parseEpoch(f)
+		}
+	case float64:
+		return parseEpoch(x)
+	}
+
+	return time.Time{}, false
+}
+
+func parseEpoch(f float64) (time.Time, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || f < 0 {
+		return time.Time{}, false
+	}
+
+	millis := f
+	if f < epochMillisThreshold {
+		millis = f * 1000
+	}
+	if millis > float64(math.MaxInt64/int64(time.Millisecond)) {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(millis*float64(time.Millisecond))).UTC(), true
+}
+
+// eventTimestamp returns the event's timestamp if it has one in the timestamp window
+// around now, or else what is wrong with it
+func eventTimestamp(data map[string]interface{}, now time.Time) (time.Time, bool, string) {
+	v, ok := data["timestamp"]
+	if !ok || v == nil {
+		return time.Time{}, false, ""
+	}
+
+	t, ok := parseTimestamp(v)
+	if !ok {
+		return t, false, "timestamp should be a date like 2020-01-30T00:00:00.000Z or epoch seconds or milliseconds, got " + describeValue(v)
+	}
+
+	timestampWindow.mu.RLock()
+	past, future := timestampWindow.past, timestampWindow.future
+	timestampWindow.mu.RUnlock()
+
+	if past > 0 && t.Before(now.Add(-past)) {
+		return t, false, "timestamp should be at most " + past.String() + " in the past, got " + describeValue(v)
+	}
+	if future > 0 && t.After(now.Add(future)) {
+		return t, false, "timestamp should be at most " + future.String() + " in the future, got " + describeValue(v)
+	}
+
+	return t, true, ""
+}
@@ -1,17 +1,81 @@
 package main
 
 import (
+	"context"
+	"datawaves/elastic"
+	"datawaves/errors"
 	"datawaves/handlers"
 	"datawaves/util"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/cors"
 	muxtrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/gorilla/mux"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+// clustersReloadInterval is how often the registry of the dedicated elasticsearch clusters is reloaded
+const clustersReloadInterval = 5 * time.Minute
+
 func main() {
+	if err := elastic.Connect(); err != nil {
+		panic(err)
+	}
+
+	// the projects not migrated yet keep writing to their legacy indices
+	if err := elastic.LoadIndexNames(context.Background()); err != nil {
+		panic(err)
+	}
+
+	// the dedicated clusters are reloaded on SIGHUP, and periodically as the registry is a secret,
+	// with the index names to see the projects migrated by other servers
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(clustersReloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-reload:
+			case <-ticker.C:
+			}
+
+			if err := elastic.ReloadClusters(); err != nil {
+				errors.Log(err, "Error reloading the elasticsearch clusters.")
+			}
+			if err := elastic.LoadIndexNames(context.Background()); err != nil {
+				errors.Log(err, "Error reloading the elasticsearch index names.")
+			}
+		}
+	}()
+
+	// reindexings running when the server stopped are moved along again
+	if err := elastic.ResumeReindexings(context.Background()); err != nil {
+		errors.Log(err, "Error resuming the reindexings.")
+	}
+
+	// how far in the past and in the future the timestamps of recorded events can be
+	past, future, err := elastic.LoadTimestampWindow()
+	if err != nil {
+		panic(err)
+	}
+	elastic.SetTimestampWindow(past, future)
+
+	// with a buffer directory recorded events are flushed in bulks, the ones not flushed yet
+	// survive a crash in the directory, without one they are indexed one by one
+	var buffer *elastic.Buffer
+	if bufferConfig, ok := elastic.LoadBufferConfig(); ok {
+		buffer, err = elastic.NewBuffer(bufferConfig)
+		if err != nil {
+			panic(err)
+		}
+		elastic.SetBuffer(buffer)
+	}
+
 	handlers.ParseTemplates()
 
 	if util.IsProduction() {
@@ -37,7 +101,27 @@ func main() {
 		port = "8080"
 	}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		panic(err)
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// the requests in progress finish, then the buffered events are flushed
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		errors.Log(err, "Error shutting down the server.")
+	}
+	if buffer != nil {
+		if err := buffer.Close(ctx); err != nil {
+			errors.Log(err, "Error draining the ingestion buffer.")
+		}
 	}
 }